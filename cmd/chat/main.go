@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"fmt"
 	"net/http"
 	"os"
@@ -14,17 +15,22 @@ import (
 	"github.com/adrian83/chat/pkg/db"
 	"github.com/adrian83/chat/pkg/exchange"
 	"github.com/adrian83/chat/pkg/handler"
+	"github.com/adrian83/chat/pkg/history"
+	"github.com/adrian83/chat/pkg/room"
 	"github.com/adrian83/chat/pkg/user"
 
 	session "github.com/adrian83/go-redis-session"
 	"github.com/go-redis/redis"
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 	logger "github.com/sirupsen/logrus"
-	"golang.org/x/net/websocket"
 )
 
 const (
 	configPrefix = "chat"
+
+	// frameOverhead is a space left in websocket frames for message fields other than content.
+	frameOverhead = 4096
 )
 
 func initLogger() {
@@ -42,11 +48,29 @@ func initConfig() *config.Config {
 		panic(err)
 	}
 
+	if err := validateConfig(appConfig); err != nil {
+		logger.Errorf("Invalid configuration! Error: %v", err)
+		panic(err)
+	}
+
 	logger.Infof("Reading configuration from environment variables: %v", appConfig)
 
 	return appConfig
 }
 
+// validateConfig checks properties which would make clients misbehave instead of failing.
+func validateConfig(config *config.Config) error {
+	if _, err := exchange.ParseSlowConsumerPolicy(config.SlowConsumerPolicy); err != nil {
+		return err
+	}
+
+	if config.OutboundQueueSize <= 0 {
+		return fmt.Errorf("outbound queue size must be positive, got %v", config.OutboundQueueSize)
+	}
+
+	return nil
+}
+
 func initRethink(config *config.Config) *db.RethinkDB {
 
 	rethink := db.NewRethinkDB(config.DatabaseHost, config.DatabasePort, config.DatabaseName)
@@ -66,6 +90,53 @@ func initRethink(config *config.Config) *db.RethinkDB {
 	return rethink
 }
 
+func rateLimits(config *config.Config) exchange.RateLimits {
+	return exchange.RateLimits{
+		Text:           exchange.RateLimit{PerSecond: config.RateTextPerSecond, Burst: config.RateTextBurst},
+		Create:         exchange.RateLimit{PerSecond: config.RateCreatePerSecond, Burst: config.RateCreateBurst},
+		Join:           exchange.RateLimit{PerSecond: config.RateJoinPerSecond, Burst: config.RateJoinBurst},
+		Other:          exchange.RateLimit{PerSecond: config.RateOtherPerSecond, Burst: config.RateOtherBurst},
+		UserMultiplier: config.RateUserMultiplier,
+		Warnings:       config.RateWarnings,
+		MuteDuration:   config.RateMuteDuration,
+		Mutes:          config.RateMutes,
+		QuietPeriod:    config.RateQuietPeriod,
+	}
+}
+
+func resumeLimits(config *config.Config) exchange.ResumeLimits {
+	return exchange.ResumeLimits{
+		Window:      config.ResumeWindow,
+		MaxMessages: config.ResumeMaxMessages,
+	}
+}
+
+func heartbeat(config *config.Config) exchange.Heartbeat {
+	return exchange.Heartbeat{
+		Interval:     config.HeartbeatInterval,
+		ReadTimeout:  config.ReadTimeout,
+		WriteTimeout: config.WriteTimeout,
+	}
+}
+
+func compression(config *config.Config) exchange.Compression {
+	return exchange.Compression{
+		Enabled:   config.CompressionEnabled,
+		Level:     config.CompressionLevel,
+		Threshold: config.CompressionThreshold,
+	}
+}
+
+// maxFrameSize returns the size of the longest message accepted from a
+// websocket client. If it is not configured, it is derived from the maximal
+// size of a text message, leaving place for escaping and other fields.
+func maxFrameSize(config *config.Config) int64 {
+	if config.MaxFrameSize > 0 {
+		return config.MaxFrameSize
+	}
+	return 2*int64(config.MaxMessageSize) + frameOverhead
+}
+
 func initSession(config *config.Config) (*session.Store, func()) {
 	options := &redis.Options{
 		Addr:     fmt.Sprintf("%v:%v", config.SessionDbHost, config.SessionDbPort),
@@ -103,9 +174,6 @@ func main() {
 	sessionStore, closeFnc := initSession(appConfig)
 	defer closeFnc()
 
-	// create chat rooms
-	chatRooms := exchange.NewRooms()
-
 	// ---------------------------------------
 	// useful structures
 	// ---------------------------------------
@@ -113,6 +181,21 @@ func main() {
 	userTable := rethink.GetUserTable()
 	userService := user.NewUserService(userTable)
 
+	messageTable := rethink.GetMessageTable()
+	conversationTable := rethink.GetConversationTable()
+	reactionTable := rethink.GetReactionTable()
+	readMarkerTable := rethink.GetReadMarkerTable()
+	historyService := history.NewHistoryService(messageTable, conversationTable, reactionTable, readMarkerTable)
+
+	// create chat rooms
+	roomTable := rethink.GetRoomTable()
+	roomService := room.NewRoomService(roomTable)
+
+	chatRooms := exchange.NewRooms(historyService, roomService, appConfig.HistorySize, appConfig.EmptyRoomGrace, appConfig.MaxMessageSize, resumeLimits(appConfig),
+		appConfig.MainRoomOwner)
+
+	rateLimiter := exchange.NewRateLimiter(rateLimits(appConfig))
+
 	templateRepository := handler.NewTemplateRepository(appConfig.StaticsPath)
 
 	loginHandler := handler.NewLoginHandler(templateRepository, userService, sessionStore)
@@ -139,7 +222,18 @@ func main() {
 
 	router.HandleFunc("/conversation", conversationHandler.ShowConversationPage).Methods("GET")
 
-	router.Handle("/talk", websocket.Handler(connect(sessionStore, chatRooms)))
+	connectClient := connect(sessionStore, chatRooms, historyService, userService, rateLimiter, appConfig.HistoryPageSize,
+		appConfig.OutboundQueueSize, exchange.SlowConsumerPolicy(appConfig.SlowConsumerPolicy))
+
+	router.HandleFunc("/talk", talk(connectClient, heartbeat(appConfig), compression(appConfig), maxFrameSize(appConfig)))
+
+	transportHandler := handler.NewTransportHandler(connectClient, heartbeat(appConfig), appConfig.PollTimeout)
+
+	router.HandleFunc("/sse", transportHandler.StreamEvents).Methods("GET")
+	router.HandleFunc("/sse/{token}", transportHandler.Post).Methods("POST")
+	router.HandleFunc("/poll", transportHandler.OpenPolling).Methods("POST")
+	router.HandleFunc("/poll/{token}", transportHandler.Poll).Methods("GET")
+	router.HandleFunc("/poll/{token}", transportHandler.Post).Methods("POST")
 
 	// ---------------------------------------
 	// http server
@@ -151,12 +245,13 @@ func main() {
 	serverAddress := appConfig.ServerHost + ":" + strconv.Itoa(appConfig.ServerPort)
 	logger.Infof("Starting server on: %v", serverAddress)
 	server := &http.Server{Addr: serverAddress, Handler: router}
+	go serve(server)
 
-	go func() {
-		if err := server.ListenAndServe(); err != nil {
-			logger.Errorf("Server error! Error: %v", err)
-		}
-	}()
+	admin := adminServer(appConfig)
+	if admin != nil {
+		logger.Infof("Starting admin server on: %v", admin.Addr)
+		go serve(admin)
+	}
 
 	<-stopChan
 
@@ -167,46 +262,145 @@ func main() {
 		logger.Warnf("Error while stopping server. Error: %v", err)
 	}
 
+	if admin != nil {
+		if err := admin.Shutdown(ctx); err != nil {
+			logger.Warnf("Error while stopping admin server. Error: %v", err)
+		}
+	}
+
 	logger.Info("Server stopped.")
 }
 
-func connect(sessionStore *session.Store, chatRooms *exchange.Rooms) func(*websocket.Conn) {
-	logger.Infof("New connection")
+// adminServer returns server exposing metrics (/debug/vars) on a separate
+// address, which shouldn't be reachable by users of the chat. Returns nil
+// if admin port is not configured.
+func adminServer(config *config.Config) *http.Server {
+	if config.AdminPort <= 0 {
+		return nil
+	}
+
+	router := http.NewServeMux()
+	router.Handle("/debug/vars", expvar.Handler())
+
+	return &http.Server{Addr: config.AdminHost + ":" + strconv.Itoa(config.AdminPort), Handler: router}
+}
+
+func serve(server *http.Server) {
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Errorf("Server error! Error: %v", err)
+	}
+}
 
-	return func(wsc *websocket.Conn) {
-		sessionID, err := handler.ReadSessionIDFromCookie(wsc.Request())
+func connect(
+	sessionStore *session.Store,
+	chatRooms *exchange.Rooms,
+	historyService *history.Service,
+	userService *user.Service,
+	rateLimiter *exchange.RateLimiter,
+	historyPageSize int,
+	queueSize int,
+	policy exchange.SlowConsumerPolicy,
+) handler.Connect {
+	commands := exchange.NewCommands(userService)
+
+	return func(req *http.Request, transport exchange.Transport) (handler.Client, error) {
+		sessionID, err := handler.ReadSessionIDFromCookie(req)
 		if err != nil {
-			logger.Error(err)
-			return
+			return nil, err
 		}
 
 		sess, err := sessionStore.Find(sessionID)
 		if err != nil {
-			logger.Errorf("Error while getting user session. Error: %v", err)
-			return
+			return nil, errors.Wrap(err, "error while getting user session")
 		}
 
 		var user user.User
 		if err = sess.Get("user", &user); err != nil {
-			logger.Errorf("Error while getting user data from session. Error: %v", err)
-			return
+			return nil, errors.Wrap(err, "error while getting user data from session")
 		}
 
 		router := exchange.NewRouter()
 
-		wsConn := exchange.NewWebSocketConn(wsc)
-		client := exchange.NewClient(sessionID, &user, chatRooms, wsConn, router)
+		client := exchange.NewClient(exchange.NewClientID(), &user, chatRooms, transport, router, queueSize, policy)
+
+		router.Use(
+			exchange.RecoveryMiddleware(client),
+			exchange.LoggingMiddleware(client),
+			exchange.RateLimitMiddleware(rateLimiter, client),
+			exchange.MetricsMiddleware(),
+			exchange.ValidationMiddleware(client),
+		)
 
+		router.NotFound(exchange.NewUnknownTypeHandler(client))
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgHelloMT, exchange.NewHelloHandler(client)))
 		router.RegisterRoute(exchange.NewRoute(exchange.MsgUserJoinedRoomMT, exchange.NewAddClientToRoomHandler(chatRooms, client)))
-		router.RegisterRoute(exchange.NewRoute(exchange.MsgTextMsgMT, exchange.NewSendMsgToRoomHandler(chatRooms)))
+		sendMsgHandler := exchange.NewSendMsgToRoomHandler(chatRooms, historyService, client)
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgTextMsgMT, exchange.NewCommandHandler(commands, router, client, sendMsgHandler)))
 		router.RegisterRoute(exchange.NewRoute(exchange.MsgCreateRoomMT, exchange.NewCreateRoomHandler(chatRooms, client)))
 		router.RegisterRoute(exchange.NewRoute(exchange.MsgUserLeftRoomMT, exchange.NewRemoveClientFromRoomHandler(chatRooms, client)))
 		router.RegisterRoute(exchange.NewRoute(exchange.MsgLogoutMT, exchange.NewLogoutHandler(client)))
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgHistoryRequestMT, exchange.NewHistoryRequestHandler(chatRooms, historyService, client, historyPageSize)))
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgThreadRequestMT, exchange.NewThreadRequestHandler(chatRooms, historyService, client, historyPageSize)))
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgDirectMsgMT, exchange.NewDirectMsgHandler(chatRooms, historyService, userService, client)))
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgConversationsMT, exchange.NewConversationsHandler(historyService, client)))
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgRoomMembersMT, exchange.NewRoomMembersHandler(chatRooms, client)))
+
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgEditMsgMT, exchange.NewEditMsgHandler(chatRooms, historyService, client)))
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgDeleteMsgMT, exchange.NewDeleteMsgHandler(chatRooms, historyService, client)))
+
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgMarkReadMT, exchange.NewMarkReadHandler(chatRooms, historyService, client)))
 
-		chatRooms.AddClientToRoom(exchange.MainRoomName(), client)
+		moderationHandler := exchange.NewModerationHandler(chatRooms, client)
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgKickUserMT, moderationHandler))
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgBanUserMT, moderationHandler))
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgMuteUserMT, moderationHandler))
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgAddModeratorMT, moderationHandler))
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgRemoveModeratorMT, moderationHandler))
+
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgRoomUpdateMT, exchange.NewRoomUpdateHandler(chatRooms, userService, client)))
+
+		invitationHandler := exchange.NewInvitationHandler(chatRooms, userService, client)
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgInviteMT, invitationHandler))
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgInviteAcceptMT, invitationHandler))
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgInviteDeclineMT, invitationHandler))
+
+		reactionHandler := exchange.NewReactionHandler(chatRooms, historyService, client)
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgReactMT, reactionHandler))
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgUnreactMT, reactionHandler))
+
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgResumeMT, exchange.NewResumeHandler(chatRooms, client)))
+
+		typingHandler := exchange.NewTypingHandler(chatRooms, client)
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgTypingStartMT, typingHandler))
+		router.RegisterRoute(exchange.NewRoute(exchange.MsgTypingStopMT, typingHandler))
+
+		chatRooms.RegisterClient(client)
+		chatRooms.AddClientToRoom("", exchange.MainRoomName(), "", client)
 
 		logger.Infof("New connection received from %v, %v", client, &user)
 
+		return client, nil
+	}
+}
+
+// talk returns handler upgrading requests to websocket connections and
+// connecting clients using given function. Messages longer than 'readLimit'
+// bytes close the connection.
+func talk(connectClient handler.Connect, heartbeat exchange.Heartbeat, compression exchange.Compression, readLimit int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		wsConn, err := exchange.Upgrade(w, req, heartbeat, compression, readLimit)
+		if err != nil {
+			logger.Warnf("Error while opening websocket connection. Error: %v", err)
+			return
+		}
+
+		client, err := connectClient(req, wsConn)
+		if err != nil {
+			logger.Errorf("Error while connecting client. Error: %v", err)
+			wsConn.Close()
+			return
+		}
+
 		client.Start()
 	}
 }
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	"github.com/kelseyhightower/envconfig"
 )
 
@@ -16,14 +18,46 @@ func ReadConfig(prefix string) (*Config, error) {
 
 // Config is a struct representing whole application configuration.
 type Config struct {
-	ServerPort        int    `json:"serverPort" envconfig:"SERVER_PORT"`
-	ServerHost        string `json:"serverHost" envconfig:"SERVER_HOST"`
-	SessionDbName     int    `json:"sessionDbName" envconfig:"SESSION_DB_NAME"`
-	SessionDbPassword string `json:"sessionDbPassword" envconfig:"SESSION_DB_PASSWORD"`
-	SessionDbHost     string `json:"sessionDbHost" envconfig:"SESSION_DB_HOST"`
-	SessionDbPort     int    `json:"sessionDbPort" envconfig:"SESSION_DB_PORT"`
-	DatabaseHost      string `json:"databaseHost" envconfig:"DATABASE_HOST"`
-	DatabasePort      int    `json:"databasePort" envconfig:"DATABASE_PORT"`
-	DatabaseName      string `json:"databaseName" envconfig:"DATABASE_NAME"`
-	StaticsPath       string `json:"staticsPath" envconfig:"STATICS_PATH"`
+	ServerPort           int           `json:"serverPort" envconfig:"SERVER_PORT"`
+	ServerHost           string        `json:"serverHost" envconfig:"SERVER_HOST"`
+	AdminPort            int           `json:"adminPort" envconfig:"ADMIN_PORT" default:"7071"`
+	AdminHost            string        `json:"adminHost" envconfig:"ADMIN_HOST" default:"127.0.0.1"`
+	SessionDbName        int           `json:"sessionDbName" envconfig:"SESSION_DB_NAME"`
+	SessionDbPassword    string        `json:"sessionDbPassword" envconfig:"SESSION_DB_PASSWORD"`
+	SessionDbHost        string        `json:"sessionDbHost" envconfig:"SESSION_DB_HOST"`
+	SessionDbPort        int           `json:"sessionDbPort" envconfig:"SESSION_DB_PORT"`
+	DatabaseHost         string        `json:"databaseHost" envconfig:"DATABASE_HOST"`
+	DatabasePort         int           `json:"databasePort" envconfig:"DATABASE_PORT"`
+	DatabaseName         string        `json:"databaseName" envconfig:"DATABASE_NAME"`
+	StaticsPath          string        `json:"staticsPath" envconfig:"STATICS_PATH"`
+	HistorySize          int           `json:"historySize" envconfig:"HISTORY_SIZE" default:"50"`
+	HistoryPageSize      int           `json:"historyPageSize" envconfig:"HISTORY_PAGE_SIZE" default:"50"`
+	MaxMessageSize       int           `json:"maxMessageSize" envconfig:"MAX_MESSAGE_SIZE" default:"4096"`
+	MaxFrameSize         int64         `json:"maxFrameSize" envconfig:"MAX_FRAME_SIZE" default:"0"`
+	MainRoomOwner        string        `json:"mainRoomOwner" envconfig:"MAIN_ROOM_OWNER"`
+	EmptyRoomGrace       time.Duration `json:"emptyRoomGrace" envconfig:"EMPTY_ROOM_GRACE" default:"0s"`
+	RateTextPerSecond    float64       `json:"rateTextPerSecond" envconfig:"RATE_TEXT_PER_SECOND" default:"2"`
+	RateTextBurst        int           `json:"rateTextBurst" envconfig:"RATE_TEXT_BURST" default:"10"`
+	RateCreatePerSecond  float64       `json:"rateCreatePerSecond" envconfig:"RATE_CREATE_PER_SECOND" default:"0.1"`
+	RateCreateBurst      int           `json:"rateCreateBurst" envconfig:"RATE_CREATE_BURST" default:"3"`
+	RateJoinPerSecond    float64       `json:"rateJoinPerSecond" envconfig:"RATE_JOIN_PER_SECOND" default:"0.5"`
+	RateJoinBurst        int           `json:"rateJoinBurst" envconfig:"RATE_JOIN_BURST" default:"10"`
+	RateOtherPerSecond   float64       `json:"rateOtherPerSecond" envconfig:"RATE_OTHER_PER_SECOND" default:"10"`
+	RateOtherBurst       int           `json:"rateOtherBurst" envconfig:"RATE_OTHER_BURST" default:"40"`
+	RateUserMultiplier   float64       `json:"rateUserMultiplier" envconfig:"RATE_USER_MULTIPLIER" default:"2"`
+	RateWarnings         int           `json:"rateWarnings" envconfig:"RATE_WARNINGS" default:"3"`
+	RateMuteDuration     time.Duration `json:"rateMuteDuration" envconfig:"RATE_MUTE_DURATION" default:"30s"`
+	RateMutes            int           `json:"rateMutes" envconfig:"RATE_MUTES" default:"2"`
+	RateQuietPeriod      time.Duration `json:"rateQuietPeriod" envconfig:"RATE_QUIET_PERIOD" default:"5m"`
+	OutboundQueueSize    int           `json:"outboundQueueSize" envconfig:"OUTBOUND_QUEUE_SIZE" default:"256"`
+	SlowConsumerPolicy   string        `json:"slowConsumerPolicy" envconfig:"SLOW_CONSUMER_POLICY" default:"disconnect"`
+	HeartbeatInterval    time.Duration `json:"heartbeatInterval" envconfig:"HEARTBEAT_INTERVAL" default:"25s"`
+	ReadTimeout          time.Duration `json:"readTimeout" envconfig:"READ_TIMEOUT" default:"60s"`
+	WriteTimeout         time.Duration `json:"writeTimeout" envconfig:"WRITE_TIMEOUT" default:"10s"`
+	ResumeWindow         time.Duration `json:"resumeWindow" envconfig:"RESUME_WINDOW" default:"2m"`
+	ResumeMaxMessages    int           `json:"resumeMaxMessages" envconfig:"RESUME_MAX_MESSAGES" default:"500"`
+	PollTimeout          time.Duration `json:"pollTimeout" envconfig:"POLL_TIMEOUT" default:"25s"`
+	CompressionEnabled   bool          `json:"compressionEnabled" envconfig:"COMPRESSION_ENABLED" default:"true"`
+	CompressionLevel     int           `json:"compressionLevel" envconfig:"COMPRESSION_LEVEL" default:"1"`
+	CompressionThreshold int           `json:"compressionThreshold" envconfig:"COMPRESSION_THRESHOLD" default:"512"`
 }
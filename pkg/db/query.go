@@ -0,0 +1,135 @@
+package db
+
+import (
+	r "gopkg.in/gorethink/gorethink.v4"
+)
+
+type condition struct {
+	property string
+	value    interface{}
+	compare  func(field r.Term, value interface{}) r.Term
+}
+
+// NewQuery returns new, empty Query which matches all elements of a table.
+func NewQuery() *Query {
+	return &Query{
+		conditions: make([]condition, 0),
+	}
+}
+
+// Query is a struct used for building filtered, sorted and limited
+// selections of table elements.
+type Query struct {
+	index      string
+	keys       []interface{}
+	lower      interface{}
+	upper      interface{}
+	conditions []condition
+	orderBy    string
+	descending bool
+	limit      int
+}
+
+// Between narrows query to elements with values of given secondary index
+// between given lower (inclusive) and upper (exclusive) bounds. Elements can
+// be ordered by the index with OrderBy given the name of the index.
+func (q *Query) Between(index string, lower, upper interface{}) *Query {
+	q.index = index
+	q.lower = lower
+	q.upper = upper
+	return q
+}
+
+// GetAll narrows query to elements with values of given secondary index equal
+// to one of given keys. Values of compound indexes are slices of values of
+// their properties. Elements cannot be ordered by the index.
+func (q *Query) GetAll(index string, keys ...interface{}) *Query {
+	q.index = index
+	q.keys = keys
+	return q
+}
+
+// Equal narrows query to elements with given property equal to given value.
+func (q *Query) Equal(property string, value interface{}) *Query {
+	return q.where(property, value, func(field r.Term, value interface{}) r.Term { return field.Eq(value) })
+}
+
+// Less narrows query to elements with given property lower than given value.
+func (q *Query) Less(property string, value interface{}) *Query {
+	return q.where(property, value, func(field r.Term, value interface{}) r.Term { return field.Lt(value) })
+}
+
+// Greater narrows query to elements with given property greater than given value.
+func (q *Query) Greater(property string, value interface{}) *Query {
+	return q.where(property, value, func(field r.Term, value interface{}) r.Term { return field.Gt(value) })
+}
+
+// Contains narrows query to elements with given array property containing given value.
+func (q *Query) Contains(property string, value interface{}) *Query {
+	return q.where(property, value, func(field r.Term, value interface{}) r.Term { return field.Contains(value) })
+}
+
+// In narrows query to elements with given property equal to one of given values.
+func (q *Query) In(property string, values ...interface{}) *Query {
+	return q.where(property, values, func(field r.Term, values interface{}) r.Term { return r.Expr(values).Contains(field) })
+}
+
+// OrderBy sorts elements by given property or, after Between, by values
+// of the index if given property is the name of the index.
+func (q *Query) OrderBy(property string, descending bool) *Query {
+	q.orderBy = property
+	q.descending = descending
+	return q
+}
+
+// Limit sets maximal number of returned elements.
+func (q *Query) Limit(limit int) *Query {
+	q.limit = limit
+	return q
+}
+
+func (q *Query) where(property string, value interface{}, compare func(r.Term, interface{}) r.Term) *Query {
+	q.conditions = append(q.conditions, condition{
+		property: property,
+		value:    value,
+		compare:  compare,
+	})
+	return q
+}
+
+func (q *Query) build(table r.Term) r.Term {
+	term := table
+
+	// index has to be used before filtering
+	switch {
+	case q.keys != nil:
+		term = term.GetAllByIndex(q.index, q.keys...)
+	case q.index != "":
+		term = term.Between(q.lower, q.upper, r.BetweenOpts{Index: q.index})
+
+		if q.orderBy == q.index {
+			term = term.OrderBy(r.OrderByOpts{Index: q.order(q.index)})
+		}
+	}
+
+	for _, c := range q.conditions {
+		term = term.Filter(c.compare(r.Row.Field(c.property), c.value))
+	}
+
+	if q.orderBy != "" && q.orderBy != q.index {
+		term = term.OrderBy(q.order(q.orderBy))
+	}
+
+	if q.limit > 0 {
+		term = term.Limit(q.limit)
+	}
+
+	return term
+}
+
+func (q *Query) order(property string) r.Term {
+	if q.descending {
+		return r.Desc(property)
+	}
+	return r.Asc(property)
+}
@@ -6,11 +6,72 @@ import (
 
 	logger "github.com/sirupsen/logrus"
 	r "gopkg.in/gorethink/gorethink.v4"
+	"gopkg.in/gorethink/gorethink.v4/encoding"
 )
 
 const (
 	usersTableName    = "users"
 	usersTableNameKey = "name"
+
+	messagesTableName    = "messages"
+	messagesTableNameKey = "id"
+
+	conversationsTableName    = "conversations"
+	conversationsTableNameKey = "id"
+
+	reactionsTableName    = "reactions"
+	reactionsTableNameKey = "id"
+
+	readMarkersTableName    = "read_markers"
+	readMarkersTableNameKey = "id"
+
+	roomsTableName    = "rooms"
+	roomsTableNameKey = "name"
+)
+
+// tables maps names of all tables used by the application to their primary keys.
+var tables = map[string]string{
+	usersTableName:         usersTableNameKey,
+	messagesTableName:      messagesTableNameKey,
+	conversationsTableName: conversationsTableNameKey,
+	reactionsTableName:     reactionsTableNameKey,
+	readMarkersTableName:   readMarkersTableNameKey,
+	roomsTableName:         roomsTableNameKey,
+}
+
+// Secondary indexes of messages table. Each of them is compound of
+// the properties named in its name.
+const (
+	RoomSequenceIndex       = "room_sequence"
+	ParentSequenceIndex     = "parentId_sequence"
+	ConversationTimeIDIndex = "conversation_time_id"
+	SenderClientMsgIDIndex  = "senderName_clientMsgId"
+)
+
+// Secondary indexes of reactions table.
+const (
+	ReactionMessageIndex = "messageId"
+)
+
+// indexes maps names of tables to their secondary indexes and properties
+// these indexes are built from. Indexes built from a single property are simple.
+var indexes = map[string]map[string][]string{
+	messagesTableName: {
+		RoomSequenceIndex:       {"room", "sequence"},
+		ParentSequenceIndex:     {"parentId", "sequence"},
+		ConversationTimeIDIndex: {"conversation", "time", "id"},
+		SenderClientMsgIDIndex:  {"senderName", "clientMsgId"},
+	},
+	reactionsTableName: {
+		ReactionMessageIndex: {"messageId"},
+	},
+}
+
+// MinValue and MaxValue are bounds of ranges of index values, which are
+// lower and greater than any other value.
+var (
+	MinValue interface{} = r.MinVal
+	MaxValue interface{} = r.MaxVal
 )
 
 // RethinkDB is a struct that allows communication with RethinkDB.
@@ -58,13 +119,19 @@ func (rt *RethinkDB) Setup() error {
 		}
 	}
 
-	tableExists, err := rt.containsTable(usersTableName)
-	if err != nil {
-		return fmt.Errorf("cannot check if table %v exist, error: %w", usersTableName, err)
-	}
+	for tableName, primaryKey := range tables {
+		tableExists, err := rt.containsTable(tableName)
+		if err != nil {
+			return fmt.Errorf("cannot check if table %v exist, error: %w", tableName, err)
+		}
 
-	if !tableExists {
-		if err := rt.createTable(usersTableName, usersTableNameKey); err != nil {
+		if !tableExists {
+			if err := rt.createTable(tableName, primaryKey); err != nil {
+				return err
+			}
+		}
+
+		if err := rt.createIndexes(tableName, indexes[tableName]); err != nil {
 			return err
 		}
 	}
@@ -95,9 +162,64 @@ func (rt *RethinkDB) UUID() (string, error) {
 }
 
 func (rt *RethinkDB) createTable(tableName, primaryKey string) error {
-	_, err := r.DB(rt.name).TableCreate(tableName, r.TableCreateOpts{PrimaryKey: primaryKey}).Run(rt.session)
+	if _, err := r.DB(rt.name).TableCreate(tableName, r.TableCreateOpts{PrimaryKey: primaryKey}).Run(rt.session); err != nil {
+		return fmt.Errorf("cannot create table %v with primary key %v, error: %w", tableName, primaryKey, err)
+	}
+
+	return nil
+}
+
+// createIndexes creates missing indexes of given table and waits until they are ready.
+func (rt *RethinkDB) createIndexes(tableName string, tableIndexes map[string][]string) error {
+	if len(tableIndexes) == 0 {
+		return nil
+	}
+
+	table := r.DB(rt.name).Table(tableName)
+
+	cursor, err := table.IndexList().Run(rt.session)
+	if err != nil {
+		return fmt.Errorf("cannot list indexes of table %v, error: %w", tableName, err)
+	}
+
+	existing := make([]string, 0)
+	if err := cursor.All(&existing); err != nil {
+		return fmt.Errorf("cannot fetch indexes of table %v, error: %w", tableName, err)
+	}
+
+	created := make(map[string]bool, len(existing))
+	for _, name := range existing {
+		created[name] = true
+	}
+
+	for name, properties := range tableIndexes {
+		if created[name] {
+			continue
+		}
+
+		properties := properties
+		index := func(row r.Term) interface{} {
+			if len(properties) == 1 {
+				return row.Field(properties[0])
+			}
+
+			fields := make([]interface{}, 0, len(properties))
+			for _, property := range properties {
+				fields = append(fields, row.Field(property))
+			}
+			return fields
+		}
 
-	return fmt.Errorf("cannot create table %v with primary key %v, error: %v", tableName, primaryKey, err.Error())
+		if _, err := table.IndexCreateFunc(name, index).RunWrite(rt.session); err != nil {
+			return fmt.Errorf("cannot create index %v of table %v, error: %w", name, tableName, err)
+		}
+	}
+
+	if _, err := table.IndexWait().Run(rt.session); err != nil {
+		return fmt.Errorf("cannot wait for indexes of table %v, error: %w", tableName, err)
+	}
+
+	return nil
 }
 
 func (rt *RethinkDB) containsDB() (bool, error) {
@@ -133,9 +255,38 @@ func (rt *RethinkDB) boolResp(cursor *r.Cursor) (bool, error) {
 
 // GetUserTable returns users table.
 func (rt *RethinkDB) GetUserTable() *RethinkTable {
+	return rt.table(usersTableName)
+}
+
+// GetMessageTable returns messages table.
+func (rt *RethinkDB) GetMessageTable() *RethinkTable {
+	return rt.table(messagesTableName)
+}
+
+// GetConversationTable returns conversations table.
+func (rt *RethinkDB) GetConversationTable() *RethinkTable {
+	return rt.table(conversationsTableName)
+}
+
+// GetReactionTable returns reactions table.
+func (rt *RethinkDB) GetReactionTable() *RethinkTable {
+	return rt.table(reactionsTableName)
+}
+
+// GetReadMarkerTable returns read markers table.
+func (rt *RethinkDB) GetReadMarkerTable() *RethinkTable {
+	return rt.table(readMarkersTableName)
+}
+
+// GetRoomTable returns rooms table.
+func (rt *RethinkDB) GetRoomTable() *RethinkTable {
+	return rt.table(roomsTableName)
+}
+
+func (rt *RethinkDB) table(tableName string) *RethinkTable {
 	return &RethinkTable{
-		name:    usersTableName,
-		term:    r.DB(rt.name).Table(usersTableName),
+		name:    tableName,
+		term:    r.DB(rt.name).Table(tableName),
 		rethink: rt,
 	}
 }
@@ -157,6 +308,99 @@ func (t *RethinkTable) Insert(entity interface{}) error {
 	return t.term.Insert(entity).Exec(t.rethink.session)
 }
 
+// Upsert persists given struct into table in RethinkDB replacing
+// element with the same primary key if it already exists.
+func (t *RethinkTable) Upsert(entity interface{}) error {
+	return t.term.Insert(entity, r.InsertOpts{Conflict: "replace"}).Exec(t.rethink.session)
+}
+
+// UpsertGreater persists given struct into table in RethinkDB. Element with
+// the same primary key is replaced only if its given property is lower than
+// the property of given struct, so the property never decreases.
+func (t *RethinkTable) UpsertGreater(entity interface{}, property string) error {
+	conflict := func(id, oldDoc, newDoc r.Term) interface{} {
+		return r.Branch(oldDoc.Field(property).Lt(newDoc.Field(property)), newDoc, oldDoc)
+	}
+
+	return t.term.Insert(entity, r.InsertOpts{Conflict: conflict}).Exec(t.rethink.session)
+}
+
+// Update merges given changes into element with given primary key.
+func (t *RethinkTable) Update(id string, changes interface{}) error {
+	return t.term.Get(id).Update(changes).Exec(t.rethink.session)
+}
+
+// UpdateUnless merges given changes into element with given primary key
+// unless its given boolean property is true and fetches the updated element
+// into given result. Returns 'false' if there is no such element or the
+// property is true. Checking the property and updating are atomic.
+func (t *RethinkTable) UpdateUnless(id, property string, changes, result interface{}) (bool, error) {
+	change := r.Branch(r.Row.Field(property).Default(false), map[string]interface{}{}, changes)
+
+	resp, err := t.term.Get(id).Update(change, r.UpdateOpts{ReturnChanges: true}).RunWrite(t.rethink.session)
+	if err != nil {
+		return false, err
+	}
+
+	if resp.Replaced == 0 || len(resp.Changes) == 0 {
+		return false, nil
+	}
+
+	if err := encoding.Decode(result, resp.Changes[0].NewValue); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Increment returns a change which atomically adds one to given numeric
+// property when passed to Update. Missing property is set to one.
+func Increment(property string) interface{} {
+	return r.Row.Field(property).Add(1).Default(1)
+}
+
+// Append returns a change which atomically appends given value to given
+// array property when passed to Update. Missing property is set to an
+// array containing only the value.
+func Append(property string, value interface{}) interface{} {
+	return r.Row.Field(property).Default([]interface{}{}).Append(value)
+}
+
+// Current returns value of given property of an element before it is
+// updated. It can be used in changes passed to Update.
+func Current(property string) interface{} {
+	return r.Row.Field(property)
+}
+
+// UpdateAll merges given changes into all elements matching given query.
+func (t *RethinkTable) UpdateAll(query *Query, changes interface{}) error {
+	return query.build(t.term).Update(changes).Exec(t.rethink.session)
+}
+
+// Delete removes element with given primary key.
+func (t *RethinkTable) Delete(id string) error {
+	return t.term.Get(id).Delete().Exec(t.rethink.session)
+}
+
+// Get fetches element with given primary key into given result. Returns
+// 'false' if there is no such element.
+func (t *RethinkTable) Get(id string, result interface{}) (bool, error) {
+	cursor, err := t.term.Get(id).Run(t.rethink.session)
+	if err != nil {
+		return false, err
+	}
+
+	if cursor.IsNil() {
+		return false, nil
+	}
+
+	if err := cursor.One(result); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
 // Find searches for first element with given property equal to given value.
 func (t *RethinkTable) Find(property string, value, result interface{}) error {
 	cursor, err := t.term.Filter(r.Row.Field(property).Eq(value)).Run(t.rethink.session)
@@ -174,3 +418,13 @@ func (t *RethinkTable) Find(property string, value, result interface{}) error {
 
 	return nil
 }
+
+// Select returns all elements matching given query.
+func (t *RethinkTable) Select(query *Query, result interface{}) error {
+	cursor, err := query.build(t.term).Run(t.rethink.session)
+	if err != nil {
+		return err
+	}
+
+	return cursor.All(result)
+}
@@ -0,0 +1,288 @@
+package exchange
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/adrian83/chat/pkg/room"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// VisibilityPublic describes room listed to and joinable by every user.
+	VisibilityPublic = "public"
+	// VisibilityPrivate describes room hidden from rooms list and joinable only by invitation.
+	VisibilityPrivate = "private"
+	// VisibilityPassword describes room listed to every user but joinable only with password or by invitation.
+	VisibilityPassword = "password"
+)
+
+func validVisibility(visibility string) bool {
+	switch visibility {
+	case VisibilityPublic, VisibilityPrivate, VisibilityPassword:
+		return true
+	}
+	return false
+}
+
+// newAccess returns access to a room described by given definition.
+func newAccess(def room.Definition) *access {
+	a := &access{
+		visibility:   def.Visibility,
+		passwordHash: def.PasswordHash,
+		invitations:  make(map[string]string),
+		invited:      make(map[string]bool),
+	}
+
+	for _, invitation := range def.Invitations {
+		a.invitations[invitation.User] = invitation.Inviter
+	}
+
+	for _, name := range def.Invited {
+		a.invited[name] = true
+	}
+
+	return a
+}
+
+// invitedNames returns sorted names of users who accepted invitations.
+func (a *access) invitedNames() []string {
+	names := make([]string, 0, len(a.invited))
+	for name := range a.invited {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// pendingInvitations returns pending invitations sorted by names of invited users.
+func (a *access) pendingInvitations() []room.Invitation {
+	invitations := make([]room.Invitation, 0, len(a.invitations))
+	for name, inviter := range a.invitations {
+		invitations = append(invitations, room.Invitation{User: name, Inviter: inviter})
+	}
+
+	sort.Slice(invitations, func(i, j int) bool { return invitations[i].User < invitations[j].User })
+	return invitations
+}
+
+// access keeps visibility of a room and users invited to it.
+// It is used only by the Rooms event loop.
+type access struct {
+	visibility   string
+	passwordHash []byte
+	// invitations maps names of users with pending invitations to names of inviting users
+	invitations map[string]string
+	// invited contains names of users who accepted invitations
+	invited map[string]bool
+}
+
+func (a *access) private() bool {
+	return a.visibility == VisibilityPrivate
+}
+
+func (a *access) protected() bool {
+	return a.visibility == VisibilityPassword
+}
+
+// open returns 'true' if user with given name can enter the room without password.
+func (a *access) open(userName string) bool {
+	return a.invited[userName] || (!a.private() && !a.protected())
+}
+
+// open returns 'true' if user with given name can enter this room without
+// password. Owner and moderators can always enter it.
+func (ch *Room) open(userName string) bool {
+	return ch.moderation.privileged(userName) || ch.access.open(userName)
+}
+
+// admits returns 'true' if user with given name can enter this room. Password
+// is verified by the caller, as hashing it would block the Rooms event loop.
+func (ch *Room) admits(userName string, passwordValid bool) bool {
+	return ch.open(userName) || (ch.access.protected() && passwordValid)
+}
+
+type passwordHashRequest struct {
+	room   string
+	result chan []byte
+}
+
+type admissionRequest struct {
+	room   string
+	user   string
+	result chan bool
+}
+
+type invitationRequest struct {
+	client    *Client
+	requestID string
+	action    string
+	room      string
+	target    string
+}
+
+// visibleRooms returns names of rooms which should be listed to user with given name.
+func (ch *Rooms) visibleRooms(userName string) []string {
+	names := make([]string, 0, len(ch.rooms))
+	for name, room := range ch.rooms {
+		if ch.roomVisible(room, userName) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// roomVisible returns 'true' if given room should be listed to user with given name.
+func (ch *Rooms) roomVisible(room *Room, userName string) bool {
+	return !room.access.private() || room.open(userName)
+}
+
+// protectedRooms returns names of password-protected rooms among given ones.
+func (ch *Rooms) protectedRooms(names []string) []string {
+	protected := make([]string, 0)
+	for _, name := range names {
+		if room, ok := ch.rooms[name]; ok && room.access.protected() {
+			protected = append(protected, name)
+		}
+	}
+	return protected
+}
+
+// roomsList returns ROOMS_LIST message for user with given name.
+func (ch *Rooms) roomsList(userName string) *Message {
+	names := ch.visibleRooms(userName)
+	return RoomsNamesMessage(names, ch.protectedRooms(names), ch.unread(userName, names))
+}
+
+// admitted returns 'true' if user with given name is not banned in room
+// with given name and is either present in it or can enter it without password.
+func (ch *Rooms) admitted(roomName, userName string) bool {
+	room, ok := ch.rooms[roomName]
+	if !ok {
+		return false
+	}
+
+	if room.moderation.restriction(userName, time.Now()).banned {
+		return false
+	}
+
+	if room.open(userName) {
+		return true
+	}
+
+	for _, client := range ch.users.clients(userName) {
+		if _, err := room.FindClient(client.ID()); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// invite handles sending, accepting and declining invitations.
+func (ch *Rooms) invite(req invitationRequest) {
+	room, ok := ch.rooms[req.room]
+	if !ok {
+		req.client.Send(ErrorMessage(ErrCodeNotFound, req.requestID, fmt.Sprintf("Room %v doesn't exist", req.room)))
+		return
+	}
+
+	userName := req.client.UserName()
+	acc := room.access
+
+	switch req.action {
+	case MsgInviteMT:
+		if !room.moderation.privileged(userName) {
+			req.client.Send(ErrorMessage(ErrCodeForbidden, req.requestID, fmt.Sprintf("You cannot invite users to room %v", req.room)))
+			return
+		}
+
+		if acc.invited[req.target] || room.moderation.privileged(req.target) {
+			req.client.Send(ErrorMessage(ErrCodeConflict, req.requestID, fmt.Sprintf("User %v is already invited to room %v", req.target, req.room)))
+			return
+		}
+
+		acc.invitations[req.target] = userName
+		ch.saveRoom(room)
+		ch.users.send(req.target, NewInvitationMessage(MsgInviteMT, req.room, req.client.ID(), userName, req.target))
+
+	case MsgInviteAcceptMT, MsgInviteDeclineMT:
+		inviter, invited := acc.invitations[userName]
+		if !invited {
+			req.client.Send(ErrorMessage(ErrCodeForbidden, req.requestID, fmt.Sprintf("You are not invited to room %v", req.room)))
+			return
+		}
+
+		if r := room.moderation.restriction(userName, time.Now()); r.banned && req.action == MsgInviteAcceptMT {
+			req.client.Send(ErrorMessage(ErrCodeForbidden, req.requestID, restrictionError(r, req.room)))
+			return
+		}
+
+		delete(acc.invitations, userName)
+		if req.action == MsgInviteAcceptMT {
+			acc.invited[userName] = true
+		}
+		ch.saveRoom(room)
+
+		ch.users.send(inviter, NewInvitationMessage(req.action, req.room, req.client.ID(), userName, inviter))
+
+		if req.action == MsgInviteDeclineMT {
+			return
+		}
+
+		ch.users.send(userName, ch.roomsList(userName))
+		for _, client := range ch.users.connections(req.client) {
+			room.AddClient(client)
+		}
+	}
+}
+
+// passwordValid returns 'true' if given password protects room with given name.
+// Password is compared in the calling goroutine.
+func (ch *Rooms) passwordValid(roomName, password string) bool {
+	if password == "" {
+		return false
+	}
+
+	result := make(chan []byte, 1)
+	ch.passwordHashRequest <- passwordHashRequest{room: roomName, result: result}
+
+	hash := <-result
+	return hash != nil && bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// passwordHash returns password hash of room with given name or nil if the room is not password-protected.
+func (ch *Rooms) passwordHash(roomName string) []byte {
+	room, ok := ch.rooms[roomName]
+	if !ok || !room.access.protected() {
+		return nil
+	}
+	return room.access.passwordHash
+}
+
+// Admitted returns 'true' if user with given name can read messages and
+// members of room with given name, that is if the user is not banned in
+// the room and is either present in it or can enter it without password.
+func (ch *Rooms) Admitted(roomName, userName string) bool {
+	result := make(chan bool, 1)
+
+	ch.admissionRequest <- admissionRequest{
+		room:   roomName,
+		user:   userName,
+		result: result,
+	}
+
+	return <-result
+}
+
+// Invite sends, accepts or declines invitation described by given message on behalf of given client.
+func (ch *Rooms) Invite(msg *Message, client *Client) {
+	ch.invitationRequest <- invitationRequest{
+		client:    client,
+		requestID: msg.RequestID,
+		action:    msg.MsgType,
+		room:      msg.Room,
+		target:    msg.Target,
+	}
+}
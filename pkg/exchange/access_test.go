@@ -0,0 +1,172 @@
+package exchange
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/adrian83/chat/pkg/room"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoomAdmits(t *testing.T) {
+	testData := []struct {
+		name          string
+		visibility    string
+		user          string
+		invited       bool
+		passwordValid bool
+		expected      bool
+	}{
+		{name: "public room admits everyone", visibility: VisibilityPublic, user: "anna", expected: true},
+		{name: "private room doesn't admit stranger", visibility: VisibilityPrivate, user: "anna", expected: false},
+		{name: "private room ignores password", visibility: VisibilityPrivate, user: "anna", passwordValid: true, expected: false},
+		{name: "private room admits invited user", visibility: VisibilityPrivate, user: "anna", invited: true, expected: true},
+		{name: "private room admits owner", visibility: VisibilityPrivate, user: "owner", expected: true},
+		{name: "private room admits moderator", visibility: VisibilityPrivate, user: "moderator", expected: true},
+		{name: "protected room doesn't admit user without password", visibility: VisibilityPassword, user: "anna", expected: false},
+		{name: "protected room admits user with password", visibility: VisibilityPassword, user: "anna", passwordValid: true, expected: true},
+		{name: "protected room admits invited user", visibility: VisibilityPassword, user: "anna", invited: true, expected: true},
+		{name: "protected room admits owner", visibility: VisibilityPassword, user: "owner", expected: true},
+		{name: "protected room admits moderator", visibility: VisibilityPassword, user: "moderator", expected: true},
+	}
+
+	for _, data := range testData {
+		// given
+		r := NewRoom(room.Definition{
+			Name:       "room",
+			Owner:      "owner",
+			Moderators: []string{"moderator"},
+			Visibility: data.visibility,
+		}, &Rooms{})
+		r.access.invited[data.user] = data.invited
+
+		// when
+		admitted := r.admits(data.user, data.passwordValid)
+
+		// then
+		assert.Equal(t, data.expected, admitted, data.name)
+	}
+}
+
+func TestEnteringProtectedRoom(t *testing.T) {
+	testData := []struct {
+		name     string
+		password string
+		enter    bool
+	}{
+		{name: "valid password", password: "secret", enter: true},
+		{name: "invalid password", password: "guess", enter: false},
+		{name: "missing password", password: "", enter: false},
+	}
+
+	for _, data := range testData {
+		// given
+		rooms := newTestRooms(newMemoryStore())
+		owner, ownerConn := connect(t, rooms, testOwner, NewRouter())
+		rooms.CreateRoom("", "protected", VisibilityPassword, "secret", false, owner)
+		assert.NotNil(t, ownerConn.received(MsgUserJoinedRoomMT, inRoom("protected")), data.name)
+
+		client, conn := connect(t, rooms, "anna", NewRouter())
+		assert.NotNil(t, conn.received(MsgUserJoinedRoomMT, inRoom(MainRoomName())), data.name)
+
+		// when
+		rooms.AddClientToRoom("join", "protected", data.password, client)
+
+		// then
+		if data.enter {
+			assert.NotNil(t, conn.received(MsgUserJoinedRoomMT, inRoom("protected")), data.name)
+			continue
+		}
+
+		assert.NotNil(t, conn.received(MsgErrorMsgMT, withCode(ErrCodeForbidden)), data.name)
+		assert.Nil(t, findMessage(conn.messages(MsgUserJoinedRoomMT), inRoom("protected")), data.name)
+	}
+}
+
+// memoryRoomStore is a room store which keeps room definitions in memory.
+type memoryRoomStore struct {
+	lock sync.Mutex
+	defs map[string]room.Definition
+}
+
+func newMemoryRoomStore(defs ...room.Definition) *memoryRoomStore {
+	store := &memoryRoomStore{defs: make(map[string]room.Definition)}
+	for _, def := range defs {
+		store.defs[def.Name] = def
+	}
+	return store
+}
+
+func (s *memoryRoomStore) SaveRoom(def room.Definition) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.defs[def.Name] = def
+	return nil
+}
+
+func (s *memoryRoomStore) DeleteRoom(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.defs, name)
+	return nil
+}
+
+func (s *memoryRoomStore) Rooms() ([]*room.Definition, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	defs := make([]*room.Definition, 0, len(s.defs))
+	for _, def := range s.defs {
+		def := def
+		defs = append(defs, &def)
+	}
+	return defs, nil
+}
+
+func (s *memoryRoomStore) definition(name string) room.Definition {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.defs[name]
+}
+
+func TestInvitationsArePersisted(t *testing.T) {
+	testData := []struct {
+		name        string
+		action      string
+		invited     []string
+		invitations []room.Invitation
+	}{
+		{name: "invitation is pending", invited: []string{}, invitations: []room.Invitation{{User: "anna", Inviter: testOwner}}},
+		{name: "invitation is accepted", action: MsgInviteAcceptMT, invited: []string{"anna"}, invitations: []room.Invitation{}},
+		{name: "invitation is declined", action: MsgInviteDeclineMT, invited: []string{}, invitations: []room.Invitation{}},
+	}
+
+	for _, data := range testData {
+		// given
+		roomStore := newMemoryRoomStore()
+		rooms := NewRooms(newMemoryStore(), roomStore, 10, 0, 100, ResumeLimits{}, testOwner)
+		owner, ownerConn := connect(t, rooms, testOwner, NewRouter())
+		rooms.CreateRoom("", "private", VisibilityPrivate, "", true, owner)
+		assert.NotNil(t, ownerConn.received(MsgUserJoinedRoomMT, inRoom("private")), data.name)
+
+		anna, annaConn := connect(t, rooms, "anna", NewRouter())
+		rooms.Invite(&Message{MsgType: MsgInviteMT, Room: "private", Target: "anna"}, owner)
+		assert.NotNil(t, annaConn.received(MsgInviteMT, inRoom("private")), data.name)
+
+		// when
+		if data.action != "" {
+			rooms.Invite(&Message{MsgType: data.action, Room: "private"}, anna)
+			assert.NotNil(t, ownerConn.received(data.action, inRoom("private")), data.name)
+		}
+
+		// then
+		persisted := func() bool {
+			def := roomStore.definition("private")
+			return assert.ObjectsAreEqual(data.invited, def.Invited) && assert.ObjectsAreEqual(data.invitations, def.Invitations)
+		}
+		assert.Eventually(t, persisted, testWaiting, testTick, data.name)
+
+		restored := NewRooms(newMemoryStore(), roomStore, 10, 0, 100, ResumeLimits{}, testOwner)
+		assert.Equal(t, data.action == MsgInviteAcceptMT, restored.Admitted("private", "anna"), data.name)
+	}
+}
@@ -0,0 +1,72 @@
+package exchange
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// acceptedCapacity is a number of recently accepted messages remembered
+// by a room in order to recognize retries of messages which may not be
+// persisted yet.
+const acceptedCapacity = 1000
+
+// newMessageID returns new unique message identifier.
+func newMessageID() string {
+	return uuid.New().String()
+}
+
+// stamp sets server identifier and time of given message if they are not set yet.
+func stamp(msg *Message) {
+	if msg.ID == "" {
+		msg.ID = newMessageID()
+	}
+
+	if msg.Time == 0 {
+		msg.Time = time.Now().UnixMilli()
+	}
+}
+
+func newAcceptedMessages() *acceptedMessages {
+	return &acceptedMessages{
+		acks:  make(map[string]*Message, acceptedCapacity),
+		order: make([]string, 0, acceptedCapacity),
+	}
+}
+
+// acceptedMessages remembers acknowledgements of recently accepted messages
+// by their senders' idempotency keys. Retries are recognized by messages
+// found in the store, but a retry may be checked before its original
+// message is persisted.
+type acceptedMessages struct {
+	acks  map[string]*Message
+	order []string
+}
+
+func (a *acceptedMessages) find(senderName, clientMsgID string) (*Message, bool) {
+	if clientMsgID == "" {
+		return nil, false
+	}
+
+	ack, ok := a.acks[acceptedKey(senderName, clientMsgID)]
+	return ack, ok
+}
+
+func (a *acceptedMessages) add(senderName, clientMsgID string, ack *Message) {
+	if clientMsgID == "" {
+		return
+	}
+
+	if len(a.order) == acceptedCapacity {
+		delete(a.acks, a.order[0])
+		a.order = a.order[1:]
+	}
+
+	key := acceptedKey(senderName, clientMsgID)
+	a.acks[key] = ack
+	a.order = append(a.order, key)
+}
+
+func acceptedKey(senderName, clientMsgID string) string {
+	return senderName + "\n" + clientMsgID
+}
@@ -2,27 +2,54 @@ package exchange
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
+	"github.com/google/uuid"
 	logger "github.com/sirupsen/logrus"
 )
 
+// slowConsumerGrace is a time given to a slow consumer to receive
+// SLOW_CONSUMER error before it is disconnected.
+const slowConsumerGrace = time.Second
+
 // User is an interface which defines persisten data about application user.
 type user interface {
 	Name() string
 }
 
-// NewClient returns new Client instance
-func NewClient(id string, user user, rooms *Rooms, conn *WsConnection, router *Router) *Client {
-	return &Client{
+// Transport is an interface which defines connection used for exchanging
+// envelopes with a client. Clients work the same way regardless of transport.
+type Transport interface {
+	Send(envelope *Envelope) error
+	Receive(envelope *Envelope) error
+	Close() error
+}
+
+// NewClientID returns new random identifier of a client. Every connection
+// gets its own identifier, so many tabs can share one session. Identifiers
+// are sent to other users, so they must not reveal the session.
+func NewClientID() string {
+	return uuid.New().String()
+}
+
+// NewClient returns new Client instance. At most 'queueSize' messages wait
+// for being sent to the client, further messages are handled according to
+// given slow consumer policy.
+func NewClient(id string, user user, rooms *Rooms, transport Transport, router *Router, queueSize int, policy SlowConsumerPolicy) *Client {
+	c := &Client{
 		user:        user,
 		id:          id,
 		rooms:       rooms,
-		connnection: conn,
+		transport:   transport,
 		router:      router,
-		messages:    make(chan *Message, 50),
 		stopSending: make(chan interface{}, 1),
 		stopWaiting: make(chan interface{}, 1),
+		version:     ProtocolVersion,
+		features:    featureSet(Features()),
 	}
+	c.messages = newOutboundQueue(queueSize, policy, c.disconnectSlowConsumer)
+	return c
 }
 
 // Client represents user of this application.
@@ -31,10 +58,15 @@ type Client struct {
 	user        user
 	rooms       *Rooms
 	router      *Router
-	connnection *WsConnection
-	messages    chan *Message
+	transport   Transport
+	messages    *outboundQueue
 	stopSending chan interface{}
 	stopWaiting chan interface{}
+	stopOnce    sync.Once
+	lock        sync.Mutex
+	nick        string
+	version     int
+	features    map[string]bool
 }
 
 // Start starts two goroutines: one for sending and one for receiving messages.
@@ -56,28 +88,110 @@ func (c *Client) ID() string {
 	return c.id
 }
 
+// UserName returns name of the user this client belongs to.
+func (c *Client) UserName() string {
+	return c.user.Name()
+}
+
+// SetNick sets nickname shown instead of user name in messages sent by this client.
+// Empty nickname restores user name.
+func (c *Client) SetNick(nick string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.nick = nick
+}
+
+// Nick returns nickname of this client or empty string if it is not set.
+func (c *Client) Nick() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.nick
+}
+
+// DisplayName returns nickname of this client or name of its user if nickname is not set.
+func (c *Client) DisplayName() string {
+	if nick := c.Nick(); nick != "" {
+		return nick
+	}
+	return c.UserName()
+}
+
+// Version returns protocol version used by this client.
+func (c *Client) Version() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.version
+}
+
+// Supports returns true if this client supports given feature. Clients
+// which didn't negotiate features support all of them.
+func (c *Client) Supports(feature string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.features[feature]
+}
+
+// negotiate sets protocol version used by this client and features supported
+// by both the client and the server. Returns the negotiated features.
+func (c *Client) negotiate(version int, features []string) []string {
+	supported := featureSet(Features())
+
+	negotiated := make([]string, 0, len(features))
+	for _, feature := range features {
+		if supported[feature] {
+			negotiated = append(negotiated, feature)
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.version = version
+	c.features = featureSet(negotiated)
+
+	return negotiated
+}
+
+func featureSet(features []string) map[string]bool {
+	set := make(map[string]bool, len(features))
+	for _, feature := range features {
+		set[feature] = true
+	}
+	return set
+}
+
 // String is a string representation of Client struct.
 func (c *Client) String() string {
 	return fmt.Sprintf(`{"name":"%v"}`, c.user.Name())
 }
 
-// Send sends message through connection.
+// Send adds message to the queue of messages sent through connection. It never blocks.
 func (c *Client) Send(msg *Message) {
-	logger.Infof("Client: %v. Adding message to send channel. Message: %v", c.user.Name(), msg.MsgType)
-	c.messages <- msg
+	logger.Infof("Client: %v. Adding message to send queue. Message: %v", c.user.Name(), msg.MsgType)
+	c.messages.push(msg)
 }
 
 func (c *Client) closeConnection() {
 	logger.Infof("Client: %v. Closing connection", c.user.Name())
 
-	if err := c.connnection.Close(); err != nil {
+	if err := c.transport.Close(); err != nil {
 		logger.Warnf("Client: %v. Error while closing connection. Error: %v", c.user.Name(), err)
 	}
 }
 
+// disconnectSlowConsumer gives the client a moment to receive SLOW_CONSUMER
+// error and stops it.
+func (c *Client) disconnectSlowConsumer() {
+	logger.Warnf("Client: %v. Disconnecting slow consumer", c.user.Name())
+	time.Sleep(slowConsumerGrace)
+	c.stop()
+}
+
+// stop stops sending messages and closes connection. It can be invoked many times.
 func (c *Client) stop() {
-	c.stopSending <- true
-	c.stopWaiting <- true
+	c.stopOnce.Do(func() {
+		c.stopSending <- true
+		c.stopWaiting <- true
+	})
 }
 
 // StartSending starts infinite loop which is sending messages.
@@ -88,11 +202,19 @@ func (c *Client) startSending() {
 	mainLoop:
 		for {
 			select {
-			case msg := <-c.messages:
-				logger.Infof("Client: %v. Sending message. Message: %v", c.user.Name(), msg.MsgType)
+			case <-c.messages.ready:
+				messages, overflowed := c.messages.popAll()
+				for _, msg := range messages {
+					logger.Infof("Client: %v. Sending message. Message: %v", c.user.Name(), msg.MsgType)
+
+					if err := c.transport.Send(NewEnvelope(c.Version(), msg)); err != nil {
+						logger.Warnf("Client: %v. Error while sending message.Error: %v", c.user.Name(), err)
+						c.stop()
+						break
+					}
+				}
 
-				if err := c.connnection.Send(msg); err != nil {
-					logger.Warnf("Client: %v. Error while sending message.Error: %v", c.user.Name(), err)
+				if overflowed {
 					c.stop()
 				}
 
@@ -112,24 +234,46 @@ func (c *Client) startReceiving() {
 
 	go func() {
 		for {
-			var msg Message
-			if err := c.connnection.Receive(&msg); err != nil {
+			var envelope Envelope
+			if err := c.transport.Receive(&envelope); err != nil {
 				logger.Warnf("Client: %v. Error while receiving message. Error: %v", c.user.Name(), err)
 				c.stop()
 
 				break
 			}
 
+			msg, perr := envelope.message(c.Version())
+			if perr != nil {
+				logger.Infof("Client: %v. Invalid message %v. Error: %v", c.user.Name(), envelope.Type, perr)
+				c.reject(envelope.RequestID, perr)
+				continue
+			}
+
 			msg.SenderName = c.user.Name()
 			msg.SenderID = c.id
+			msg.SenderNick = c.Nick()
 
 			logger.Infof("Client: %v. Received message. Message: %v", c.user.Name(), msg.MsgType)
 
-			if err := c.router.FindRoute(msg.MsgType).Handle(&msg); err != nil {
-				logger.Warnf("Client: %v. Error while handling message: %v. Error: %v", c.user.Name(), msg, err)
+			if err := c.router.Handle(msg); err != nil {
+				logger.Warnf("Client: %v. Error while handling message: %v. Error: %v", c.user.Name(), msg.MsgType, err)
 			}
 		}
 
 		logger.Infof("Client: %v. Stopping receiving messages", c.user.Name())
 	}()
 }
+
+// reject answers invalid envelope with given error. The answer passes through
+// global middlewares, so invalid envelopes use the rate limit of other messages.
+func (c *Client) reject(requestID string, perr *ProtocolError) {
+	invalid := &Message{MsgType: msgInvalidEnvelopeMT, RequestID: requestID, SenderID: c.id, SenderName: c.user.Name()}
+
+	err := c.router.HandleWith(invalid, HandlerFunc(func(msg *Message) error {
+		c.Send(ErrorMessage(perr.Code, msg.RequestID, perr.Error()))
+		return nil
+	}))
+	if err != nil {
+		logger.Warnf("Client: %v. Error while rejecting message. Error: %v", c.user.Name(), err)
+	}
+}
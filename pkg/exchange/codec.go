@@ -0,0 +1,61 @@
+package exchange
+
+import (
+	"encoding/json"
+)
+
+// Websocket subprotocols naming codecs which can be used on a connection.
+const (
+	JSONSubprotocol     = "chat.json"
+	MsgPackSubprotocol  = "chat.msgpack"
+	ProtobufSubprotocol = "chat.protobuf"
+)
+
+// Codec encodes envelopes exchanged with clients.
+type Codec interface {
+	// Subprotocol returns name of the websocket subprotocol selecting this codec.
+	Subprotocol() string
+	// Binary returns true if encoded envelopes are sent in binary frames.
+	Binary() bool
+	Marshal(envelope *Envelope) ([]byte, error)
+	Unmarshal(data []byte, envelope *Envelope) error
+}
+
+var codecs = map[string]Codec{
+	JSONSubprotocol:     jsonCodec{},
+	MsgPackSubprotocol:  msgPackCodec{},
+	ProtobufSubprotocol: protobufCodec{},
+}
+
+// DefaultCodec returns codec used when client didn't ask for any supported subprotocol.
+func DefaultCodec() Codec {
+	return jsonCodec{}
+}
+
+// CodecFor returns codec selected by given (negotiated) subprotocols.
+func CodecFor(subprotocols []string) Codec {
+	for _, subprotocol := range subprotocols {
+		if codec, ok := codecs[subprotocol]; ok {
+			return codec
+		}
+	}
+	return DefaultCodec()
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Subprotocol() string {
+	return JSONSubprotocol
+}
+
+func (jsonCodec) Binary() bool {
+	return false
+}
+
+func (jsonCodec) Marshal(envelope *Envelope) ([]byte, error) {
+	return json.Marshal(envelope)
+}
+
+func (jsonCodec) Unmarshal(data []byte, envelope *Envelope) error {
+	return json.Unmarshal(data, envelope)
+}
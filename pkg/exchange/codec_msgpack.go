@@ -0,0 +1,64 @@
+package exchange
+
+import (
+	"bytes"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// msgPackCodec encodes envelopes with MessagePack. Keys are the same as in JSON.
+type msgPackCodec struct{}
+
+func (msgPackCodec) Subprotocol() string {
+	return MsgPackSubprotocol
+}
+
+func (msgPackCodec) Binary() bool {
+	return true
+}
+
+func (msgPackCodec) Marshal(envelope *Envelope) ([]byte, error) {
+	var buf bytes.Buffer
+
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+
+	if err := enc.Encode(envelope); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes envelope sent by a client. Like with JSON, payload
+// which doesn't match the type of the envelope marks it as invalid.
+func (msgPackCodec) Unmarshal(data []byte, envelope *Envelope) error {
+	var received struct {
+		Version   int                `json:"v"`
+		Type      string             `json:"type"`
+		RequestID string             `json:"requestId"`
+		Payload   msgpack.RawMessage `json:"payload"`
+	}
+	if err := newMsgPackDecoder(data).Decode(&received); err != nil {
+		return err
+	}
+
+	*envelope = Envelope{Version: received.Version, Type: received.Type, RequestID: received.RequestID}
+	envelope.readPayload(func(p payload) error {
+		if len(received.Payload) == 0 {
+			return nil
+		}
+
+		dec := newMsgPackDecoder(received.Payload)
+		dec.DisallowUnknownFields(true)
+		return dec.Decode(p)
+	})
+	return nil
+}
+
+func newMsgPackDecoder(data []byte) *msgpack.Decoder {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec
+}
@@ -0,0 +1,252 @@
+package exchange
+
+import (
+	"fmt"
+
+	"github.com/adrian83/chat/pkg/exchange/pb"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// maxProtoDepth is the deepest nesting of messages accepted from clients.
+// Envelopes sent by the server nest at most a page of messages with their
+// reactions (envelope, payload, message, reaction).
+const maxProtoDepth = 4
+
+// protobufCodec encodes envelopes with Protocol Buffers. Schema of the
+// messages is described in pb/envelope.proto.
+type protobufCodec struct{}
+
+func (protobufCodec) Subprotocol() string {
+	return ProtobufSubprotocol
+}
+
+func (protobufCodec) Binary() bool {
+	return true
+}
+
+func (protobufCodec) Marshal(envelope *Envelope) ([]byte, error) {
+	encoded := &pb.Envelope{
+		V:         int64(envelope.Version),
+		Type:      envelope.Type,
+		RequestId: envelope.RequestID,
+	}
+	if envelope.Payload != nil {
+		encoded.Payload = &pb.Envelope_Message{Message: toProtoMessage(envelope.Payload)}
+	}
+
+	return proto.Marshal(encoded)
+}
+
+// Unmarshal decodes envelope sent by a client. Payload which doesn't match
+// the type of the envelope marks it as invalid.
+func (protobufCodec) Unmarshal(data []byte, envelope *Envelope) error {
+	var decoded pb.Envelope
+	if err := (proto.UnmarshalOptions{RecursionLimit: maxProtoDepth}).Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	*envelope = Envelope{Version: int(decoded.V), Type: decoded.Type, RequestID: decoded.RequestId}
+	envelope.readPayload(func(p payload) error {
+		if decoded.Payload == nil || fromProtoPayload(&decoded, p) {
+			return nil
+		}
+		return fmt.Errorf("payload of %v message has unexpected type", decoded.Type)
+	})
+	return nil
+}
+
+// fromProtoPayload copies payload of given envelope to given payload and
+// returns true if the envelope carries payload of the same type.
+func fromProtoPayload(envelope *pb.Envelope, p payload) bool {
+	switch p := p.(type) {
+	case *helloPayload:
+		if hello := envelope.GetHello(); hello != nil {
+			*p = helloPayload{Version: int(hello.Version), Features: hello.Features}
+			return true
+		}
+	case *roomPayload:
+		if room := envelope.GetRoom(); room != nil {
+			*p = roomPayload{Room: room.Room}
+			return true
+		}
+	case *joinRoomPayload:
+		if join := envelope.GetJoinRoom(); join != nil {
+			*p = joinRoomPayload{Room: join.Room, Password: join.Password}
+			return true
+		}
+	case *createRoomPayload:
+		if create := envelope.GetCreateRoom(); create != nil {
+			*p = createRoomPayload{Room: create.Room, Visibility: create.Visibility, Password: create.Password, Persistent: create.Persistent}
+			return true
+		}
+	case *textPayload:
+		if text := envelope.GetText(); text != nil {
+			*p = textPayload{Room: text.Room, Content: text.Content, ClientMsgID: text.ClientMsgId, ParentID: text.ParentId}
+			return true
+		}
+	case *directPayload:
+		if direct := envelope.GetDirect(); direct != nil {
+			*p = directPayload{Recipient: direct.Recipient, Content: direct.Content, ClientMsgID: direct.ClientMsgId}
+			return true
+		}
+	case *historyPayload:
+		if history := envelope.GetHistory(); history != nil {
+			*p = historyPayload{Room: history.Room, Recipient: history.Recipient, Before: history.Before, ID: history.Id, Limit: int(history.Limit)}
+			return true
+		}
+	case *threadPayload:
+		if thread := envelope.GetThread(); thread != nil {
+			*p = threadPayload{ParentID: thread.ParentId, Before: thread.Before, Limit: int(thread.Limit)}
+			return true
+		}
+	case *editPayload:
+		if edit := envelope.GetEdit(); edit != nil {
+			*p = editPayload{ID: edit.Id, Content: edit.Content}
+			return true
+		}
+	case *deletePayload:
+		if deleted := envelope.GetDelete(); deleted != nil {
+			*p = deletePayload{ID: deleted.Id}
+			return true
+		}
+	case *reactionPayload:
+		if reaction := envelope.GetReaction(); reaction != nil {
+			*p = reactionPayload{ID: reaction.Id, Emoji: reaction.Emoji}
+			return true
+		}
+	case *markReadPayload:
+		if marker := envelope.GetMarkRead(); marker != nil {
+			*p = markReadPayload{Room: marker.Room, Sequence: marker.Seq}
+			return true
+		}
+	case *targetPayload:
+		if target := envelope.GetTarget(); target != nil {
+			*p = targetPayload{Room: target.Room, Target: target.Target}
+			return true
+		}
+	case *restrictionPayload:
+		if restriction := envelope.GetRestriction(); restriction != nil {
+			*p = restrictionPayload{Room: restriction.Room, Target: restriction.Target, Until: restriction.Until}
+			return true
+		}
+	case *roomUpdatePayload:
+		if update := envelope.GetRoomUpdate(); update != nil {
+			*p = roomUpdatePayload{Room: update.Room, NewName: update.NewName, Topic: update.Topic, Description: update.Description,
+				MaxMessageSize: int(update.MaxMessageSize), Target: update.Target}
+			return true
+		}
+	case *resumePayload:
+		if resume := envelope.GetResume(); resume != nil {
+			*p = resumePayload{Sequences: resume.Sequences}
+			return true
+		}
+	}
+
+	return false
+}
+
+func toProtoMessage(m *Message) *pb.Message {
+	if m == nil {
+		return nil
+	}
+
+	return &pb.Message{
+		Version:        int64(m.Version),
+		Features:       m.Features,
+		Id:             m.ID,
+		ClientMsgId:    m.ClientMsgID,
+		Seq:            m.Sequence,
+		ParentId:       m.ParentID,
+		ReplyCount:     int64(m.ReplyCount),
+		LastReply:      m.LastReply,
+		SenderId:       m.SenderID,
+		SenderName:     m.SenderName,
+		SenderNick:     m.SenderNick,
+		Rooms:          m.Rooms,
+		Unread:         m.Unread,
+		Sequences:      m.Sequences,
+		Room:           m.Room,
+		Recipient:      m.Recipient,
+		Visibility:     m.Visibility,
+		Password:       m.Password,
+		Protected:      m.Protected,
+		Persistent:     m.Persistent,
+		NewName:        m.NewName,
+		PreviousRoom:   m.PreviousRoom,
+		Topic:          m.Topic,
+		Description:    m.Description,
+		MaxMessageSize: int64(m.MaxMessageSize),
+		Info:           toProtoRoomInfo(m.Info),
+		Code:           m.Code,
+		Command:        m.Command,
+		Target:         m.Target,
+		Until:          m.Until,
+		Content:        m.Content,
+		Time:           m.Time,
+		Edited:         m.Edited,
+		Deleted:        m.Deleted,
+		Emoji:          m.Emoji,
+		Reactions:      toProtoReactions(m.Reactions),
+		Before:         m.Before,
+		Limit:          int64(m.Limit),
+		Members:        m.Members,
+		Messages:       toProtoMessages(m.Messages),
+		Conversations:  toProtoConversations(m.Conversations),
+	}
+}
+
+func toProtoMessages(messages []*Message) []*pb.Message {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	converted := make([]*pb.Message, 0, len(messages))
+	for _, m := range messages {
+		converted = append(converted, toProtoMessage(m))
+	}
+	return converted
+}
+
+func toProtoRoomInfo(info *RoomInfo) *pb.RoomInfo {
+	if info == nil {
+		return nil
+	}
+
+	return &pb.RoomInfo{
+		Name:           info.Name,
+		Topic:          info.Topic,
+		Description:    info.Description,
+		Owner:          info.Owner,
+		Moderators:     info.Moderators,
+		CreatedBy:      info.CreatedBy,
+		CreatedAt:      info.CreatedAt,
+		Visibility:     info.Visibility,
+		Persistent:     info.Persistent,
+		MaxMessageSize: int64(info.MaxMessageSize),
+	}
+}
+
+func toProtoReactions(reactions []*Reaction) []*pb.Reaction {
+	if len(reactions) == 0 {
+		return nil
+	}
+
+	converted := make([]*pb.Reaction, 0, len(reactions))
+	for _, r := range reactions {
+		converted = append(converted, &pb.Reaction{Emoji: r.Emoji, Count: int64(r.Count), Users: r.Users})
+	}
+	return converted
+}
+
+func toProtoConversations(conversations []*Conversation) []*pb.Conversation {
+	if len(conversations) == 0 {
+		return nil
+	}
+
+	converted := make([]*pb.Conversation, 0, len(conversations))
+	for _, c := range conversations {
+		converted = append(converted, &pb.Conversation{Peer: c.Peer, LastMessage: c.LastMessage})
+	}
+	return converted
+}
@@ -0,0 +1,575 @@
+package exchange
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/adrian83/chat/pkg/exchange/pb"
+	"github.com/adrian83/chat/pkg/history"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+var messageTypes = []string{
+	MsgUserJoinedRoomMT, MsgUserLeftRoomMT, MsgLogoutMT, MsgTextMsgMT, MsgCreateRoomMT, MsgRemoveRoomMT,
+	MsgRoomsNamesMT, MsgErrorMsgMT, MsgHistoryRequestMT, MsgHistoryPageMT, MsgDirectMsgMT, MsgConversationsMT,
+	MsgRoomMembersMT, MsgTypingStartMT, MsgTypingStopMT, MsgAckMT, MsgEditMsgMT, MsgDeleteMsgMT, MsgReactMT,
+	MsgUnreactMT, MsgThreadRequestMT, MsgThreadPageMT, MsgMarkReadMT, MsgKickUserMT, MsgBanUserMT, MsgMuteUserMT,
+	MsgAddModeratorMT, MsgRemoveModeratorMT, MsgInviteMT, MsgInviteAcceptMT, MsgInviteDeclineMT, MsgRoomUpdateMT,
+	MsgRoomInfoMT, MsgCommandResultMT, MsgPingMT, MsgPongMT, MsgResumeMT, MsgResyncMT, MsgHelloMT,
+}
+
+func fullMessage(msgType string) *Message {
+	topic, description := "topic", ""
+
+	return &Message{
+		MsgType:        msgType,
+		RequestID:      "req-1",
+		Version:        1,
+		Features:       []string{FeatureTyping},
+		ID:             "msg-1",
+		ClientMsgID:    "client-msg-1",
+		Sequence:       42,
+		ParentID:       "msg-0",
+		ReplyCount:     3,
+		LastReply:      1700000000000,
+		SenderID:       "user-1",
+		SenderName:     "john",
+		SenderNick:     "Johnny",
+		Rooms:          []string{"main", "random"},
+		Unread:         map[string]int64{"main": 2, "random": 0},
+		Sequences:      map[string]int64{"main": 40},
+		Room:           "main",
+		Recipient:      "anna",
+		Visibility:     "private",
+		Password:       "secret",
+		Protected:      []string{"random"},
+		Persistent:     true,
+		NewName:        "general",
+		PreviousRoom:   "lobby",
+		Topic:          &topic,
+		Description:    &description,
+		MaxMessageSize: 2048,
+		Info: &RoomInfo{
+			Name:           "main",
+			Topic:          "topic",
+			Description:    "description",
+			Owner:          "john",
+			Moderators:     []string{"anna"},
+			CreatedBy:      "john",
+			CreatedAt:      1600000000000,
+			Visibility:     "public",
+			Persistent:     true,
+			MaxMessageSize: 1024,
+		},
+		Code:      ErrCodeNotFound,
+		Command:   "/topic",
+		Target:    "anna",
+		Until:     1800000000000,
+		Content:   "zażółć gęślą jaźń 👋",
+		Time:      1700000000001,
+		Edited:    1700000000002,
+		Deleted:   true,
+		Emoji:     "👍",
+		Reactions: []*Reaction{{Emoji: "👍", Count: 2, Users: []string{"john", "anna"}}},
+		Before:    -1,
+		Limit:     50,
+		Members:   []string{"john", "anna"},
+		Messages: []*Message{
+			{MsgType: MsgTextMsgMT, ID: "msg-2", SenderID: "user-2", SenderName: "anna", Room: "main", Content: "hi", Sequence: 41,
+				Reactions: []*Reaction{{Emoji: "👍", Count: 1, Users: []string{"john"}}}},
+		},
+		Conversations: []*Conversation{{Peer: "anna", LastMessage: 1700000000003}},
+	}
+}
+
+// decodeSent decodes envelope sent by the server with given codec as it is
+// decoded by clients. Payloads of such envelopes are not restricted to fields
+// which clients can send.
+func decodeSent(codec Codec, data []byte) (*Envelope, error) {
+	var decoded struct {
+		Version   int      `json:"v"`
+		Type      string   `json:"type"`
+		RequestID string   `json:"requestId"`
+		Payload   *Message `json:"payload"`
+	}
+
+	switch codec.(type) {
+	case jsonCodec:
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			return nil, err
+		}
+	case msgPackCodec:
+		if err := newMsgPackDecoder(data).Decode(&decoded); err != nil {
+			return nil, err
+		}
+	case protobufCodec:
+		var envelope pb.Envelope
+		if err := proto.Unmarshal(data, &envelope); err != nil {
+			return nil, err
+		}
+
+		decoded.Version, decoded.Type, decoded.RequestID = int(envelope.V), envelope.Type, envelope.RequestId
+		decoded.Payload = fromProtoMessage(envelope.GetMessage())
+	}
+
+	return &Envelope{Version: decoded.Version, Type: decoded.Type, RequestID: decoded.RequestID, Payload: decoded.Payload}, nil
+}
+
+func fromProtoMessage(m *pb.Message) *Message {
+	if m == nil {
+		return nil
+	}
+
+	return &Message{
+		Version:        int(m.Version),
+		Features:       m.Features,
+		ID:             m.Id,
+		ClientMsgID:    m.ClientMsgId,
+		Sequence:       m.Seq,
+		ParentID:       m.ParentId,
+		ReplyCount:     int(m.ReplyCount),
+		LastReply:      m.LastReply,
+		SenderID:       m.SenderId,
+		SenderName:     m.SenderName,
+		SenderNick:     m.SenderNick,
+		Rooms:          m.Rooms,
+		Unread:         m.Unread,
+		Sequences:      m.Sequences,
+		Room:           m.Room,
+		Recipient:      m.Recipient,
+		Visibility:     m.Visibility,
+		Password:       m.Password,
+		Protected:      m.Protected,
+		Persistent:     m.Persistent,
+		NewName:        m.NewName,
+		PreviousRoom:   m.PreviousRoom,
+		Topic:          m.Topic,
+		Description:    m.Description,
+		MaxMessageSize: int(m.MaxMessageSize),
+		Info:           fromProtoRoomInfo(m.Info),
+		Code:           m.Code,
+		Command:        m.Command,
+		Target:         m.Target,
+		Until:          m.Until,
+		Content:        m.Content,
+		Time:           m.Time,
+		Edited:         m.Edited,
+		Deleted:        m.Deleted,
+		Emoji:          m.Emoji,
+		Reactions:      fromProtoReactions(m.Reactions),
+		Before:         m.Before,
+		Limit:          int(m.Limit),
+		Members:        m.Members,
+		Messages:       fromProtoMessages(m.Messages),
+		Conversations:  fromProtoConversations(m.Conversations),
+	}
+}
+
+func fromProtoMessages(messages []*pb.Message) []*Message {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	converted := make([]*Message, 0, len(messages))
+	for _, m := range messages {
+		msg := fromProtoMessage(m)
+
+		// clients derive types of listed messages from their recipients
+		msg.MsgType = MsgTextMsgMT
+		if msg.Recipient != "" {
+			msg.MsgType = MsgDirectMsgMT
+		}
+
+		converted = append(converted, msg)
+	}
+	return converted
+}
+
+func fromProtoRoomInfo(info *pb.RoomInfo) *RoomInfo {
+	if info == nil {
+		return nil
+	}
+
+	return &RoomInfo{
+		Name:           info.Name,
+		Topic:          info.Topic,
+		Description:    info.Description,
+		Owner:          info.Owner,
+		Moderators:     info.Moderators,
+		CreatedBy:      info.CreatedBy,
+		CreatedAt:      info.CreatedAt,
+		Visibility:     info.Visibility,
+		Persistent:     info.Persistent,
+		MaxMessageSize: int(info.MaxMessageSize),
+	}
+}
+
+func fromProtoReactions(reactions []*pb.Reaction) []*Reaction {
+	if len(reactions) == 0 {
+		return nil
+	}
+
+	converted := make([]*Reaction, 0, len(reactions))
+	for _, r := range reactions {
+		converted = append(converted, &Reaction{Emoji: r.Emoji, Count: int(r.Count), Users: r.Users})
+	}
+	return converted
+}
+
+func fromProtoConversations(conversations []*pb.Conversation) []*Conversation {
+	if len(conversations) == 0 {
+		return nil
+	}
+
+	converted := make([]*Conversation, 0, len(conversations))
+	for _, c := range conversations {
+		converted = append(converted, &Conversation{Peer: c.Peer, LastMessage: c.LastMessage})
+	}
+	return converted
+}
+
+func TestCodecsRoundTripEveryMessageType(t *testing.T) {
+	for _, codec := range codecs {
+		for _, msgType := range messageTypes {
+			// given
+			envelope := NewEnvelope(ProtocolVersion, fullMessage(msgType))
+			envelope.RequestID = "req-1"
+
+			// when
+			data, err := codec.Marshal(envelope)
+			assert.NoError(t, err)
+
+			decoded, err := decodeSent(codec, data)
+
+			// then
+			assert.NoError(t, err)
+			assert.Equal(t, envelope, decoded, "codec %v, message %v", codec.Subprotocol(), msgType)
+		}
+	}
+}
+
+// realisticMessages returns messages of every type as they are built by the
+// server and, for types sent only by clients, as the browser client sends them.
+func realisticMessages() []*Message {
+	sent := time.UnixMilli(1700000000000)
+	lastReply := time.UnixMilli(1700000060000)
+
+	parent := fromStoredMessage(&history.Message{
+		ID:          "msg-1",
+		ClientMsgID: "client-msg-1",
+		Sequence:    41,
+		Room:        "main",
+		SenderName:  "john",
+		Content:     "zażółć gęślą jaźń 👋",
+		Time:        sent,
+		Revisions:   []history.Revision{{Content: "hello", Time: sent.Add(time.Minute)}},
+		ReplyCount:  1,
+		LastReply:   &lastReply,
+		Reactions:   []history.Reaction{{Emoji: "👍", Users: []string{"anna", "mike"}}},
+	})
+	parent.SenderID = "client-1"
+	parent.SenderNick = "Johnny"
+
+	reply := fromStoredMessage(&history.Message{ID: "msg-2", Sequence: 42, Room: "main", ParentID: "msg-1", SenderName: "anna", Content: "hi", Time: lastReply})
+	direct := fromStoredMessage(&history.Message{ID: "msg-3", SenderName: "john", Recipient: "anna", Content: "psst", Time: sent})
+	deleted := fromStoredMessage(&history.Message{ID: "msg-4", Sequence: 43, Room: "main", SenderName: "john", Deleted: true, Time: sent})
+	until := time.UnixMilli(1800000000000)
+
+	return []*Message{
+		NewHelloMessage("req-1", ProtocolVersion, Features()),
+		NewPingMessage(),
+		{MsgType: MsgPongMT},
+		{MsgType: MsgLogoutMT},
+		NewUserJoinedRoomMessage("main", "client-1", "john"),
+		NewUserLeftRoomMessage("main", "client-1", "john"),
+		NewCreateRoomMessage("random", VisibilityPassword),
+		NewRemoveRoomMessage("random"),
+		RoomsNamesMessage([]string{"main", "random"}, []string{"random"}, map[string]int64{"main": 3}),
+		ErrorMessage(ErrCodeForbidden, "req-2", "You are muted in room main"),
+		parent,
+		direct,
+		NewAckMessage(parent),
+		{MsgType: MsgHistoryRequestMT, Room: "main", Before: 41, Limit: 50},
+		NewHistoryPageMessage("main", 41, []*Message{parent, deleted}),
+		{MsgType: MsgThreadRequestMT, ParentID: "msg-1", Limit: 50},
+		NewThreadPageMessage(parent, 42, []*Message{reply}),
+		NewConversationsMessage([]*Conversation{{Peer: "anna", LastMessage: sent.UnixMilli()}}),
+		NewRoomMembersMessage("main", []string{"anna", "john"}),
+		NewTypingMessage(MsgTypingStartMT, "main", "client-1", "john"),
+		NewTypingMessage(MsgTypingStopMT, "main", "client-1", "john"),
+		NewMessageChangedMessage(MsgEditMsgMT, parent),
+		NewMessageChangedMessage(MsgDeleteMsgMT, deleted),
+		NewReactionMessage(MsgReactMT, parent, "👍", "client-2", "anna"),
+		NewReactionMessage(MsgUnreactMT, direct, "🎉", "client-2", "anna"),
+		NewMarkReadMessage("main", 42, 1),
+		NewModerationMessage(MsgKickUserMT, "main", "mike", time.Time{}, "client-1", "john"),
+		NewModerationMessage(MsgBanUserMT, "main", "mike", until, "client-1", "john"),
+		NewModerationMessage(MsgMuteUserMT, "main", "mike", until, "client-1", "john"),
+		NewModerationMessage(MsgAddModeratorMT, "main", "anna", time.Time{}, "client-1", "john"),
+		NewModerationMessage(MsgRemoveModeratorMT, "main", "anna", time.Time{}, "client-1", "john"),
+		NewInvitationMessage(MsgInviteMT, "random", "client-1", "john", "anna"),
+		NewInvitationMessage(MsgInviteAcceptMT, "random", "client-2", "anna", "john"),
+		NewInvitationMessage(MsgInviteDeclineMT, "random", "client-2", "anna", "john"),
+		{MsgType: MsgRoomUpdateMT, Room: "random", NewName: "general", MaxMessageSize: 1024},
+		NewRoomInfoMessage(&RoomInfo{
+			Name:           "general",
+			Topic:          "Everything",
+			Owner:          "john",
+			Moderators:     []string{"anna"},
+			CreatedBy:      "john",
+			CreatedAt:      sent.UnixMilli(),
+			Visibility:     VisibilityPassword,
+			Persistent:     true,
+			MaxMessageSize: 1024,
+		}, "random"),
+		NewCommandResultMessage("main", "Topic of room main: Everything"),
+		NewResumeMessage([]string{"main", "general"}),
+		NewResyncMessage("main"),
+	}
+}
+
+func TestRealisticMessagesCoverEveryMessageType(t *testing.T) {
+	// given
+	covered := make(map[string]bool)
+
+	// when
+	for _, msg := range realisticMessages() {
+		covered[msg.MsgType] = true
+	}
+
+	// then
+	for _, msgType := range messageTypes {
+		assert.True(t, covered[msgType], "message type %v", msgType)
+	}
+}
+
+func TestCodecsRoundTripRealisticMessages(t *testing.T) {
+	for _, codec := range codecs {
+		for _, msg := range realisticMessages() {
+			// given
+			envelope := NewEnvelope(ProtocolVersion, msg)
+
+			// when
+			data, err := codec.Marshal(envelope)
+			assert.NoError(t, err)
+
+			decoded, err := decodeSent(codec, data)
+
+			// then
+			assert.NoError(t, err)
+			assert.Equal(t, envelope, decoded, "codec %v, message %v", codec.Subprotocol(), msg.MsgType)
+		}
+	}
+}
+
+func TestCodecsDecodeMessagesSentByClients(t *testing.T) {
+	content := "cześć 👋"
+
+	// text message as it is sent by a client of each codec
+	sent := map[Codec][]byte{
+		jsonCodec{}: []byte(`{"v":1,"type":"TEXT_MSG","requestId":"7","payload":{"room":"main","content":"cześć 👋","clientMsgId":"c-1"}}`),
+		msgPackCodec{}: []byte("\x84" +
+			"\xa1v\x01" +
+			"\xa4type\xa8TEXT_MSG" +
+			"\xa9requestId\xa17" +
+			"\xa7payload\x83" +
+			"\xa4room\xa4main" +
+			"\xa7content\xac" + content +
+			"\xabclientMsgId\xa3c-1"),
+		protobufCodec{}: []byte("\x08\x01" + // v
+			"\x12\x08TEXT_MSG" + // type
+			"\x1a\x017" + // request_id
+			"\x4a\x19" + // text
+			"\x0a\x04main" + // room
+			"\x12\x0c" + content + // content
+			"\x1a\x03c-1"), // client_msg_id
+	}
+
+	for codec, data := range sent {
+		// given
+		var envelope Envelope
+
+		// when
+		err := codec.Unmarshal(data, &envelope)
+		assert.NoError(t, err, codec.Subprotocol())
+
+		msg, perr := envelope.message(ProtocolVersion)
+
+		// then
+		assert.Nil(t, perr, codec.Subprotocol())
+		assert.Equal(t, &Message{MsgType: MsgTextMsgMT, RequestID: "7", Room: "main", Content: content, ClientMsgID: "c-1"}, msg, codec.Subprotocol())
+	}
+}
+
+func TestCodecsRoundTripMinimalMessages(t *testing.T) {
+	messages := []*Message{
+		NewPingMessage(),
+		NewResyncMessage("main"),
+		NewResumeMessage([]string{"main"}),
+		NewHelloMessage("req-2", ProtocolVersion, Features()),
+		ErrorMessage(ErrCodeUnknownType, "req-3", "unknown message type"),
+		NewRoomInfoMessage(&RoomInfo{Name: "main", Moderators: []string{"anna"}}, ""),
+	}
+
+	for _, codec := range codecs {
+		for _, msg := range messages {
+			// given
+			envelope := NewEnvelope(ProtocolVersion, msg)
+
+			// when
+			data, err := codec.Marshal(envelope)
+			assert.NoError(t, err)
+
+			decoded, err := decodeSent(codec, data)
+
+			// then
+			assert.NoError(t, err)
+			assert.Equal(t, envelope, decoded, "codec %v, message %v", codec.Subprotocol(), msg.MsgType)
+		}
+	}
+}
+
+func TestCodecForNegotiatedSubprotocol(t *testing.T) {
+	// given
+	offered := [][]string{nil, {"unknown"}, {JSONSubprotocol}, {"unknown", MsgPackSubprotocol}, {ProtobufSubprotocol, JSONSubprotocol}}
+	expected := []string{JSONSubprotocol, JSONSubprotocol, JSONSubprotocol, MsgPackSubprotocol, ProtobufSubprotocol}
+
+	for i, subprotocols := range offered {
+		// when
+		codec := CodecFor(subprotocols)
+
+		// then
+		assert.Equal(t, expected[i], codec.Subprotocol())
+	}
+}
+
+func TestProtobufCodecRejectsMalformedData(t *testing.T) {
+	// given
+	data := []byte{0x22, 0x10, 0x01}
+
+	// when
+	err := protobufCodec{}.Unmarshal(data, &Envelope{})
+
+	// then
+	assert.Error(t, err)
+}
+
+func TestProtobufCodecRejectsDeeplyNestedMessages(t *testing.T) {
+	// given
+	nested := &pb.Message{Content: "hi"}
+	for i := 0; i < maxProtoDepth; i++ {
+		nested = &pb.Message{Messages: []*pb.Message{nested}}
+	}
+
+	data, err := proto.Marshal(&pb.Envelope{V: ProtocolVersion, Type: MsgHistoryPageMT, Payload: &pb.Envelope_Message{Message: nested}})
+	assert.NoError(t, err)
+
+	// when
+	err = protobufCodec{}.Unmarshal(data, &Envelope{})
+
+	// then
+	assert.Error(t, err)
+}
+
+func TestCodecsRejectPayloadsNotMatchingTypes(t *testing.T) {
+	encodeMsgPack := func(envelope map[string]interface{}) []byte {
+		data, err := msgpack.Marshal(envelope)
+		assert.NoError(t, err)
+		return data
+	}
+	encodeProto := func(envelope *pb.Envelope) []byte {
+		data, err := proto.Marshal(envelope)
+		assert.NoError(t, err)
+		return data
+	}
+
+	testData := []struct {
+		name     string
+		codec    Codec
+		data     []byte
+		expected string
+	}{
+		{
+			name:  "json message with sender",
+			codec: jsonCodec{},
+			data:  []byte(`{"v":1,"type":"TEXT_MSG","payload":{"room":"main","content":"hi","senderId":"s-1","senderName":"john"}}`),
+		},
+		{
+			name:     "json message with field of other type",
+			codec:    jsonCodec{},
+			data:     []byte(`{"v":1,"type":"TEXT_MSG","payload":{"room":"main","content":"hi","target":"anna"}}`),
+			expected: ErrCodeInvalidPayload,
+		},
+		{
+			name:     "json message with field of wrong type",
+			codec:    jsonCodec{},
+			data:     []byte(`{"v":1,"type":"MARK_READ","payload":{"room":"main","seq":"last"}}`),
+			expected: ErrCodeInvalidPayload,
+		},
+		{
+			name:     "json message without fields with payload",
+			codec:    jsonCodec{},
+			data:     []byte(`{"v":1,"type":"PONG","payload":{"room":"main"}}`),
+			expected: ErrCodeInvalidPayload,
+		},
+		{
+			name:  "json message of unknown type",
+			codec: jsonCodec{},
+			data:  []byte(`{"v":1,"type":"SHOUT","payload":{"room":"main"}}`),
+		},
+		{
+			name:  "msgpack message",
+			codec: msgPackCodec{},
+			data:  encodeMsgPack(map[string]interface{}{"v": 1, "type": MsgTextMsgMT, "payload": map[string]interface{}{"room": "main", "content": "hi", "senderId": "s-1"}}),
+		},
+		{
+			name:     "msgpack message with field of other type",
+			codec:    msgPackCodec{},
+			data:     encodeMsgPack(map[string]interface{}{"v": 1, "type": MsgTextMsgMT, "payload": map[string]interface{}{"room": "main", "until": 1}}),
+			expected: ErrCodeInvalidPayload,
+		},
+		{
+			name:  "protobuf message",
+			codec: protobufCodec{},
+			data:  encodeProto(&pb.Envelope{V: 1, Type: MsgKickUserMT, Payload: &pb.Envelope_Target{Target: &pb.TargetPayload{Room: "main", Target: "anna"}}}),
+		},
+		{
+			name:     "protobuf message with payload of other type",
+			codec:    protobufCodec{},
+			data:     encodeProto(&pb.Envelope{V: 1, Type: MsgTextMsgMT, Payload: &pb.Envelope_Target{Target: &pb.TargetPayload{Room: "main", Target: "anna"}}}),
+			expected: ErrCodeInvalidPayload,
+		},
+		{
+			name:     "protobuf message with payload of server message",
+			codec:    protobufCodec{},
+			data:     encodeProto(&pb.Envelope{V: 1, Type: MsgTextMsgMT, Payload: &pb.Envelope_Message{Message: &pb.Message{Room: "main", Content: "hi"}}}),
+			expected: ErrCodeInvalidPayload,
+		},
+	}
+
+	for _, data := range testData {
+		// given
+		var envelope Envelope
+
+		// when
+		err := data.codec.Unmarshal(data.data, &envelope)
+		msg, perr := envelope.message(ProtocolVersion)
+
+		// then
+		assert.NoError(t, err, data.name)
+		if data.expected == "" {
+			assert.Nil(t, perr, data.name)
+			assert.NotNil(t, msg, data.name)
+			continue
+		}
+
+		assert.Nil(t, msg, data.name)
+		if assert.NotNil(t, perr, data.name) {
+			assert.Equal(t, data.expected, perr.Code, data.name)
+		}
+	}
+}
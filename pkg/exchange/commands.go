@@ -0,0 +1,342 @@
+package exchange
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// commandPrefix starts every command typed in a room.
+	commandPrefix = "/"
+
+	// ErrCodeUnknownCommand is a code of errors sent for commands which are not registered.
+	ErrCodeUnknownCommand = "UNKNOWN_COMMAND"
+	// ErrCodeInvalidArguments is a code of errors sent for commands with invalid arguments.
+	ErrCodeInvalidArguments = "INVALID_ARGUMENTS"
+)
+
+var validNick = regexp.MustCompile(`^[\p{L}\p{N}_.-]{1,32}$`)
+
+// CommandCall is a struct containing data of a single command invocation.
+type CommandCall struct {
+	Client *Client
+	Room   string
+	// Args contains whitespace separated arguments of the command.
+	Args []string
+	// Text contains everything typed after the command name.
+	Text string
+}
+
+// Command is a slash command which can be typed in a room. Run returns message
+// which is handled as if it was sent by the client or nil if the command has
+// already been handled.
+type Command struct {
+	Name        string
+	Usage       string
+	Description string
+	MinArgs     int
+	Run         func(call CommandCall) (*Message, error)
+}
+
+// NewCommands returns new Commands struct with all built-in commands registered.
+// Given user directory is used for preventing nicknames equal to names of other users.
+func NewCommands(users userDirectory) *Commands {
+	commands := &Commands{
+		commands: make(map[string]*Command),
+	}
+
+	for _, command := range builtinCommands(users) {
+		commands.Register(command)
+	}
+
+	commands.Register(&Command{
+		Name:        "help",
+		Usage:       "/help",
+		Description: "lists available commands",
+		Run:         commands.help,
+	})
+
+	return commands
+}
+
+// Commands is a registry of slash commands.
+type Commands struct {
+	commands map[string]*Command
+}
+
+// Register adds given command to the registry replacing command with the same name.
+func (c *Commands) Register(command *Command) {
+	c.commands[command.Name] = command
+}
+
+// Find returns command with given name or nil if there is no such command.
+func (c *Commands) Find(name string) *Command {
+	return c.commands[name]
+}
+
+func (c *Commands) help(call CommandCall) (*Message, error) {
+	names := make([]string, 0, len(c.commands))
+	for name := range c.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		command := c.commands[name]
+		lines = append(lines, fmt.Sprintf("%v - %v", command.Usage, command.Description))
+	}
+
+	call.Client.Send(NewCommandResultMessage(call.Room, strings.Join(lines, "\n")))
+	return nil, nil
+}
+
+// parseCommand splits given text into command name and the rest of the text.
+// Returns 'false' if text is not a command. Text starting with two prefixes
+// is a message starting with single prefix.
+func parseCommand(text string) (string, string, bool) {
+	if !strings.HasPrefix(text, commandPrefix) || strings.HasPrefix(text, commandPrefix+commandPrefix) {
+		return "", "", false
+	}
+
+	name, rest, _ := strings.Cut(strings.TrimPrefix(text, commandPrefix), " ")
+	return strings.ToLower(name), strings.TrimSpace(rest), true
+}
+
+// NewCommandHandler returns new CommandHandler struct.
+func NewCommandHandler(commands *Commands, router *Router, client *Client, next Handler) *CommandHandler {
+	return &CommandHandler{
+		commands: commands,
+		router:   router,
+		client:   client,
+		next:     next,
+	}
+}
+
+// CommandHandler handles TEXT_MSG messages which contain slash commands.
+// Other messages are passed to the next handler.
+type CommandHandler struct {
+	commands *Commands
+	router   *Router
+	client   *Client
+	next     Handler
+}
+
+func (h *CommandHandler) Handle(msg *Message) error {
+	name, text, isCommand := parseCommand(msg.Content)
+	if !isCommand {
+		if strings.HasPrefix(msg.Content, commandPrefix+commandPrefix) {
+			msg.Content = strings.TrimPrefix(msg.Content, commandPrefix)
+		}
+		return h.next.Handle(msg)
+	}
+
+	command := h.commands.Find(name)
+	if command == nil {
+		h.client.Send(NewCommandErrorMessage(ErrCodeUnknownCommand, msg.RequestID, name, fmt.Sprintf("Unknown command /%v. Type /help to list commands", name)))
+		return nil
+	}
+
+	args := strings.Fields(text)
+	if len(args) < command.MinArgs {
+		h.client.Send(NewCommandErrorMessage(ErrCodeInvalidArguments, msg.RequestID, name, fmt.Sprintf("Usage: %v", command.Usage)))
+		return nil
+	}
+
+	result, err := command.Run(CommandCall{
+		Client: h.client,
+		Room:   msg.Room,
+		Args:   args,
+		Text:   text,
+	})
+	if err != nil {
+		h.client.Send(NewCommandErrorMessage(ErrCodeInvalidArguments, msg.RequestID, name, err.Error()))
+		return nil
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	result.RequestID = msg.RequestID
+	result.SenderID = msg.SenderID
+	result.SenderName = msg.SenderName
+	result.SenderNick = msg.SenderNick
+	if result.Room == "" {
+		result.Room = msg.Room
+	}
+
+	// the result is dispatched to its route only, as router middlewares
+	// have already handled the command message
+	return h.router.FindRoute(result.MsgType).Handle(result)
+}
+
+func builtinCommands(users userDirectory) []*Command {
+	return []*Command{
+		{
+			Name:        "join",
+			Usage:       "/join <room> [password]",
+			Description: "enters the room",
+			MinArgs:     1,
+			Run: func(call CommandCall) (*Message, error) {
+				msg := &Message{MsgType: MsgUserJoinedRoomMT, Room: call.Args[0]}
+				if len(call.Args) > 1 {
+					msg.Password = call.Args[1]
+				}
+				return msg, nil
+			},
+		},
+		{
+			Name:        "leave",
+			Usage:       "/leave",
+			Description: "leaves the current room",
+			Run: func(call CommandCall) (*Message, error) {
+				if call.Room == MainRoomName() {
+					return nil, fmt.Errorf("room %v cannot be left", MainRoomName())
+				}
+				return &Message{MsgType: MsgUserLeftRoomMT}, nil
+			},
+		},
+		{
+			Name:        "create",
+			Usage:       "/create <room> [public|private|password] [password]",
+			Description: "creates new room",
+			MinArgs:     1,
+			Run: func(call CommandCall) (*Message, error) {
+				msg := &Message{MsgType: MsgCreateRoomMT, Room: call.Args[0]}
+				if len(call.Args) > 1 {
+					msg.Visibility = call.Args[1]
+				}
+				if len(call.Args) > 2 {
+					msg.Password = call.Args[2]
+				}
+				return msg, nil
+			},
+		},
+		{
+			Name:        "logout",
+			Usage:       "/logout",
+			Description: "logs out",
+			Run: func(call CommandCall) (*Message, error) {
+				return &Message{MsgType: MsgLogoutMT}, nil
+			},
+		},
+		{
+			Name:        "me",
+			Usage:       "/me <action>",
+			Description: "describes what you are doing",
+			MinArgs:     1,
+			Run: func(call CommandCall) (*Message, error) {
+				return &Message{
+					MsgType:     MsgTextMsgMT,
+					ClientMsgID: newMessageID(),
+					Content:     fmt.Sprintf("* %v %v", call.Client.DisplayName(), call.Text),
+				}, nil
+			},
+		},
+		{
+			Name:        "msg",
+			Usage:       "/msg <user> <message>",
+			Description: "sends direct message to the user",
+			MinArgs:     2,
+			Run: func(call CommandCall) (*Message, error) {
+				return &Message{
+					MsgType:     MsgDirectMsgMT,
+					ClientMsgID: newMessageID(),
+					Recipient:   call.Args[0],
+					Content:     strings.TrimSpace(strings.TrimPrefix(call.Text, call.Args[0])),
+				}, nil
+			},
+		},
+		{
+			Name:        "topic",
+			Usage:       "/topic <topic>",
+			Description: "changes topic of the current room",
+			Run: func(call CommandCall) (*Message, error) {
+				topic := call.Text
+				return &Message{MsgType: MsgRoomUpdateMT, Topic: &topic}, nil
+			},
+		},
+		{
+			Name:        "rename",
+			Usage:       "/rename <name>",
+			Description: "renames the current room",
+			MinArgs:     1,
+			Run: func(call CommandCall) (*Message, error) {
+				return &Message{MsgType: MsgRoomUpdateMT, NewName: call.Args[0]}, nil
+			},
+		},
+		{
+			Name:        "nick",
+			Usage:       "/nick [nickname]",
+			Description: "changes your nickname shown in rooms, without nickname restores user name",
+			Run: func(call CommandCall) (*Message, error) {
+				if call.Text != "" && !validNick.MatchString(call.Text) {
+					return nil, fmt.Errorf("invalid nickname %v", call.Text)
+				}
+
+				if call.Text != "" && call.Text != call.Client.UserName() {
+					exists, err := users.UserExists(call.Text)
+					if err != nil {
+						return nil, fmt.Errorf("cannot check nickname %v", call.Text)
+					}
+					if exists {
+						return nil, fmt.Errorf("nickname %v is a name of other user", call.Text)
+					}
+				}
+
+				if !call.Client.rooms.ClaimNick(call.Text, call.Client) {
+					return nil, fmt.Errorf("nickname %v is already used", call.Text)
+				}
+
+				call.Client.Send(NewCommandResultMessage(call.Room, fmt.Sprintf("You are now known as %v", call.Client.DisplayName())))
+				return nil, nil
+			},
+		},
+		targetCommand("invite", "invites the user to the current room", MsgInviteMT),
+		targetCommand("kick", "removes the user from the current room", MsgKickUserMT),
+		targetCommand("op", "makes the user a moderator of the current room", MsgAddModeratorMT),
+		targetCommand("deop", "removes the user from moderators of the current room", MsgRemoveModeratorMT),
+		targetCommand("owner", "transfers ownership of the current room to the user", MsgRoomUpdateMT),
+		restrictCommand("ban", "bans the user in the current room", MsgBanUserMT),
+		restrictCommand("mute", "mutes the user in the current room", MsgMuteUserMT),
+	}
+}
+
+// targetCommand returns command which sends message of given type targeting user given as an argument.
+func targetCommand(name, description, msgType string) *Command {
+	return &Command{
+		Name:        name,
+		Usage:       fmt.Sprintf("/%v <user>", name),
+		Description: description,
+		MinArgs:     1,
+		Run: func(call CommandCall) (*Message, error) {
+			return &Message{MsgType: msgType, Target: call.Args[0]}, nil
+		},
+	}
+}
+
+// restrictCommand returns command which restricts user given as an argument
+// for optional duration given as a second argument.
+func restrictCommand(name, description, msgType string) *Command {
+	return &Command{
+		Name:        name,
+		Usage:       fmt.Sprintf("/%v <user> [duration, e.g. 10m]", name),
+		Description: description,
+		MinArgs:     1,
+		Run: func(call CommandCall) (*Message, error) {
+			msg := &Message{MsgType: msgType, Target: call.Args[0]}
+			if len(call.Args) > 1 {
+				duration, err := time.ParseDuration(call.Args[1])
+				if err != nil || duration <= 0 {
+					return nil, fmt.Errorf("invalid duration %v", call.Args[1])
+				}
+				msg.Until = time.Now().Add(duration).UnixMilli()
+			}
+			return msg, nil
+		},
+	}
+}
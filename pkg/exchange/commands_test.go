@@ -0,0 +1,184 @@
+package exchange
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingHandler is a handler which records all handled messages.
+type recordingHandler struct {
+	handled []*Message
+}
+
+func (h *recordingHandler) Handle(msg *Message) error {
+	h.handled = append(h.handled, msg)
+	return nil
+}
+
+// tracingMiddleware returns middleware which appends given name to given
+// trace before and after the next handler handles a message.
+func tracingMiddleware(name string, trace *[]string) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(msg *Message) error {
+			*trace = append(*trace, name+" "+msg.MsgType)
+			err := next.Handle(msg)
+			*trace = append(*trace, name+" done")
+			return err
+		})
+	}
+}
+
+func TestSlashCommands(t *testing.T) {
+	testData := []struct {
+		name     string
+		content  string
+		expected *Message
+		code     string
+	}{
+		{name: "plain text is sent", content: "hello", expected: &Message{MsgType: MsgTextMsgMT, Room: MainRoomName(), Content: "hello"}},
+		{name: "doubled prefix is sent as text", content: "//hello", expected: &Message{MsgType: MsgTextMsgMT, Room: MainRoomName(), Content: "/hello"}},
+		{name: "join enters room with password", content: "/join lobby secret", expected: &Message{MsgType: MsgUserJoinedRoomMT, Room: "lobby", Password: "secret"}},
+		{name: "command name ignores case", content: "/KICK mike", expected: &Message{MsgType: MsgKickUserMT, Room: MainRoomName(), Target: "mike"}},
+		{name: "msg sends direct message", content: "/msg mike see you", expected: &Message{MsgType: MsgDirectMsgMT, Room: MainRoomName(), Recipient: "mike", Content: "see you"}},
+		{name: "unknown command is rejected", content: "/dance", code: ErrCodeUnknownCommand},
+		{name: "missing arguments are rejected", content: "/kick", code: ErrCodeInvalidArguments},
+		{name: "invalid duration is rejected", content: "/mute mike soon", code: ErrCodeInvalidArguments},
+		{name: "main room cannot be left", content: "/leave", code: ErrCodeInvalidArguments},
+	}
+
+	for _, data := range testData {
+		// given
+		rooms := newTestRooms(newMemoryStore())
+		router := NewRouter()
+		client, conn := connect(t, rooms, "anna", router)
+		assert.NotNil(t, conn.received(MsgUserJoinedRoomMT, inRoom(MainRoomName())), data.name)
+
+		var trace []string
+		router.Use(tracingMiddleware("global", &trace))
+
+		handler := &recordingHandler{}
+		for _, msgType := range []string{MsgUserJoinedRoomMT, MsgKickUserMT, MsgDirectMsgMT} {
+			router.RegisterRoute(NewRoute(msgType, handler))
+		}
+		router.RegisterRoute(NewRoute(MsgTextMsgMT, NewCommandHandler(NewCommands(testUsers{"anna", "mike"}), router, client, handler)))
+
+		// when
+		err := router.Handle(&Message{MsgType: MsgTextMsgMT, RequestID: "command", Room: MainRoomName(), Content: data.content, SenderName: "anna"})
+
+		// then
+		assert.NoError(t, err, data.name)
+		assert.Equal(t, []string{"global " + MsgTextMsgMT, "global done"}, trace, data.name)
+
+		if data.code != "" {
+			assert.Empty(t, handler.handled, data.name)
+			assert.NotNil(t, conn.received(MsgErrorMsgMT, withCode(data.code)), data.name)
+			continue
+		}
+
+		if assert.Len(t, handler.handled, 1, data.name) {
+			handled := handler.handled[0]
+			assert.Equal(t, "command", handled.RequestID, data.name)
+			assert.Equal(t, "anna", handled.SenderName, data.name)
+			assert.Equal(t, data.expected.MsgType, handled.MsgType, data.name)
+			assert.Equal(t, data.expected.Room, handled.Room, data.name)
+			assert.Equal(t, data.expected.Content, handled.Content, data.name)
+			assert.Equal(t, data.expected.Password, handled.Password, data.name)
+			assert.Equal(t, data.expected.Target, handled.Target, data.name)
+			assert.Equal(t, data.expected.Recipient, handled.Recipient, data.name)
+		}
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	testData := []struct {
+		name     string
+		msgType  string
+		expected []string
+	}{
+		{
+			name:    "global middlewares wrap route middlewares",
+			msgType: MsgPongMT,
+			expected: []string{
+				"first " + MsgPongMT, "second " + MsgPongMT, "route " + MsgPongMT,
+				"handler",
+				"route done", "second done", "first done",
+			},
+		},
+		{
+			name:    "global middlewares wrap handler of unknown types",
+			msgType: "DANCE",
+			expected: []string{
+				"first DANCE", "second DANCE",
+				"not found",
+				"second done", "first done",
+			},
+		},
+	}
+
+	for _, data := range testData {
+		// given
+		var trace []string
+		router := NewRouter()
+		router.Use(tracingMiddleware("first", &trace), tracingMiddleware("second", &trace))
+		router.NotFound(HandlerFunc(func(*Message) error {
+			trace = append(trace, "not found")
+			return nil
+		}))
+
+		handler := HandlerFunc(func(*Message) error {
+			trace = append(trace, "handler")
+			return nil
+		})
+		router.RegisterRoute(NewRoute(MsgPongMT, handler).Use(tracingMiddleware("route", &trace)))
+
+		// when
+		err := router.Handle(&Message{MsgType: data.msgType})
+
+		// then
+		assert.NoError(t, err, data.name)
+		assert.Equal(t, data.expected, trace, data.name)
+	}
+}
+
+func TestNickIsSharedByConnectionsOfUser(t *testing.T) {
+	testData := []struct {
+		name     string
+		user     string
+		nick     string
+		claimed  bool
+		expected string
+	}{
+		{name: "user claims free nickname", user: "anna", nick: "annie", claimed: true, expected: "annie"},
+		{name: "user restores own name", user: "anna", nick: "", claimed: true, expected: ""},
+		{name: "user cannot claim name of other user", user: "anna", nick: "Mike", claimed: false, expected: "ann"},
+		{name: "user cannot claim nickname of other user", user: "mike", nick: "ann", claimed: false, expected: ""},
+	}
+
+	for _, data := range testData {
+		// given
+		rooms := newTestRooms(newMemoryStore())
+		clients := make(map[string][]*Client)
+		for _, name := range []string{"anna", "anna", "mike"} {
+			client, conn := connect(t, rooms, name, NewRouter())
+			assert.NotNil(t, conn.received(MsgUserJoinedRoomMT, inRoom(MainRoomName())), data.name)
+			clients[name] = append(clients[name], client)
+		}
+		assert.True(t, rooms.ClaimNick("ann", clients["anna"][0]), data.name)
+
+		// when
+		claimed := rooms.ClaimNick(data.nick, clients[data.user][0])
+
+		// then
+		assert.Equal(t, data.claimed, claimed, data.name)
+
+		joined, conn := connect(t, rooms, data.user, NewRouter())
+		assert.NotNil(t, conn.received(MsgUserJoinedRoomMT, inRoom(MainRoomName())), data.name)
+
+		for _, client := range append(clients[data.user], joined) {
+			client := client
+			nick := func() bool { return client.Nick() == data.expected }
+			assert.Eventually(t, nick, testWaiting, testTick, data.name)
+		}
+	}
+}
@@ -1,32 +1,318 @@
 package exchange
 
 import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
-	"golang.org/x/net/websocket"
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	// CloseHeartbeatTimeout is a websocket close status sent to a client which missed heartbeats.
+	CloseHeartbeatTimeout = 4000
+
+	heartbeatTimeoutReason = "heartbeat timeout"
+
+	// closeFrameTimeout is a time for sending close frame if write timeout is not set.
+	closeFrameTimeout = time.Second
 )
 
-// NewWebSocketConn returns new instance of wsConnection,
-func NewWebSocketConn(webSocketConn *websocket.Conn) *WsConnection {
-	return &WsConnection{
+// compressionMetrics contains numbers and sizes of messages sent with and
+// without compression. For compressed messages both encoded size and size
+// of the frame sent through the network are recorded, 'ratio' is a ratio
+// of these sizes. Values are published by expvar under 'compression' key.
+var (
+	compressionMetrics = expvar.NewMap("compression")
+
+	compressedBytes     = new(expvar.Int)
+	compressedWireBytes = new(expvar.Int)
+)
+
+func init() {
+	compressionMetrics.Set("compressed.bytes", compressedBytes)
+	compressionMetrics.Set("compressed.wireBytes", compressedWireBytes)
+	compressionMetrics.Set("ratio", expvar.Func(func() interface{} {
+		if compressedBytes.Value() == 0 {
+			return 0.0
+		}
+		return float64(compressedWireBytes.Value()) / float64(compressedBytes.Value())
+	}))
+}
+
+// Heartbeat defines how often connection is checked and how long it may stay silent.
+// Zero values disable heartbeats and corresponding deadlines.
+type Heartbeat struct {
+	// Interval is a time between PING messages sent to a client.
+	Interval time.Duration
+	// ReadTimeout is a time after which a client which didn't send anything (including PONG) is disconnected.
+	ReadTimeout time.Duration
+	// WriteTimeout is a time after which sending a message to a client fails.
+	WriteTimeout time.Duration
+}
+
+// Compression defines how messages sent through websocket connections are
+// compressed with permessage-deflate extension.
+type Compression struct {
+	// Enabled allows negotiating permessage-deflate with clients.
+	Enabled bool
+	// Level is a flate compression level (from -2 to 9).
+	Level int
+	// Threshold is the size of the smallest encoded message which is compressed.
+	Threshold int
+}
+
+// Upgrade upgrades given request to websocket connection. Messages are
+// encoded with codec named by the first supported subprotocol offered by the
+// client (or JSON if there is none) and compressed if the client supports
+// permessage-deflate. Connection is closed if client sends a message longer
+// than 'readLimit' bytes (zero means no limit). If upgrade fails, client
+// gets an HTTP error response.
+func Upgrade(w http.ResponseWriter, req *http.Request, heartbeat Heartbeat, compression Compression, readLimit int64) (*WsConnection, error) {
+	codec := CodecFor(websocket.Subprotocols(req))
+
+	upgrader := websocket.Upgrader{
+		Subprotocols:      []string{codec.Subprotocol()},
+		EnableCompression: compression.Enabled,
+	}
+
+	counting := &countingResponseWriter{ResponseWriter: w}
+
+	webSocketConn, err := upgrader.Upgrade(counting, req, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "error while upgrading connection")
+	}
+
+	if err := webSocketConn.SetCompressionLevel(compression.Level); err != nil {
+		webSocketConn.Close()
+		return nil, errors.Wrap(err, "error while setting compression level")
+	}
+
+	if readLimit > 0 {
+		webSocketConn.SetReadLimit(readLimit)
+	}
+
+	compressed := compression.Enabled && offersDeflate(req)
+	return newWebSocketConn(webSocketConn, counting.conn, codec, heartbeat, compressed, compression.Threshold), nil
+}
+
+// newWebSocketConn returns new instance of wsConnection. Messages are encoded
+// with given codec, those not smaller than 'threshold' are compressed if
+// compression has been negotiated. Given counting connection is the network
+// connection of the websocket, used for measuring compression. If heartbeat
+// interval is set, PING messages are sent periodically until the connection is closed.
+func newWebSocketConn(webSocketConn *websocket.Conn, netConn *countingConn, codec Codec, heartbeat Heartbeat, compressed bool, threshold int) *WsConnection {
+	messageType := websocket.TextMessage
+	if codec.Binary() {
+		messageType = websocket.BinaryMessage
+	}
+
+	conn := &WsConnection{
 		webSocketConn: webSocketConn,
+		netConn:       netConn,
+		codec:         codec,
+		messageType:   messageType,
+		heartbeat:     heartbeat,
+		compressed:    compressed,
+		threshold:     threshold,
+		closed:        make(chan struct{}),
+	}
+
+	if heartbeat.Interval > 0 {
+		go sendHeartbeats(conn, heartbeat.Interval, conn.closed)
 	}
+
+	return conn
 }
 
 type WsConnection struct {
 	webSocketConn *websocket.Conn
+	netConn       *countingConn
+	codec         Codec
+	messageType   int
+	heartbeat     Heartbeat
+	compressed    bool
+	threshold     int
+	writeLock     sync.Mutex
+	closed        chan struct{}
+	closeOnce     sync.Once
 }
 
-func (c *WsConnection) Send(msg interface{}) error {
-	err := websocket.JSON.Send(c.webSocketConn, msg)
+// Send encodes given envelope and sends it. Envelopes smaller than the
+// threshold are not compressed, as compression wouldn't make them much smaller.
+func (c *WsConnection) Send(envelope *Envelope) error {
+	data, err := c.codec.Marshal(envelope)
+	if err != nil {
+		return errors.Wrapf(err, "error while encoding message")
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if err := c.setDeadline(c.webSocketConn.SetWriteDeadline, c.heartbeat.WriteTimeout); err != nil {
+		return errors.Wrapf(err, "error while setting write deadline")
+	}
+
+	compress := c.compressed && len(data) >= c.threshold
+	c.webSocketConn.EnableWriteCompression(compress)
+
+	written := c.netConn.written.Load()
+	err = c.webSocketConn.WriteMessage(c.messageType, data)
+	recordCompression(compress, len(data), c.netConn.written.Load()-written)
+
 	return errors.Wrapf(err, "error while sending message through websocket")
 }
 
-func (c *WsConnection) Receive(msg interface{}) error {
-	err := websocket.JSON.Receive(c.webSocketConn, &msg)
-	return errors.Wrapf(err, "error while receiving message from websocket")
+// Receive waits for a message from a client. PONG messages only extend read deadline
+// and are not returned. Messages which cannot be decoded are returned as invalid
+// envelopes, so the client is informed about them and the connection is kept. If nothing is received before the deadline, connection is
+// closed with CloseHeartbeatTimeout status.
+func (c *WsConnection) Receive(envelope *Envelope) error {
+	for {
+		if err := c.setDeadline(c.webSocketConn.SetReadDeadline, c.heartbeat.ReadTimeout); err != nil {
+			return errors.Wrapf(err, "error while setting read deadline")
+		}
+
+		_, data, err := c.webSocketConn.ReadMessage()
+		if timeout(err) {
+			c.closeWithReason(CloseHeartbeatTimeout, heartbeatTimeoutReason)
+			return errors.Wrapf(err, "client missed heartbeats")
+		}
+
+		if err != nil {
+			return errors.Wrapf(err, "error while receiving message from websocket")
+		}
+
+		*envelope = Envelope{}
+		if err := c.codec.Unmarshal(data, envelope); err != nil {
+			envelope.invalid = &ProtocolError{ErrCodeInvalidPayload, fmt.Sprintf("message cannot be decoded: %v", err)}
+			return nil
+		}
+
+		if envelope.Type == MsgPongMT {
+			continue
+		}
+
+		return nil
+	}
 }
 
 func (c *WsConnection) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+
 	err := c.webSocketConn.Close()
 	return errors.Wrapf(err, "error while closing websocket connection")
 }
+
+// sendHeartbeats sends PING messages through given transport with given
+// interval until 'closed' channel is closed.
+func sendHeartbeats(transport Transport, interval time.Duration, closed <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := transport.Send(NewEnvelope(ProtocolVersion, NewPingMessage())); err != nil {
+				logger.Warnf("Error while sending heartbeat. Error: %v", err)
+				return
+			}
+
+		case <-closed:
+			return
+		}
+	}
+}
+
+// closeWithReason sends close frame with given status and reason. Connection
+// itself has to be closed with Close.
+func (c *WsConnection) closeWithReason(status int, reason string) {
+	frameTimeout := c.heartbeat.WriteTimeout
+	if frameTimeout <= 0 {
+		frameTimeout = closeFrameTimeout
+	}
+
+	msg := websocket.FormatCloseMessage(status, reason)
+	if err := c.webSocketConn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(frameTimeout)); err != nil {
+		logger.Warnf("Error while sending close frame. Error: %v", err)
+	}
+}
+
+func (c *WsConnection) setDeadline(set func(time.Time) error, timeout time.Duration) error {
+	if timeout <= 0 {
+		return nil
+	}
+	return set(time.Now().Add(timeout))
+}
+
+func timeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// offersDeflate returns true if client sending given request supports permessage-deflate extension.
+func offersDeflate(req *http.Request) bool {
+	for _, extensions := range req.Header.Values("Sec-Websocket-Extensions") {
+		for _, extension := range strings.Split(extensions, ",") {
+			name, _, _ := strings.Cut(extension, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func recordCompression(compressed bool, size int, wireSize int64) {
+	if !compressed {
+		compressionMetrics.Add("uncompressed.messages", 1)
+		compressionMetrics.Add("uncompressed.bytes", int64(size))
+		return
+	}
+
+	compressionMetrics.Add("compressed.messages", 1)
+	compressedBytes.Add(int64(size))
+	compressedWireBytes.Add(wireSize)
+}
+
+// countingResponseWriter wraps connection hijacked during websocket upgrade
+// with countingConn.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	conn *countingConn
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer doesn't support hijacking")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w.conn = &countingConn{Conn: conn}
+	return w.conn, rw, nil
+}
+
+// countingConn counts bytes written to the network connection.
+type countingConn struct {
+	net.Conn
+	written atomic.Int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	return n, err
+}
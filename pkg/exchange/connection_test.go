@@ -0,0 +1,57 @@
+package exchange
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectionKeepsReceivingAfterUndecodableMessage(t *testing.T) {
+	// given
+	received := make(chan *Envelope, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := Upgrade(w, req, Heartbeat{}, Compression{}, 0)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			var envelope Envelope
+			if err := conn.Receive(&envelope); err != nil {
+				return
+			}
+			received <- &envelope
+		}
+	}))
+	defer server.Close()
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	// when
+	assert.NoError(t, client.WriteMessage(websocket.TextMessage, []byte(`{"v":1,"type":`)))
+	assert.NoError(t, client.WriteMessage(websocket.TextMessage, []byte(`{"v":1,"type":"TEXT_MSG","payload":{"room":"main","content":"hi"}}`)))
+
+	// then
+	for _, expected := range []string{ErrCodeInvalidPayload, ""} {
+		select {
+		case envelope := <-received:
+			msg, perr := envelope.message(ProtocolVersion)
+			if expected == "" {
+				assert.Nil(t, perr)
+				assert.Equal(t, "hi", msg.Content)
+			} else if assert.NotNil(t, perr) {
+				assert.Equal(t, expected, perr.Code)
+			}
+		case <-time.After(testWaiting):
+			assert.Fail(t, "message not received")
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package exchange
+
+import (
+	"github.com/adrian83/chat/pkg/room"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// roomStore is an interface which defines persistent storage of room definitions.
+type roomStore interface {
+	SaveRoom(def room.Definition) error
+	DeleteRoom(name string) error
+	Rooms() ([]*room.Definition, error)
+}
+
+type roomChange struct {
+	definition room.Definition
+	removed    bool
+	// previousName is set if the room has been renamed
+	previousName string
+}
+
+// definition returns data needed to recreate this room after restart.
+func (ch *Room) definition() room.Definition {
+	return room.Definition{
+		Name:           ch.Name(),
+		Owner:          ch.moderation.owner,
+		Moderators:     ch.moderation.moderatorNames(),
+		Bans:           toRestrictions(ch.moderation.bans),
+		Mutes:          toRestrictions(ch.moderation.mutes),
+		Invited:        ch.access.invitedNames(),
+		Invitations:    ch.access.pendingInvitations(),
+		Visibility:     ch.access.visibility,
+		PasswordHash:   ch.access.passwordHash,
+		Topic:          ch.topic,
+		Description:    ch.description,
+		CreatedBy:      ch.createdBy,
+		MaxMessageSize: int(ch.maxMessageSize.Load()),
+		Persistent:     ch.persistent,
+		CreatedAt:      ch.createdAt,
+	}
+}
+
+// restoreRooms creates and starts rooms persisted in the room store.
+func (ch *Rooms) restoreRooms() {
+	defs, err := ch.roomStore.Rooms()
+	if err != nil {
+		logger.Errorf("Cannot read persisted rooms. Error: %v", err)
+		return
+	}
+
+	for _, def := range defs {
+		if def.Name == MainRoomName() {
+			def.Owner = ch.mainRoomOwner
+			ch.rooms[def.Name].moderation = newModeration(*def)
+			continue
+		}
+
+		restored := NewRoom(*def, ch)
+		restored.restored = true
+		restored.Start()
+		ch.rooms[def.Name] = restored
+	}
+
+	logger.Infof("Restored %v rooms", len(defs))
+}
+
+// saveRoom schedules persisting of definition of given room.
+func (ch *Rooms) saveRoom(r *Room) {
+	ch.roomChanges <- roomChange{definition: r.definition()}
+}
+
+// renameRoom schedules persisting of definition of given room renamed from
+// given previous name together with moving messages and read markers to the new name.
+func (ch *Rooms) renameRoom(r *Room, previousName string) {
+	ch.roomChanges <- roomChange{definition: r.definition(), previousName: previousName}
+}
+
+// deleteRoom schedules removal of definition of room with given name.
+func (ch *Rooms) deleteRoom(name string) {
+	ch.roomChanges <- roomChange{definition: room.Definition{Name: name}, removed: true}
+}
+
+// persistRooms writes changes of room definitions to the room store in the
+// order they were made, so that the Rooms event loop doesn't wait for the database.
+func (ch *Rooms) persistRooms() {
+	for change := range ch.roomChanges {
+		var err error
+		switch {
+		case change.removed:
+			err = ch.roomStore.DeleteRoom(change.definition.Name)
+		case change.previousName != "":
+			err = ch.moveRoom(change.previousName, change.definition)
+		default:
+			err = ch.roomStore.SaveRoom(change.definition)
+		}
+
+		if err != nil {
+			logger.Errorf("Cannot persist changes of room %v. Error: %v", change.definition.Name, err)
+		}
+	}
+}
+
+func (ch *Rooms) moveRoom(previousName string, def room.Definition) error {
+	if err := ch.roomStore.SaveRoom(def); err != nil {
+		return err
+	}
+
+	if err := ch.roomStore.DeleteRoom(previousName); err != nil {
+		return err
+	}
+
+	return ch.store.RenameRoom(previousName, def.Name)
+}
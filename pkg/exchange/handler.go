@@ -2,22 +2,35 @@ package exchange
 
 import (
 	"fmt"
+	"math"
+	"time"
+
+	"github.com/adrian83/chat/pkg/history"
 )
 
 type Handler interface {
 	Handle(msg *Message) error
 }
 
-func NewRoute(msgType string, handler Handler) *Route {
+// HandlerFunc is an adapter which allows using ordinary functions as handlers.
+type HandlerFunc func(msg *Message) error
+
+func (f HandlerFunc) Handle(msg *Message) error {
+	return f(msg)
+}
+
+func NewRoute(msgType string, handler Handler, middlewares ...Middleware) *Route {
 	return &Route{
-		msgType: msgType,
-		handler: handler,
+		msgType:     msgType,
+		handler:     handler,
+		middlewares: middlewares,
 	}
 }
 
 type Route struct {
-	msgType string
-	handler Handler
+	msgType     string
+	handler     Handler
+	middlewares []Middleware
 }
 
 func (r *Route) Handle(msg *Message) error {
@@ -25,13 +38,19 @@ func (r *Route) Handle(msg *Message) error {
 		return fmt.Errorf("cannot handle message: %v", msg)
 	}
 
-	return r.handler.Handle(msg)
+	return chain(r.handler, r.middlewares).Handle(msg)
 }
 
 func (r *Route) MsgType() string {
 	return r.msgType
 }
 
+// Use adds given middlewares wrapping handler of this route.
+func (r *Route) Use(middlewares ...Middleware) *Route {
+	r.middlewares = append(r.middlewares, middlewares...)
+	return r
+}
+
 func NewRouter() *Router {
 	return &Router{
 		routes: map[string]*Route{},
@@ -39,7 +58,9 @@ func NewRouter() *Router {
 }
 
 type Router struct {
-	routes map[string]*Route
+	routes      map[string]*Route
+	middlewares []Middleware
+	notFound    Handler
 }
 
 func (r *Router) RegisterRoute(route *Route) {
@@ -50,6 +71,36 @@ func (r *Router) FindRoute(msgType string) *Route {
 	return r.routes[msgType]
 }
 
+// Use adds given middlewares wrapping handlers of all routes. Global
+// middlewares are invoked before middlewares of a route.
+func (r *Router) Use(middlewares ...Middleware) {
+	r.middlewares = append(r.middlewares, middlewares...)
+}
+
+// Handle passes given message through global middlewares to the route
+// registered for its type.
+func (r *Router) Handle(msg *Message) error {
+	route := r.FindRoute(msg.MsgType)
+	if route == nil && r.notFound != nil {
+		return r.HandleWith(msg, r.notFound)
+	}
+
+	return r.HandleWith(msg, route)
+}
+
+// HandleWith passes given message through global middlewares to given
+// handler. It is used for messages answered without routing, so they are
+// still rate limited, logged and recovered from panics.
+func (r *Router) HandleWith(msg *Message, handler Handler) error {
+	return chain(handler, r.middlewares).Handle(msg)
+}
+
+// NotFound sets handler of messages of types without registered routes.
+// Global middlewares are applied to it as to any other route.
+func (r *Router) NotFound(handler Handler) {
+	r.notFound = handler
+}
+
 // ----
 
 func NewAddClientToRoomHandler(rooms *Rooms, client *Client) *AddClientToRoomHandler {
@@ -65,27 +116,55 @@ type AddClientToRoomHandler struct {
 }
 
 func (h *AddClientToRoomHandler) Handle(msg *Message) error {
-	h.rooms.AddClientToRoom(msg.Room, h.client)
+	h.rooms.AddClientToRoom(msg.RequestID, msg.Room, msg.Password, h.client)
 	return nil
 }
 
 // ----
 
-func NewSendMsgToRoomHandler(rooms *Rooms) *SendMsgToRoomHandler {
+func NewSendMsgToRoomHandler(rooms *Rooms, store messageStore, client *Client) *SendMsgToRoomHandler {
 	return &SendMsgToRoomHandler{
-		rooms: rooms,
+		rooms:  rooms,
+		store:  store,
+		client: client,
 	}
 }
 
 type SendMsgToRoomHandler struct {
-	rooms *Rooms
+	rooms  *Rooms
+	store  messageStore
+	client *Client
 }
 
 func (h *SendMsgToRoomHandler) Handle(msg *Message) error {
+	if r := h.rooms.Restriction(msg.Room, h.client.UserName()); r.banned || r.muted {
+		h.client.Send(ErrorMessage(ErrCodeForbidden, msg.RequestID, restrictionError(r, msg.Room)))
+		return nil
+	}
+
+	if msg.ParentID != "" {
+		parent, err := h.store.FindMessage(msg.ParentID)
+		if err != nil {
+			h.client.Send(ErrorMessage(ErrCodeInternal, msg.RequestID, "Cannot find thread"))
+			return fmt.Errorf("cannot find parent message %v, error: %w", msg.ParentID, err)
+		}
+
+		if !threadParent(parent, msg.Room) {
+			h.client.Send(ErrorMessage(ErrCodeForbidden, msg.RequestID, fmt.Sprintf("Message %v cannot be replied in room %v", msg.ParentID, msg.Room)))
+			return nil
+		}
+	}
+
 	h.rooms.SendMessageOnRoom(msg)
 	return nil
 }
 
+// threadParent returns 'true' if given message can start a thread in given
+// room. Threads can't be nested.
+func threadParent(parent *history.Message, room string) bool {
+	return parent != nil && !parent.Deleted && !parent.Direct() && !parent.Reply() && parent.Room == room
+}
+
 // ----
 
 func NewCreateRoomHandler(rooms *Rooms, client *Client) *CreateRoomHandler {
@@ -101,7 +180,7 @@ type CreateRoomHandler struct {
 }
 
 func (h *CreateRoomHandler) Handle(msg *Message) error {
-	h.rooms.CreateRoom(msg.Room, h.client)
+	h.rooms.CreateRoom(msg.RequestID, msg.Room, msg.Visibility, msg.Password, msg.Persistent, h.client)
 	return nil
 }
 
@@ -140,3 +219,663 @@ func (h *LogoutHandler) Handle(msg *Message) error {
 	h.client.Send(msg)
 	return nil
 }
+
+// ----
+
+func NewHistoryRequestHandler(rooms *Rooms, store messageStore, client *Client, pageSize int) *HistoryRequestHandler {
+	return &HistoryRequestHandler{
+		rooms:    rooms,
+		store:    store,
+		client:   client,
+		pageSize: pageSize,
+	}
+}
+
+type HistoryRequestHandler struct {
+	rooms    *Rooms
+	store    messageStore
+	client   *Client
+	pageSize int
+}
+
+func (h *HistoryRequestHandler) Handle(msg *Message) error {
+	if msg.Recipient == "" && !h.rooms.Admitted(msg.Room, h.client.UserName()) {
+		h.client.Send(ErrorMessage(ErrCodeForbidden, msg.RequestID, fmt.Sprintf("You are not allowed to read room %v", msg.Room)))
+		return nil
+	}
+
+	limit := msg.Limit
+	if limit <= 0 || limit > h.pageSize {
+		limit = h.pageSize
+	}
+
+	stored, err := h.readHistory(msg, limit)
+	if err != nil {
+		h.client.Send(ErrorMessage(ErrCodeInternal, msg.RequestID, "Cannot read message history"))
+		return fmt.Errorf("cannot read history of room %v / recipient %v, error: %w", msg.Room, msg.Recipient, err)
+	}
+
+	messages := fromStoredMessages(stored)
+
+	cursor, cursorID := msg.Before, msg.ID
+	if len(messages) > 0 {
+		cursor, cursorID = pageCursor(msg, messages[0])
+	}
+
+	page := NewHistoryPageMessage(msg.Room, cursor, messages)
+	page.Recipient = msg.Recipient
+	page.ID = cursorID
+
+	h.client.Send(page)
+	return nil
+}
+
+// readHistory reads page of messages requested by given message. Room
+// history is paged by sequence numbers, direct messages (which have no
+// sequence numbers) are paged by time in milliseconds and identifiers,
+// as more messages can be sent in the same millisecond.
+func (h *HistoryRequestHandler) readHistory(msg *Message, limit int) ([]*history.Message, error) {
+	if msg.Recipient != "" {
+		var before time.Time
+		if msg.Before > 0 {
+			before = time.UnixMilli(msg.Before).UTC()
+		}
+		return h.store.DirectMessagesBefore(h.client.UserName(), msg.Recipient, before, msg.ID, limit)
+	}
+	return h.store.MessagesBefore(msg.Room, sequenceBefore(msg.Before), limit)
+}
+
+// pageCursor returns values of 'before' and 'id' fields requesting messages
+// older than given oldest message of a page. Identifier is used only by
+// direct messages.
+func pageCursor(req *Message, oldest *Message) (int64, string) {
+	if req.Recipient != "" {
+		return oldest.Time, oldest.ID
+	}
+	return oldest.Sequence, ""
+}
+
+// sequenceBefore returns sequence number which all requested messages are
+// lower than. Zero means that the latest messages are requested.
+func sequenceBefore(before int64) int64 {
+	if before <= 0 {
+		return math.MaxInt64
+	}
+	return before
+}
+
+// ----
+
+// userDirectory is an interface which defines registry of all application users.
+type userDirectory interface {
+	UserExists(name string) (bool, error)
+}
+
+func NewDirectMsgHandler(rooms *Rooms, store messageStore, users userDirectory, client *Client) *DirectMsgHandler {
+	return &DirectMsgHandler{
+		rooms:  rooms,
+		store:  store,
+		users:  users,
+		client: client,
+	}
+}
+
+type DirectMsgHandler struct {
+	rooms  *Rooms
+	store  messageStore
+	users  userDirectory
+	client *Client
+}
+
+func (h *DirectMsgHandler) Handle(msg *Message) error {
+	if limit := h.rooms.MessageLimit(""); len(msg.Content) > limit {
+		h.client.Send(ErrorMessage(ErrCodeTooLarge, msg.RequestID, fmt.Sprintf("Message is longer than %v bytes allowed", limit)))
+		return nil
+	}
+
+	exists, err := h.users.UserExists(msg.Recipient)
+	if err != nil {
+		return fmt.Errorf("cannot check if user %v exists, error: %w", msg.Recipient, err)
+	}
+
+	if !exists {
+		h.client.Send(ErrorMessage(ErrCodeNotFound, msg.RequestID, fmt.Sprintf("User %v doesn't exist", msg.Recipient)))
+		return nil
+	}
+
+	if msg.ClientMsgID != "" {
+		retried, err := h.store.FindByClientMsgID(msg.SenderName, msg.ClientMsgID)
+		if err != nil {
+			return fmt.Errorf("cannot check if direct message %v was already sent, error: %w", msg.ClientMsgID, err)
+		}
+
+		if retried != nil {
+			ack := NewAckMessage(fromStoredMessage(retried))
+			ack.RequestID = msg.RequestID
+			h.client.Send(ack)
+			return nil
+		}
+	}
+
+	msg.Room = ""
+	msg.ID = ""
+	msg.Time = 0
+	stamp(msg)
+
+	if _, err := h.store.SaveDirectMessage(toStoredMessage(msg)); err != nil {
+		h.client.Send(ErrorMessage(ErrCodeInternal, msg.RequestID, "Cannot store direct message"))
+		return fmt.Errorf("cannot store direct message to %v, error: %w", msg.Recipient, err)
+	}
+
+	h.client.Send(NewAckMessage(msg))
+
+	// request identifier concerns only the sender
+	msg.RequestID = ""
+	h.rooms.SendDirectMessage(msg)
+	return nil
+}
+
+// ----
+
+func NewConversationsHandler(store messageStore, client *Client) *ConversationsHandler {
+	return &ConversationsHandler{
+		store:  store,
+		client: client,
+	}
+}
+
+type ConversationsHandler struct {
+	store  messageStore
+	client *Client
+}
+
+func (h *ConversationsHandler) Handle(msg *Message) error {
+	convs, err := h.store.Conversations(h.client.UserName())
+	if err != nil {
+		h.client.Send(ErrorMessage(ErrCodeInternal, msg.RequestID, "Cannot read direct conversations"))
+		return fmt.Errorf("cannot read conversations of user %v, error: %w", h.client.UserName(), err)
+	}
+
+	h.client.Send(NewConversationsMessage(fromStoredConversations(h.client.UserName(), convs)))
+	return nil
+}
+
+// ----
+
+func NewRoomMembersHandler(rooms *Rooms, client *Client) *RoomMembersHandler {
+	return &RoomMembersHandler{
+		rooms:  rooms,
+		client: client,
+	}
+}
+
+type RoomMembersHandler struct {
+	rooms  *Rooms
+	client *Client
+}
+
+func (h *RoomMembersHandler) Handle(msg *Message) error {
+	h.rooms.RoomMembers(msg.RequestID, msg.Room, h.client)
+	return nil
+}
+
+// ----
+
+func NewEditMsgHandler(rooms *Rooms, store messageStore, client *Client) *EditMsgHandler {
+	return &EditMsgHandler{
+		rooms:  rooms,
+		store:  store,
+		client: client,
+	}
+}
+
+type EditMsgHandler struct {
+	rooms  *Rooms
+	store  messageStore
+	client *Client
+}
+
+func (h *EditMsgHandler) Handle(msg *Message) error {
+	original, err := findOwnMessage(h.store, h.client, msg)
+	if err != nil || original == nil {
+		return err
+	}
+
+	if !original.Direct() {
+		if r := h.rooms.Restriction(original.Room, h.client.UserName()); r.banned || r.muted {
+			h.client.Send(ErrorMessage(ErrCodeForbidden, msg.RequestID, restrictionError(r, original.Room)))
+			return nil
+		}
+	}
+
+	if limit := h.rooms.MessageLimit(original.Room); len(msg.Content) > limit {
+		h.client.Send(ErrorMessage(ErrCodeTooLarge, msg.RequestID, fmt.Sprintf("Message is longer than %v bytes allowed", limit)))
+		return nil
+	}
+
+	edited, err := h.store.EditMessage(original.ID, msg.Content, time.Now().UTC())
+	if err != nil {
+		h.client.Send(ErrorMessage(ErrCodeInternal, msg.RequestID, "Cannot edit message"))
+		return fmt.Errorf("cannot edit message %v, error: %w", msg.ID, err)
+	}
+
+	// message could have been deleted in the meantime
+	if edited == nil {
+		h.client.Send(ErrorMessage(ErrCodeNotFound, msg.RequestID, fmt.Sprintf("Message %v doesn't exist", msg.ID)))
+		return nil
+	}
+
+	publishChange(h.rooms, NewMessageChangedMessage(MsgEditMsgMT, fromStoredMessage(edited)))
+	return nil
+}
+
+// ----
+
+func NewDeleteMsgHandler(rooms *Rooms, store messageStore, client *Client) *DeleteMsgHandler {
+	return &DeleteMsgHandler{
+		rooms:  rooms,
+		store:  store,
+		client: client,
+	}
+}
+
+type DeleteMsgHandler struct {
+	rooms  *Rooms
+	store  messageStore
+	client *Client
+}
+
+func (h *DeleteMsgHandler) Handle(msg *Message) error {
+	original, err := findOwnMessage(h.store, h.client, msg)
+	if err != nil || original == nil {
+		return err
+	}
+
+	deleted, err := h.store.DeleteMessage(original.ID, time.Now().UTC())
+	if err != nil {
+		h.client.Send(ErrorMessage(ErrCodeInternal, msg.RequestID, "Cannot delete message"))
+		return fmt.Errorf("cannot delete message %v, error: %w", msg.ID, err)
+	}
+
+	// message could have been deleted in the meantime
+	if deleted == nil {
+		h.client.Send(ErrorMessage(ErrCodeNotFound, msg.RequestID, fmt.Sprintf("Message %v doesn't exist", msg.ID)))
+		return nil
+	}
+
+	publishChange(h.rooms, NewMessageChangedMessage(MsgDeleteMsgMT, fromStoredMessage(deleted)))
+	return nil
+}
+
+// ----
+
+// maxEmojiLength is a maximal length (in bytes) of an emoji used in reactions.
+const maxEmojiLength = 32
+
+func NewReactionHandler(rooms *Rooms, store messageStore, client *Client) *ReactionHandler {
+	return &ReactionHandler{
+		rooms:  rooms,
+		store:  store,
+		client: client,
+	}
+}
+
+// ReactionHandler handles both adding (REACT) and removing (UNREACT) reactions.
+type ReactionHandler struct {
+	rooms  *Rooms
+	store  messageStore
+	client *Client
+}
+
+func (h *ReactionHandler) Handle(msg *Message) error {
+	if msg.Emoji == "" || len(msg.Emoji) > maxEmojiLength {
+		h.client.Send(ErrorMessage(ErrCodeInvalidPayload, msg.RequestID, "Invalid emoji"))
+		return nil
+	}
+
+	stored, err := h.store.FindMessage(msg.ID)
+	if err != nil {
+		h.client.Send(ErrorMessage(ErrCodeInternal, msg.RequestID, "Cannot find message"))
+		return fmt.Errorf("cannot find message %v, error: %w", msg.ID, err)
+	}
+
+	if stored == nil || stored.Deleted || !visibleTo(stored, h.client.UserName()) {
+		h.client.Send(ErrorMessage(ErrCodeNotFound, msg.RequestID, fmt.Sprintf("Message %v doesn't exist", msg.ID)))
+		return nil
+	}
+
+	if !stored.Direct() {
+		if !h.rooms.Admitted(stored.Room, h.client.UserName()) {
+			h.client.Send(ErrorMessage(ErrCodeForbidden, msg.RequestID, fmt.Sprintf("You are not allowed to react in room %v", stored.Room)))
+			return nil
+		}
+
+		if r := h.rooms.Restriction(stored.Room, h.client.UserName()); r.banned || r.muted {
+			h.client.Send(ErrorMessage(ErrCodeForbidden, msg.RequestID, restrictionError(r, stored.Room)))
+			return nil
+		}
+	}
+
+	if msg.MsgType == MsgUnreactMT {
+		err = h.store.RemoveReaction(stored.ID, msg.Emoji, h.client.UserName())
+	} else {
+		err = h.store.AddReaction(stored.ID, msg.Emoji, h.client.UserName(), time.Now().UTC())
+	}
+
+	if err != nil {
+		h.client.Send(ErrorMessage(ErrCodeInternal, msg.RequestID, "Cannot store reaction"))
+		return fmt.Errorf("cannot store reaction to message %v, error: %w", msg.ID, err)
+	}
+
+	reaction := NewReactionMessage(msg.MsgType, fromStoredMessage(stored), msg.Emoji, h.client.ID(), h.client.UserName())
+	if stored.Direct() {
+		// direct messages are delivered to the sender and the recipient, so
+		// the other participant of the conversation becomes the recipient
+		reaction.Recipient = peer(stored, h.client.UserName())
+	}
+
+	publishChange(h.rooms, reaction)
+	return nil
+}
+
+// peer returns the participant of the direct conversation which given message belongs to, other than given user.
+func peer(msg *history.Message, userName string) string {
+	if msg.SenderName == userName {
+		return msg.Recipient
+	}
+	return msg.SenderName
+}
+
+// visibleTo returns 'true' if given user can see given message, 'false' otherwise.
+func visibleTo(msg *history.Message, userName string) bool {
+	return !msg.Direct() || msg.SenderName == userName || msg.Recipient == userName
+}
+
+// findOwnMessage returns not deleted message with id given in request if it
+// has been sent by the user of given client. Otherwise client is notified
+// about the problem and nil is returned.
+func findOwnMessage(store messageStore, client *Client, req *Message) (*history.Message, error) {
+	id := req.ID
+	msg, err := store.FindMessage(id)
+	if err != nil {
+		client.Send(ErrorMessage(ErrCodeInternal, req.RequestID, "Cannot find message"))
+		return nil, fmt.Errorf("cannot find message %v, error: %w", id, err)
+	}
+
+	if msg == nil || msg.Deleted {
+		client.Send(ErrorMessage(ErrCodeNotFound, req.RequestID, fmt.Sprintf("Message %v doesn't exist", id)))
+		return nil, nil
+	}
+
+	if msg.SenderName != client.UserName() {
+		client.Send(ErrorMessage(ErrCodeForbidden, req.RequestID, "Only author can change the message"))
+		return nil, nil
+	}
+
+	return msg, nil
+}
+
+// publishChange sends given notification about changed message to
+// everyone who could see the message.
+func publishChange(rooms *Rooms, change *Message) {
+	if change.Recipient != "" {
+		rooms.SendDirectMessage(change)
+		return
+	}
+	rooms.SendMessageOnRoom(change)
+}
+
+// ----
+
+func NewThreadRequestHandler(rooms *Rooms, store messageStore, client *Client, pageSize int) *ThreadRequestHandler {
+	return &ThreadRequestHandler{
+		rooms:    rooms,
+		store:    store,
+		client:   client,
+		pageSize: pageSize,
+	}
+}
+
+type ThreadRequestHandler struct {
+	rooms    *Rooms
+	store    messageStore
+	client   *Client
+	pageSize int
+}
+
+func (h *ThreadRequestHandler) Handle(msg *Message) error {
+	parent, err := h.store.FindMessage(msg.ParentID)
+	if err != nil {
+		h.client.Send(ErrorMessage(ErrCodeInternal, msg.RequestID, "Cannot find thread"))
+		return fmt.Errorf("cannot find parent message %v, error: %w", msg.ParentID, err)
+	}
+
+	if parent == nil || parent.Direct() || parent.Reply() {
+		h.client.Send(ErrorMessage(ErrCodeNotFound, msg.RequestID, fmt.Sprintf("Thread %v doesn't exist", msg.ParentID)))
+		return nil
+	}
+
+	if !h.rooms.Admitted(parent.Room, h.client.UserName()) {
+		h.client.Send(ErrorMessage(ErrCodeForbidden, msg.RequestID, fmt.Sprintf("You are not allowed to read room %v", parent.Room)))
+		return nil
+	}
+
+	limit := msg.Limit
+	if limit <= 0 || limit > h.pageSize {
+		limit = h.pageSize
+	}
+
+	stored, err := h.store.ThreadMessagesBefore(parent.ID, sequenceBefore(msg.Before), limit)
+	if err != nil {
+		h.client.Send(ErrorMessage(ErrCodeInternal, msg.RequestID, "Cannot read thread"))
+		return fmt.Errorf("cannot read thread of message %v, error: %w", parent.ID, err)
+	}
+
+	replies := fromStoredMessages(stored)
+
+	cursor := msg.Before
+	if len(replies) > 0 {
+		cursor = replies[0].Sequence
+	}
+
+	h.client.Send(NewThreadPageMessage(fromStoredMessage(parent), cursor, replies))
+	return nil
+}
+
+// ----
+
+func NewMarkReadHandler(rooms *Rooms, store messageStore, client *Client) *MarkReadHandler {
+	return &MarkReadHandler{
+		rooms:  rooms,
+		store:  store,
+		client: client,
+	}
+}
+
+type MarkReadHandler struct {
+	rooms  *Rooms
+	store  messageStore
+	client *Client
+}
+
+func (h *MarkReadHandler) Handle(msg *Message) error {
+	if msg.Room == "" || msg.Sequence <= 0 {
+		h.client.Send(ErrorMessage(ErrCodeInvalidPayload, msg.RequestID, "Invalid read marker"))
+		return nil
+	}
+
+	sequence := h.rooms.MarkRead(msg.Room, msg.Sequence, h.client)
+	if sequence == 0 {
+		return nil
+	}
+
+	if err := h.store.SaveReadMarker(h.client.UserName(), msg.Room, sequence); err != nil {
+		return fmt.Errorf("cannot store read marker of room %v, error: %w", msg.Room, err)
+	}
+
+	return nil
+}
+
+// ----
+
+func NewModerationHandler(rooms *Rooms, client *Client) *ModerationHandler {
+	return &ModerationHandler{
+		rooms:  rooms,
+		client: client,
+	}
+}
+
+// ModerationHandler handles KICK_USER, BAN_USER, MUTE_USER, ADD_MODERATOR and REMOVE_MODERATOR messages.
+type ModerationHandler struct {
+	rooms  *Rooms
+	client *Client
+}
+
+func (h *ModerationHandler) Handle(msg *Message) error {
+	if msg.Target == "" {
+		h.client.Send(ErrorMessage(ErrCodeInvalidPayload, msg.RequestID, "Missing target user"))
+		return nil
+	}
+
+	h.rooms.Moderate(msg, h.client)
+	return nil
+}
+
+// ----
+
+func NewInvitationHandler(rooms *Rooms, users userDirectory, client *Client) *InvitationHandler {
+	return &InvitationHandler{
+		rooms:  rooms,
+		users:  users,
+		client: client,
+	}
+}
+
+// InvitationHandler handles INVITE, INVITE_ACCEPT and INVITE_DECLINE messages.
+type InvitationHandler struct {
+	rooms  *Rooms
+	users  userDirectory
+	client *Client
+}
+
+func (h *InvitationHandler) Handle(msg *Message) error {
+	if msg.MsgType == MsgInviteMT {
+		if msg.Target == "" {
+			h.client.Send(ErrorMessage(ErrCodeInvalidPayload, msg.RequestID, "Missing invited user"))
+			return nil
+		}
+
+		exists, err := h.users.UserExists(msg.Target)
+		if err != nil {
+			h.client.Send(ErrorMessage(ErrCodeInternal, msg.RequestID, "Cannot invite user"))
+			return fmt.Errorf("cannot check if user %v exists, error: %w", msg.Target, err)
+		}
+
+		if !exists {
+			h.client.Send(ErrorMessage(ErrCodeNotFound, msg.RequestID, fmt.Sprintf("User %v doesn't exist", msg.Target)))
+			return nil
+		}
+	}
+
+	h.rooms.Invite(msg, h.client)
+	return nil
+}
+
+// ----
+
+func NewRoomUpdateHandler(rooms *Rooms, users userDirectory, client *Client) *RoomUpdateHandler {
+	return &RoomUpdateHandler{
+		rooms:  rooms,
+		users:  users,
+		client: client,
+	}
+}
+
+// RoomUpdateHandler handles ROOM_UPDATE messages which rename rooms, change
+// their topics, descriptions and message size limits and transfer ownership.
+type RoomUpdateHandler struct {
+	rooms  *Rooms
+	users  userDirectory
+	client *Client
+}
+
+func (h *RoomUpdateHandler) Handle(msg *Message) error {
+	if msg.Target != "" {
+		exists, err := h.users.UserExists(msg.Target)
+		if err != nil {
+			h.client.Send(ErrorMessage(ErrCodeInternal, msg.RequestID, "Cannot transfer ownership"))
+			return fmt.Errorf("cannot check if user %v exists, error: %w", msg.Target, err)
+		}
+
+		if !exists {
+			h.client.Send(ErrorMessage(ErrCodeNotFound, msg.RequestID, fmt.Sprintf("User %v doesn't exist", msg.Target)))
+			return nil
+		}
+	}
+
+	h.rooms.UpdateRoom(msg, h.client)
+	return nil
+}
+
+// ----
+
+func NewResumeHandler(rooms *Rooms, client *Client) *ResumeHandler {
+	return &ResumeHandler{
+		rooms:  rooms,
+		client: client,
+	}
+}
+
+// ResumeHandler handles RESUME messages sent by reconnected clients.
+type ResumeHandler struct {
+	rooms  *Rooms
+	client *Client
+}
+
+func (h *ResumeHandler) Handle(msg *Message) error {
+	h.rooms.Resume(msg.Sequences, h.client)
+	return nil
+}
+
+// ----
+
+func NewHelloHandler(client *Client) *HelloHandler {
+	return &HelloHandler{
+		client: client,
+	}
+}
+
+// HelloHandler handles HELLO messages which negotiate protocol version and features.
+type HelloHandler struct {
+	client *Client
+}
+
+func (h *HelloHandler) Handle(msg *Message) error {
+	version, err := negotiateVersion(msg.Version)
+	if err != nil {
+		h.client.Send(ErrorMessage(ErrCodeUnsupportedVersion, msg.RequestID, err.Error()))
+		return nil
+	}
+
+	features := h.client.negotiate(version, msg.Features)
+	h.client.Send(NewHelloMessage(msg.RequestID, version, features))
+	return nil
+}
+
+// ----
+
+func NewUnknownTypeHandler(client *Client) *UnknownTypeHandler {
+	return &UnknownTypeHandler{
+		client: client,
+	}
+}
+
+// UnknownTypeHandler handles messages of types the server doesn't support.
+type UnknownTypeHandler struct {
+	client *Client
+}
+
+func (h *UnknownTypeHandler) Handle(msg *Message) error {
+	h.client.Send(ErrorMessage(ErrCodeUnknownType, msg.RequestID, fmt.Sprintf("Unknown message type %v", msg.MsgType)))
+	return nil
+}
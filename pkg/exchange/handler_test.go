@@ -0,0 +1,231 @@
+package exchange
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adrian83/chat/pkg/history"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEditedMessageSizeLimit(t *testing.T) {
+	testData := []struct {
+		name      string
+		room      string
+		recipient string
+		roomLimit int
+		length    int
+		expected  string
+	}{
+		{name: "edited message fits configured limit", room: MainRoomName(), length: 100},
+		{name: "edited message exceeds configured limit", room: MainRoomName(), length: 101, expected: ErrCodeTooLarge},
+		{name: "edited message exceeds room limit", room: "room", roomLimit: 50, length: 51, expected: ErrCodeTooLarge},
+		{name: "edited direct message fits configured limit", recipient: "mike", length: 100},
+		{name: "edited direct message exceeds configured limit", recipient: "mike", length: 101, expected: ErrCodeTooLarge},
+	}
+
+	for _, data := range testData {
+		// given
+		store := newMemoryStore()
+		rooms := newTestRooms(store)
+		owner, ownerConn := connect(t, rooms, testOwner, NewRouter())
+		assert.NotNil(t, ownerConn.received(MsgUserJoinedRoomMT, inRoom(MainRoomName())), data.name)
+
+		if data.room != MainRoomName() && data.room != "" {
+			rooms.CreateRoom("", data.room, VisibilityPublic, "", true, owner)
+			assert.NotNil(t, ownerConn.received(MsgUserJoinedRoomMT, inRoom(data.room)), data.name)
+
+			rooms.UpdateRoom(&Message{Room: data.room, MaxMessageSize: data.roomLimit}, owner)
+			limited := func(msg *Message) bool { return msg.Info != nil && msg.Info.MaxMessageSize == data.roomLimit }
+			assert.NotNil(t, ownerConn.received(MsgRoomInfoMT, limited), data.name)
+		}
+
+		original, _ := store.SaveMessage(history.Message{Room: data.room, Recipient: data.recipient, SenderName: testOwner, Content: "message"})
+		handler := NewEditMsgHandler(rooms, store, owner)
+
+		// when
+		err := handler.Handle(&Message{MsgType: MsgEditMsgMT, RequestID: "edit", ID: original.ID, Content: strings.Repeat("a", data.length)})
+
+		// then
+		assert.NoError(t, err, data.name)
+		if data.expected != "" {
+			assert.NotNil(t, ownerConn.received(MsgErrorMsgMT, withCode(data.expected)), data.name)
+			stored, _ := store.FindMessage(original.ID)
+			assert.Equal(t, "message", stored.Content, data.name)
+			continue
+		}
+
+		assert.NotNil(t, ownerConn.received(MsgEditMsgMT, anyMessage), data.name)
+	}
+}
+
+func TestDirectMessageSizeLimit(t *testing.T) {
+	testData := []struct {
+		name     string
+		length   int
+		expected string
+	}{
+		{name: "direct message fits configured limit", length: 100},
+		{name: "direct message exceeds configured limit", length: 101, expected: ErrCodeTooLarge},
+	}
+
+	for _, data := range testData {
+		// given
+		store := newMemoryStore()
+		rooms := newTestRooms(store)
+		anna, annaConn := connect(t, rooms, "anna", NewRouter())
+		handler := NewDirectMsgHandler(rooms, store, testUsers{"anna", "mike"}, anna)
+
+		// when
+		err := handler.Handle(&Message{MsgType: MsgDirectMsgMT, RequestID: "dm", SenderName: "anna", Recipient: "mike", Content: strings.Repeat("a", data.length)})
+
+		// then
+		assert.NoError(t, err, data.name)
+		if data.expected != "" {
+			assert.NotNil(t, annaConn.received(MsgErrorMsgMT, withCode(data.expected)), data.name)
+			assert.Empty(t, store.find(func(*history.Message) bool { return true }), data.name)
+			continue
+		}
+
+		assert.NotNil(t, annaConn.received(MsgAckMT, anyMessage), data.name)
+	}
+}
+
+// staleStore is a message store which finds messages as they were before they were deleted.
+type staleStore struct {
+	*memoryStore
+}
+
+func (s *staleStore) FindMessage(id string) (*history.Message, error) {
+	msg, err := s.memoryStore.FindMessage(id)
+	if msg != nil {
+		msg.Deleted = false
+	}
+	return msg, err
+}
+
+func TestChangingMessageDeletedInTheMeantime(t *testing.T) {
+	testData := []struct {
+		name    string
+		msgType string
+		handler func(rooms *Rooms, store messageStore, client *Client) Handler
+	}{
+		{name: "deleted message is not edited", msgType: MsgEditMsgMT, handler: func(rooms *Rooms, store messageStore, client *Client) Handler {
+			return NewEditMsgHandler(rooms, store, client)
+		}},
+		{name: "deleted message is not deleted again", msgType: MsgDeleteMsgMT, handler: func(rooms *Rooms, store messageStore, client *Client) Handler {
+			return NewDeleteMsgHandler(rooms, store, client)
+		}},
+	}
+
+	for _, data := range testData {
+		// given
+		store := &staleStore{memoryStore: newMemoryStore()}
+		rooms := newTestRooms(store)
+		owner, ownerConn := connect(t, rooms, testOwner, NewRouter())
+		assert.NotNil(t, ownerConn.received(MsgUserJoinedRoomMT, inRoom(MainRoomName())), data.name)
+
+		original, _ := store.SaveMessage(history.Message{Room: MainRoomName(), SenderName: testOwner, Content: "message"})
+		_, _ = store.DeleteMessage(original.ID, time.Now())
+
+		// when
+		err := data.handler(rooms, store, owner).Handle(&Message{MsgType: data.msgType, RequestID: "change", ID: original.ID, Content: "edited"})
+
+		// then
+		assert.NoError(t, err, data.name)
+		assert.NotNil(t, ownerConn.received(MsgErrorMsgMT, withCode(ErrCodeNotFound)), data.name)
+		assert.Empty(t, ownerConn.messages(data.msgType), data.name)
+
+		stored, _ := store.memoryStore.FindMessage(original.ID)
+		assert.Equal(t, "", stored.Content, data.name)
+		assert.Len(t, stored.Revisions, 1, data.name)
+	}
+}
+
+func TestHistoryPagination(t *testing.T) {
+	sent := time.UnixMilli(1700000000000).UTC()
+
+	testData := []struct {
+		name      string
+		room      string
+		recipient string
+		messages  []history.Message
+	}{
+		{
+			name: "room history is paged by sequence numbers",
+			room: MainRoomName(),
+			messages: []history.Message{
+				{ID: "m-1", Sequence: 1, Room: MainRoomName(), Time: sent},
+				{ID: "m-2", Sequence: 2, Room: MainRoomName(), Time: sent},
+				{ID: "m-3", Sequence: 3, Room: MainRoomName(), Time: sent},
+				{ID: "m-4", Sequence: 4, Room: MainRoomName(), Time: sent.Add(time.Millisecond)},
+				{ID: "m-5", Sequence: 5, Room: MainRoomName(), Time: sent.Add(time.Millisecond)},
+			},
+		},
+		{
+			name:      "direct messages sent at different times are paged",
+			recipient: "anna",
+			messages: []history.Message{
+				{ID: "d-1", Recipient: "anna", Time: sent},
+				{ID: "d-2", Recipient: "anna", Time: sent.Add(time.Millisecond)},
+				{ID: "d-3", Recipient: "anna", Time: sent.Add(2 * time.Millisecond)},
+			},
+		},
+		{
+			name:      "direct messages sent in the same millisecond are paged",
+			recipient: "anna",
+			messages: []history.Message{
+				{ID: "d-1", Recipient: "anna", Time: sent},
+				{ID: "d-2", Recipient: "anna", Time: sent},
+				{ID: "d-3", Recipient: "anna", Time: sent},
+				{ID: "d-4", Recipient: "anna", Time: sent},
+				{ID: "d-5", Recipient: "anna", Time: sent.Add(time.Millisecond)},
+			},
+		},
+	}
+
+	for _, data := range testData {
+		// given
+		store := newMemoryStore()
+		for _, msg := range data.messages {
+			msg.SenderName = testOwner
+			_, _ = store.SaveMessage(msg)
+		}
+
+		rooms := newTestRooms(store)
+		owner, ownerConn := connect(t, rooms, testOwner, NewRouter())
+		assert.NotNil(t, ownerConn.received(MsgUserJoinedRoomMT, inRoom(MainRoomName())), data.name)
+
+		handler := NewHistoryRequestHandler(rooms, store, owner, 2)
+
+		// when
+		read := make([]string, 0)
+		request := &Message{MsgType: MsgHistoryRequestMT, Room: data.room, Recipient: data.recipient}
+		for i := 0; i <= len(data.messages); i++ {
+			assert.NoError(t, handler.Handle(request), data.name)
+
+			pages := func() bool { return len(ownerConn.messages(MsgHistoryPageMT)) > i }
+			if !assert.Eventually(t, pages, testWaiting, testTick, data.name) {
+				break
+			}
+
+			page := ownerConn.messages(MsgHistoryPageMT)[i]
+			if len(page.Messages) == 0 {
+				break
+			}
+
+			for j := len(page.Messages) - 1; j >= 0; j-- {
+				read = append(read, page.Messages[j].ID)
+			}
+			request.Before, request.ID = page.Before, page.ID
+		}
+
+		// then
+		expected := make([]string, 0, len(data.messages))
+		for i := len(data.messages) - 1; i >= 0; i-- {
+			expected = append(expected, data.messages[i].ID)
+		}
+		assert.Equal(t, expected, read, data.name)
+	}
+}
@@ -0,0 +1,113 @@
+package exchange
+
+import (
+	"time"
+
+	"github.com/adrian83/chat/pkg/history"
+)
+
+// messageStore is an interface which defines persistent storage of messages sent in rooms.
+type messageStore interface {
+	SaveMessage(msg history.Message) (*history.Message, error)
+	LastMessages(room string, limit int) ([]*history.Message, error)
+	LastSequence(room string) (int64, error)
+	MessagesAfter(room string, sequence int64, limit int) ([]*history.Message, error)
+	MessagesBefore(room string, before int64, limit int) ([]*history.Message, error)
+	SaveDirectMessage(msg history.Message) (*history.Message, error)
+	FindByClientMsgID(senderName, clientMsgID string) (*history.Message, error)
+	FindMessage(id string) (*history.Message, error)
+	EditMessage(id, content string, at time.Time) (*history.Message, error)
+	DeleteMessage(id string, at time.Time) (*history.Message, error)
+	AddReaction(messageID, emoji, userName string, at time.Time) error
+	RemoveReaction(messageID, emoji, userName string) error
+	SaveReadMarker(userName, room string, sequence int64) error
+	ReadMarkers(userName string) (map[string]int64, error)
+	ThreadMessagesBefore(parentID string, before int64, limit int) ([]*history.Message, error)
+	DirectMessagesBefore(userName, peer string, before time.Time, beforeID string, limit int) ([]*history.Message, error)
+	Conversations(userName string) ([]*history.Conversation, error)
+	RenameRoom(oldName, newName string) error
+}
+
+func toStoredMessage(msg *Message) history.Message {
+	return history.Message{
+		ID:          msg.ID,
+		ClientMsgID: msg.ClientMsgID,
+		Sequence:    msg.Sequence,
+		ParentID:    msg.ParentID,
+		Room:        msg.Room,
+		SenderName:  msg.SenderName,
+		Recipient:   msg.Recipient,
+		Content:     msg.Content,
+		Time:        time.UnixMilli(msg.Time).UTC(),
+	}
+}
+
+func fromStoredMessage(msg *history.Message) *Message {
+	msgType := MsgTextMsgMT
+	if msg.Direct() {
+		msgType = MsgDirectMsgMT
+	}
+
+	var edited int64
+	if !msg.Edited().IsZero() {
+		edited = msg.Edited().UnixMilli()
+	}
+
+	var lastReply int64
+	if msg.LastReply != nil {
+		lastReply = msg.LastReply.UnixMilli()
+	}
+
+	return &Message{
+		MsgType:     msgType,
+		ID:          msg.ID,
+		ClientMsgID: msg.ClientMsgID,
+		Sequence:    msg.Sequence,
+		ParentID:    msg.ParentID,
+		ReplyCount:  msg.ReplyCount,
+		LastReply:   lastReply,
+		SenderName:  msg.SenderName,
+		Room:        msg.Room,
+		Recipient:   msg.Recipient,
+		Content:     msg.Content,
+		Time:        msg.Time.UnixMilli(),
+		Edited:      edited,
+		Deleted:     msg.Deleted,
+		Reactions:   fromStoredReactions(msg.Reactions),
+	}
+}
+
+func fromStoredReactions(reacts []history.Reaction) []*Reaction {
+	if len(reacts) == 0 {
+		return nil
+	}
+
+	reactions := make([]*Reaction, 0, len(reacts))
+	for _, react := range reacts {
+		reactions = append(reactions, &Reaction{
+			Emoji: react.Emoji,
+			Count: len(react.Users),
+			Users: react.Users,
+		})
+	}
+	return reactions
+}
+
+func fromStoredMessages(msgs []*history.Message) []*Message {
+	messages := make([]*Message, 0, len(msgs))
+	for _, msg := range msgs {
+		messages = append(messages, fromStoredMessage(msg))
+	}
+	return messages
+}
+
+func fromStoredConversations(userName string, convs []*history.Conversation) []*Conversation {
+	conversations := make([]*Conversation, 0, len(convs))
+	for _, conv := range convs {
+		conversations = append(conversations, &Conversation{
+			Peer:        conv.Peer(userName),
+			LastMessage: conv.LastMessage.UnixMilli(),
+		})
+	}
+	return conversations
+}
@@ -2,43 +2,131 @@ package exchange
 
 import (
 	"encoding/json"
+	"time"
 )
 
 const (
-	MsgUserJoinedRoomMT = "USER_JOINED_ROOM"
-	MsgUserLeftRoomMT   = "USER_LEFT_ROOM"
-	MsgLogoutMT         = "LOGOUT_USER"
-	MsgTextMsgMT        = "TEXT_MSG"
-	MsgCreateRoomMT     = "CREATE_ROOM"
-	MsgRemoveRoomMT     = "REMOVE_ROOM"
-	MsgRoomsNamesMT     = "ROOMS_LIST"
-	MsgErrorMsgMT       = "ERROR"
+	MsgUserJoinedRoomMT  = "USER_JOINED_ROOM"
+	MsgUserLeftRoomMT    = "USER_LEFT_ROOM"
+	MsgLogoutMT          = "LOGOUT_USER"
+	MsgTextMsgMT         = "TEXT_MSG"
+	MsgCreateRoomMT      = "CREATE_ROOM"
+	MsgRemoveRoomMT      = "REMOVE_ROOM"
+	MsgRoomsNamesMT      = "ROOMS_LIST"
+	MsgErrorMsgMT        = "ERROR"
+	MsgHistoryRequestMT  = "HISTORY_REQUEST"
+	MsgHistoryPageMT     = "HISTORY_PAGE"
+	MsgDirectMsgMT       = "DIRECT_MSG"
+	MsgConversationsMT   = "CONVERSATIONS_LIST"
+	MsgRoomMembersMT     = "ROOM_MEMBERS"
+	MsgTypingStartMT     = "TYPING_START"
+	MsgTypingStopMT      = "TYPING_STOP"
+	MsgAckMT             = "ACK"
+	MsgEditMsgMT         = "EDIT_MSG"
+	MsgDeleteMsgMT       = "DELETE_MSG"
+	MsgReactMT           = "REACT"
+	MsgUnreactMT         = "UNREACT"
+	MsgThreadRequestMT   = "THREAD_REQUEST"
+	MsgThreadPageMT      = "THREAD_PAGE"
+	MsgMarkReadMT        = "MARK_READ"
+	MsgKickUserMT        = "KICK_USER"
+	MsgBanUserMT         = "BAN_USER"
+	MsgMuteUserMT        = "MUTE_USER"
+	MsgAddModeratorMT    = "ADD_MODERATOR"
+	MsgRemoveModeratorMT = "REMOVE_MODERATOR"
+	MsgInviteMT          = "INVITE"
+	MsgInviteAcceptMT    = "INVITE_ACCEPT"
+	MsgInviteDeclineMT   = "INVITE_DECLINE"
+	MsgRoomUpdateMT      = "ROOM_UPDATE"
+	MsgRoomInfoMT        = "ROOM_INFO"
+	MsgCommandResultMT   = "COMMAND_RESULT"
+	MsgPingMT            = "PING"
+	MsgPongMT            = "PONG"
+	MsgResumeMT          = "RESUME"
+	MsgResyncMT          = "RESYNC"
+	MsgHelloMT           = "HELLO"
 
 	system = "system"
 )
 
 // Message represents ALL messages exchanged in the app. This may not be the
 // best idea, but in such small app maybe it won't be catastrophic. We will see.
+// Text message with ParentID is a reply in the thread of the parent message.
 type Message struct {
-	MsgType    string   `json:"msgType"`
-	SenderID   string   `json:"senderId"`
-	SenderName string   `json:"senderName"`
-	Rooms      []string `json:"rooms"`
-	Room       string   `json:"room"`
-	Content    string   `json:"content"`
+	MsgType        string           `json:"msgType,omitempty"`
+	RequestID      string           `json:"-"`
+	Version        int              `json:"version,omitempty"`
+	Features       []string         `json:"features,omitempty"`
+	ID             string           `json:"id,omitempty"`
+	ClientMsgID    string           `json:"clientMsgId,omitempty"`
+	Sequence       int64            `json:"seq,omitempty"`
+	ParentID       string           `json:"parentId,omitempty"`
+	ReplyCount     int              `json:"replyCount,omitempty"`
+	LastReply      int64            `json:"lastReply,omitempty"`
+	SenderID       string           `json:"senderId"`
+	SenderName     string           `json:"senderName"`
+	SenderNick     string           `json:"senderNick,omitempty"`
+	Rooms          []string         `json:"rooms"`
+	Unread         map[string]int64 `json:"unread,omitempty"`
+	Sequences      map[string]int64 `json:"sequences,omitempty"`
+	Room           string           `json:"room"`
+	Recipient      string           `json:"recipient,omitempty"`
+	Visibility     string           `json:"visibility,omitempty"`
+	Password       string           `json:"password,omitempty"`
+	Protected      []string         `json:"protected,omitempty"`
+	Persistent     bool             `json:"persistent,omitempty"`
+	NewName        string           `json:"newName,omitempty"`
+	PreviousRoom   string           `json:"previousRoom,omitempty"`
+	Topic          *string          `json:"topic,omitempty"`
+	Description    *string          `json:"description,omitempty"`
+	MaxMessageSize int              `json:"maxMessageSize,omitempty"`
+	Info           *RoomInfo        `json:"info,omitempty"`
+	Code           string           `json:"code,omitempty"`
+	Command        string           `json:"command,omitempty"`
+	Target         string           `json:"target,omitempty"`
+	Until          int64            `json:"until,omitempty"`
+	Content        string           `json:"content"`
+	Time           int64            `json:"time,omitempty"`
+	Edited         int64            `json:"edited,omitempty"`
+	Deleted        bool             `json:"deleted,omitempty"`
+	Emoji          string           `json:"emoji,omitempty"`
+	Reactions      []*Reaction      `json:"reactions,omitempty"`
+	Before         int64            `json:"before,omitempty"`
+	Limit          int              `json:"limit,omitempty"`
+	Members        []string         `json:"members,omitempty"`
+	Messages       []*Message       `json:"messages,omitempty"`
+	Conversations  []*Conversation  `json:"conversations,omitempty"`
 }
 
-// String returns string representation of Message struct.
+// Reaction describes all reactions to a message with the same emoji.
+type Reaction struct {
+	Emoji string   `json:"emoji"`
+	Count int      `json:"count"`
+	Users []string `json:"users"`
+}
+
+// Conversation describes direct messages exchanged with other user.
+type Conversation struct {
+	Peer        string `json:"peer"`
+	LastMessage int64  `json:"lastMessage"`
+}
+
+// String returns string representation of Message struct. Password is
+// omitted, as messages are logged.
 func (m *Message) String() string {
-	bts, _ := json.Marshal(m)
+	redacted := *m
+	redacted.Password = ""
+
+	bts, _ := json.Marshal(&redacted)
 	return string(bts)
 }
 
 // NewCreateRoomMessage returns message which can be used for creating new room.
-func NewCreateRoomMessage(roomName string) *Message {
+func NewCreateRoomMessage(roomName, visibility string) *Message {
 	return &Message{
 		MsgType:    MsgCreateRoomMT,
 		Room:       roomName,
+		Visibility: visibility,
 		SenderID:   system,
 		SenderName: system,
 	}
@@ -54,42 +142,304 @@ func NewRemoveRoomMessage(roomName string) *Message {
 	}
 }
 
-// RoomsNamesMessage returns message which contains names of all rooms.
-func RoomsNamesMessage(roomNames []string) *Message {
+// RoomsNamesMessage returns message which contains names of rooms, names of
+// password-protected rooms among them and numbers of unread messages in
+// these rooms (if they are known).
+func RoomsNamesMessage(roomNames, protected []string, unread map[string]int64) *Message {
 	return &Message{
 		MsgType:    MsgRoomsNamesMT,
 		SenderID:   system,
 		SenderName: system,
 		Rooms:      roomNames,
+		Protected:  protected,
+		Unread:     unread,
+	}
+}
+
+// NewCommandErrorMessage returns error message with given code sent as
+// a response to command with given name.
+func NewCommandErrorMessage(code, requestID, command, content string) *Message {
+	msg := ErrorMessage(code, requestID, content)
+	msg.Command = command
+	return msg
+}
+
+// NewCommandResultMessage returns message containing result of a command typed in given room.
+func NewCommandResultMessage(room, content string) *Message {
+	return &Message{
+		MsgType:    MsgCommandResultMT,
+		SenderID:   system,
+		SenderName: system,
+		Room:       room,
+		Content:    content,
 	}
 }
 
-// ErrorMessage returns error message.
-func ErrorMessage(content string) *Message {
+// NewPingMessage returns heartbeat message which client should answer with PONG.
+func NewPingMessage() *Message {
+	return &Message{
+		MsgType: MsgPingMT,
+	}
+}
+
+// NewResumeMessage returns message listing rooms restored after reconnection.
+func NewResumeMessage(rooms []string) *Message {
+	return &Message{
+		MsgType:    MsgResumeMT,
+		SenderID:   system,
+		SenderName: system,
+		Rooms:      rooms,
+	}
+}
+
+// NewResyncMessage returns message telling client to discard messages it has
+// in given room, because too many of them were missed. Latest messages follow.
+func NewResyncMessage(room string) *Message {
+	return &Message{
+		MsgType:    MsgResyncMT,
+		SenderID:   system,
+		SenderName: system,
+		Room:       room,
+	}
+}
+
+// ErrorMessage returns error message with given code sent as a response
+// to request with given identifier.
+func ErrorMessage(code, requestID, content string) *Message {
 	return &Message{
 		MsgType:    MsgErrorMsgMT,
+		RequestID:  requestID,
 		SenderID:   system,
 		SenderName: system,
+		Code:       code,
 		Content:    content,
 	}
 }
 
+// NewHelloMessage returns response to HELLO request with negotiated protocol version and features.
+func NewHelloMessage(requestID string, version int, features []string) *Message {
+	return &Message{
+		MsgType:    MsgHelloMT,
+		RequestID:  requestID,
+		SenderID:   system,
+		SenderName: system,
+		Version:    version,
+		Features:   features,
+	}
+}
+
 // NewUserJoinedRoomMessage returns  new UserJoinedRoomMessage message.
-func NewUserJoinedRoomMessage(room, senderID string) *Message {
+func NewUserJoinedRoomMessage(room, senderID, senderName string) *Message {
 	return &Message{
 		MsgType:    MsgUserJoinedRoomMT,
 		SenderID:   senderID,
-		SenderName: senderID,
+		SenderName: senderName,
 		Room:       room,
 	}
 }
 
 // NewUserLeftRoomMessage returns new UserLeftRoomMessage message.
-func NewUserLeftRoomMessage(room, senderID string) *Message {
+func NewUserLeftRoomMessage(room, senderID, senderName string) *Message {
 	return &Message{
 		MsgType:    MsgUserLeftRoomMT,
 		SenderID:   senderID,
-		SenderName: senderID,
+		SenderName: senderName,
+		Room:       room,
+	}
+}
+
+// NewRoomMembersMessage returns message containing names of users present in given room.
+func NewRoomMembersMessage(room string, members []string) *Message {
+	return &Message{
+		MsgType:    MsgRoomMembersMT,
+		SenderID:   system,
+		SenderName: system,
+		Room:       room,
+		Members:    members,
+	}
+}
+
+// NewHistoryPageMessage returns message containing page of messages sent in
+// given room. 'before' is a cursor which can be used to request older page.
+func NewHistoryPageMessage(room string, before int64, messages []*Message) *Message {
+	return &Message{
+		MsgType:    MsgHistoryPageMT,
+		SenderID:   system,
+		SenderName: system,
 		Room:       room,
+		Before:     before,
+		Messages:   messages,
+	}
+}
+
+// NewConversationsMessage returns message containing direct conversations of a user.
+func NewConversationsMessage(conversations []*Conversation) *Message {
+	return &Message{
+		MsgType:       MsgConversationsMT,
+		SenderID:      system,
+		SenderName:    system,
+		Conversations: conversations,
+	}
+}
+
+// NewTypingMessage returns message notifying that given user started or stopped typing in given room.
+func NewTypingMessage(msgType, room, senderID, senderName string) *Message {
+	return &Message{
+		MsgType:    msgType,
+		SenderID:   senderID,
+		SenderName: senderName,
+		Room:       room,
+	}
+}
+
+// Typing returns 'true' if message is a typing notification, 'false' otherwise.
+func (m *Message) Typing() bool {
+	return m.MsgType == MsgTypingStartMT || m.MsgType == MsgTypingStopMT
+}
+
+// NewAckMessage returns message confirming that given message has been accepted.
+func NewAckMessage(msg *Message) *Message {
+	return &Message{
+		MsgType:     MsgAckMT,
+		RequestID:   msg.RequestID,
+		SenderID:    system,
+		SenderName:  system,
+		ID:          msg.ID,
+		ClientMsgID: msg.ClientMsgID,
+		Sequence:    msg.Sequence,
+		Room:        msg.Room,
+		Recipient:   msg.Recipient,
+		Time:        msg.Time,
+	}
+}
+
+// NewMessageChangedMessage returns message notifying that given message
+// has been edited or deleted.
+func NewMessageChangedMessage(msgType string, msg *Message) *Message {
+	return &Message{
+		MsgType:    msgType,
+		ID:         msg.ID,
+		SenderID:   msg.SenderID,
+		SenderName: msg.SenderName,
+		Room:       msg.Room,
+		Recipient:  msg.Recipient,
+		Content:    msg.Content,
+		Sequence:   msg.Sequence,
+		ParentID:   msg.ParentID,
+		ReplyCount: msg.ReplyCount,
+		LastReply:  msg.LastReply,
+		Time:       msg.Time,
+		Edited:     msg.Edited,
+		Deleted:    msg.Deleted,
+		Reactions:  msg.Reactions,
+	}
+}
+
+// NewReactionMessage returns message notifying that given user added
+// or removed reaction to given message.
+func NewReactionMessage(msgType string, msg *Message, emoji, senderID, senderName string) *Message {
+	return &Message{
+		MsgType:    msgType,
+		ID:         msg.ID,
+		SenderID:   senderID,
+		SenderName: senderName,
+		Room:       msg.Room,
+		Recipient:  msg.Recipient,
+		Emoji:      emoji,
+	}
+}
+
+// NewThreadPageMessage returns message containing page of replies to given
+// message. 'before' is a cursor which can be used to request older page.
+func NewThreadPageMessage(parent *Message, before int64, replies []*Message) *Message {
+	return &Message{
+		MsgType:    MsgThreadPageMT,
+		SenderID:   system,
+		SenderName: system,
+		Room:       parent.Room,
+		ParentID:   parent.ID,
+		ReplyCount: parent.ReplyCount,
+		LastReply:  parent.LastReply,
+		Before:     before,
+		Messages:   replies,
+	}
+}
+
+// NewMarkReadMessage returns message notifying that messages in given room
+// up to given sequence number have been read.
+func NewMarkReadMessage(room string, sequence, unread int64) *Message {
+	return &Message{
+		MsgType:    MsgMarkReadMT,
+		SenderID:   system,
+		SenderName: system,
+		Room:       room,
+		Sequence:   sequence,
+		Unread:     map[string]int64{room: unread},
+	}
+}
+
+// NewModerationMessage returns message notifying that given moderation
+// action has been taken against given user in given room.
+func NewModerationMessage(action, room, target string, until time.Time, senderID, senderName string) *Message {
+	var untilMs int64
+	if !until.IsZero() {
+		untilMs = until.UnixMilli()
+	}
+
+	return &Message{
+		MsgType:    action,
+		SenderID:   senderID,
+		SenderName: senderName,
+		Room:       room,
+		Target:     target,
+		Until:      untilMs,
+	}
+}
+
+// Moderation returns 'true' if message is a moderation notification, 'false' otherwise.
+func (m *Message) Moderation() bool {
+	switch m.MsgType {
+	case MsgKickUserMT, MsgBanUserMT, MsgMuteUserMT, MsgAddModeratorMT, MsgRemoveModeratorMT:
+		return true
+	}
+	return false
+}
+
+// NewInvitationMessage returns message which invites given target user to
+// given room or notifies the target about accepted or declined invitation.
+func NewInvitationMessage(msgType, room, senderID, senderName, target string) *Message {
+	return &Message{
+		MsgType:    msgType,
+		SenderID:   senderID,
+		SenderName: senderName,
+		Room:       room,
+		Target:     target,
+	}
+}
+
+// RoomInfo is a struct containing settings and metadata of a room.
+type RoomInfo struct {
+	Name           string   `json:"name"`
+	Topic          string   `json:"topic"`
+	Description    string   `json:"description"`
+	Owner          string   `json:"owner"`
+	Moderators     []string `json:"moderators"`
+	CreatedBy      string   `json:"createdBy"`
+	CreatedAt      int64    `json:"createdAt"`
+	Visibility     string   `json:"visibility"`
+	Persistent     bool     `json:"persistent"`
+	MaxMessageSize int      `json:"maxMessageSize"`
+}
+
+// NewRoomInfoMessage returns message containing given room info. Previous
+// name of the room is set only if the room has been renamed.
+func NewRoomInfoMessage(info *RoomInfo, previousName string) *Message {
+	return &Message{
+		MsgType:      MsgRoomInfoMT,
+		SenderID:     system,
+		SenderName:   system,
+		Room:         info.Name,
+		PreviousRoom: previousName,
+		Info:         info,
 	}
 }
@@ -0,0 +1,181 @@
+package exchange
+
+import (
+	"expvar"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// ErrCodeInvalidPayload is a code of errors sent for messages with missing or invalid fields.
+const ErrCodeInvalidPayload = "INVALID_PAYLOAD"
+
+// handlerMetrics contains number of handled messages, number of errors and
+// total handling time in microseconds for every message type. Values are
+// published by expvar under 'handlers' key.
+var handlerMetrics = expvar.NewMap("handlers")
+
+// Middleware wraps handler with additional behavior.
+type Middleware func(next Handler) Handler
+
+// chain wraps given handler with given middlewares. The first middleware is the outermost one.
+func chain(handler Handler, middlewares []Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// LoggingMiddleware logs every message handled for given client together
+// with handling time and error.
+func LoggingMiddleware(client *Client) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(msg *Message) error {
+			start := time.Now()
+			err := next.Handle(msg)
+
+			entry := logger.WithFields(logger.Fields{
+				"msgType":  msg.MsgType,
+				"client":   client.ID(),
+				"user":     client.UserName(),
+				"room":     msg.Room,
+				"duration": time.Since(start),
+			})
+
+			if err != nil {
+				entry.WithError(err).Warn("Message handling failed")
+			} else {
+				entry.Info("Message handled")
+			}
+
+			return err
+		})
+	}
+}
+
+// RecoveryMiddleware recovers from panics in handlers, so they don't stop
+// receiving messages from given client, and informs the client about the failure.
+func RecoveryMiddleware(client *Client) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(msg *Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Errorf("Client: %v. Panic while handling message %v: %v\n%s", client, msg.MsgType, r, debug.Stack())
+					client.Send(ErrorMessage(ErrCodeInternal, msg.RequestID, "Internal error"))
+					err = fmt.Errorf("panic while handling message %v: %v", msg.MsgType, r)
+				}
+			}()
+
+			return next.Handle(msg)
+		})
+	}
+}
+
+// MetricsMiddleware records number of handled messages, number of errors
+// and handling time for every message type.
+func MetricsMiddleware() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(msg *Message) error {
+			start := time.Now()
+			err := next.Handle(msg)
+
+			key := metricsKey(msg.MsgType)
+			handlerMetrics.Add(key+".count", 1)
+			handlerMetrics.Add(key+".micros", time.Since(start).Microseconds())
+			if err != nil {
+				handlerMetrics.Add(key+".errors", 1)
+			}
+
+			return err
+		})
+	}
+}
+
+// metricsKey returns name under which metrics of messages of given type are
+// recorded. Types unknown to the server are recorded together, so clients
+// cannot create arbitrary number of metrics.
+func metricsKey(msgType string) string {
+	if _, known := payloads[msgType]; known || msgType == msgInvalidEnvelopeMT {
+		return msgType
+	}
+	return "unknown"
+}
+
+// ValidationMiddleware rejects messages without fields required by their
+// type and informs given client about it.
+func ValidationMiddleware(client *Client) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(msg *Message) error {
+			if err := validate(msg); err != nil {
+				client.Send(ErrorMessage(ErrCodeInvalidPayload, msg.RequestID, err.Error()))
+				return nil
+			}
+
+			return next.Handle(msg)
+		})
+	}
+}
+
+type field struct {
+	name  string
+	value func(msg *Message) string
+}
+
+var (
+	roomField      = field{"room", func(msg *Message) string { return msg.Room }}
+	contentField   = field{"content", func(msg *Message) string { return msg.Content }}
+	recipientField = field{"recipient", func(msg *Message) string { return msg.Recipient }}
+	idField        = field{"id", func(msg *Message) string { return msg.ID }}
+	parentIDField  = field{"parentId", func(msg *Message) string { return msg.ParentID }}
+	emojiField     = field{"emoji", func(msg *Message) string { return msg.Emoji }}
+	targetField    = field{"target", func(msg *Message) string { return msg.Target }}
+)
+
+// requiredFields maps message types to fields which cannot be empty.
+var requiredFields = map[string][]field{
+	MsgUserJoinedRoomMT:  {roomField},
+	MsgUserLeftRoomMT:    {roomField},
+	MsgCreateRoomMT:      {roomField},
+	MsgTextMsgMT:         {roomField, contentField},
+	MsgDirectMsgMT:       {recipientField, contentField},
+	MsgRoomMembersMT:     {roomField},
+	MsgTypingStartMT:     {roomField},
+	MsgTypingStopMT:      {roomField},
+	MsgEditMsgMT:         {idField, contentField},
+	MsgDeleteMsgMT:       {idField},
+	MsgReactMT:           {idField, emojiField},
+	MsgUnreactMT:         {idField, emojiField},
+	MsgThreadRequestMT:   {parentIDField},
+	MsgMarkReadMT:        {roomField},
+	MsgKickUserMT:        {roomField, targetField},
+	MsgBanUserMT:         {roomField, targetField},
+	MsgMuteUserMT:        {roomField, targetField},
+	MsgAddModeratorMT:    {roomField, targetField},
+	MsgRemoveModeratorMT: {roomField, targetField},
+	MsgInviteMT:          {roomField, targetField},
+	MsgInviteAcceptMT:    {roomField},
+	MsgInviteDeclineMT:   {roomField},
+	MsgRoomUpdateMT:      {roomField},
+}
+
+func validate(msg *Message) error {
+	for _, f := range requiredFields[msg.MsgType] {
+		if f.value(msg) == "" {
+			return fmt.Errorf("message %v requires field %v", msg.MsgType, f.name)
+		}
+	}
+
+	if msg.Limit < 0 || msg.Until < 0 || msg.MaxMessageSize < 0 || msg.Sequence < 0 || msg.Version < 0 {
+		return fmt.Errorf("message %v contains negative number", msg.MsgType)
+	}
+
+	for _, sequence := range msg.Sequences {
+		if sequence < 0 {
+			return fmt.Errorf("message %v contains negative sequence number", msg.MsgType)
+		}
+	}
+
+	return nil
+}
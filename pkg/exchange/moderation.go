@@ -0,0 +1,262 @@
+package exchange
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/adrian83/chat/pkg/room"
+)
+
+// restriction describes moderation restrictions imposed on a user in a room.
+// Zero time means that restriction never expires.
+type restriction struct {
+	banned      bool
+	bannedUntil time.Time
+	muted       bool
+	mutedUntil  time.Time
+}
+
+// newModeration returns moderation of a room described by given definition.
+func newModeration(def room.Definition) *moderation {
+	m := &moderation{
+		owner:      def.Owner,
+		moderators: make(map[string]bool),
+		bans:       fromRestrictions(def.Bans),
+		mutes:      fromRestrictions(def.Mutes),
+	}
+
+	for _, name := range def.Moderators {
+		m.moderators[name] = true
+	}
+
+	return m
+}
+
+func fromRestrictions(restrictions []room.Restriction) map[string]time.Time {
+	users := make(map[string]time.Time, len(restrictions))
+	for _, r := range restrictions {
+		var until time.Time
+		if r.Until != nil {
+			until = *r.Until
+		}
+		users[r.User] = until
+	}
+	return users
+}
+
+func toRestrictions(users map[string]time.Time) []room.Restriction {
+	restrictions := make([]room.Restriction, 0, len(users))
+	for name, until := range users {
+		restriction := room.Restriction{User: name}
+		if !until.IsZero() {
+			restriction.Until = &until
+		}
+		restrictions = append(restrictions, restriction)
+	}
+
+	sort.Slice(restrictions, func(i, j int) bool { return restrictions[i].User < restrictions[j].User })
+	return restrictions
+}
+
+// moderatorNames returns sorted names of moderators.
+func (m *moderation) moderatorNames() []string {
+	names := make([]string, 0, len(m.moderators))
+	for name := range m.moderators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// moderation keeps owner, moderators and restricted users of a room.
+// It is used only by the Rooms event loop.
+type moderation struct {
+	owner      string
+	moderators map[string]bool
+	bans       map[string]time.Time
+	mutes      map[string]time.Time
+}
+
+// canModerate returns 'true' if given actor is allowed to kick, ban or mute
+// given target. Owner can moderate everyone, moderators can moderate
+// everyone except the owner and other moderators.
+func (m *moderation) canModerate(actor, target string) bool {
+	if actor == "" || actor == target || target == m.owner {
+		return false
+	}
+
+	if actor == m.owner {
+		return true
+	}
+
+	return m.moderators[actor] && !m.moderators[target]
+}
+
+// privileged returns 'true' if user with given name is the owner or a moderator.
+func (m *moderation) privileged(userName string) bool {
+	return userName != "" && (userName == m.owner || m.moderators[userName])
+}
+
+func (m *moderation) restriction(userName string, now time.Time) restriction {
+	var r restriction
+
+	if until, ok := m.bans[userName]; ok {
+		if until.IsZero() || until.After(now) {
+			r.banned, r.bannedUntil = true, until
+		} else {
+			delete(m.bans, userName)
+		}
+	}
+
+	if until, ok := m.mutes[userName]; ok {
+		if until.IsZero() || until.After(now) {
+			r.muted, r.mutedUntil = true, until
+		} else {
+			delete(m.mutes, userName)
+		}
+	}
+
+	return r
+}
+
+type moderationRequest struct {
+	client    *Client
+	requestID string
+	action    string
+	room      string
+	target    string
+	until     time.Time
+}
+
+type restrictionRequest struct {
+	room   string
+	user   string
+	result chan restriction
+}
+
+// moderate executes given moderation request if the requesting client is allowed to.
+func (ch *Rooms) moderate(req moderationRequest) {
+	room, ok := ch.rooms[req.room]
+	if !ok {
+		req.client.Send(ErrorMessage(ErrCodeNotFound, req.requestID, fmt.Sprintf("Room %v doesn't exist", req.room)))
+		return
+	}
+
+	actor := req.client.UserName()
+	mod := room.moderation
+
+	switch req.action {
+	case MsgAddModeratorMT, MsgRemoveModeratorMT:
+		if actor != mod.owner || req.target == mod.owner {
+			req.client.Send(ErrorMessage(ErrCodeForbidden, req.requestID, "Only room owner can change moderators"))
+			return
+		}
+
+		mod.moderators[req.target] = req.action == MsgAddModeratorMT
+		if !mod.moderators[req.target] {
+			delete(mod.moderators, req.target)
+		}
+
+	case MsgKickUserMT, MsgBanUserMT, MsgMuteUserMT:
+		if !mod.canModerate(actor, req.target) {
+			req.client.Send(ErrorMessage(ErrCodeForbidden, req.requestID, fmt.Sprintf("You cannot moderate user %v in room %v", req.target, req.room)))
+			return
+		}
+
+		switch req.action {
+		case MsgBanUserMT:
+			mod.bans[req.target] = req.until
+			ch.removeUser(room, req.target)
+		case MsgMuteUserMT:
+			mod.mutes[req.target] = req.until
+		default:
+			ch.removeUser(room, req.target)
+		}
+
+	default:
+		req.client.Send(ErrorMessage(ErrCodeUnknownType, req.requestID, fmt.Sprintf("Unknown moderation action %v", req.action)))
+		return
+	}
+
+	ch.saveRoom(room)
+
+	// the room skips the target, who is notified once even if it is leaving the room
+	notification := NewModerationMessage(req.action, req.room, req.target, req.until, req.client.ID(), actor)
+	stamp(notification)
+	ch.sendToEveryone(req.room, notification)
+	ch.users.send(req.target, notification)
+
+	if req.action == MsgAddModeratorMT || req.action == MsgRemoveModeratorMT {
+		ch.publishRoomInfo(room, "")
+	}
+}
+
+// removeUser removes all clients of given user from given room.
+func (ch *Rooms) removeUser(room *Room, userName string) {
+	for _, client := range ch.users.clients(userName) {
+		if _, err := room.FindClient(client.ID()); err != nil {
+			continue
+		}
+
+		room.RemoveClient(client.ID())
+		client.Send(NewUserLeftRoomMessage(room.Name(), client.ID(), client.UserName()))
+	}
+}
+
+// restriction returns moderation restrictions of given user in room with given name.
+func (ch *Rooms) restriction(roomName, userName string) restriction {
+	room, ok := ch.rooms[roomName]
+	if !ok {
+		return restriction{}
+	}
+
+	return room.moderation.restriction(userName, time.Now())
+}
+
+// Moderate requests kick, ban, mute or change of moderators described by
+// given message on behalf of given client.
+func (ch *Rooms) Moderate(msg *Message, client *Client) {
+	var until time.Time
+	if msg.Until > 0 {
+		until = time.UnixMilli(msg.Until)
+	}
+
+	ch.moderationRequest <- moderationRequest{
+		client:    client,
+		requestID: msg.RequestID,
+		action:    msg.MsgType,
+		room:      msg.Room,
+		target:    msg.Target,
+		until:     until,
+	}
+}
+
+// Restriction returns moderation restrictions of given user in room with given name.
+func (ch *Rooms) Restriction(roomName, userName string) restriction {
+	result := make(chan restriction, 1)
+
+	ch.restrictionRequest <- restrictionRequest{
+		room:   roomName,
+		user:   userName,
+		result: result,
+	}
+
+	return <-result
+}
+
+// restrictionError returns description of given restriction or empty
+// string if user is not restricted.
+func restrictionError(r restriction, roomName string) string {
+	switch {
+	case r.banned && r.bannedUntil.IsZero():
+		return fmt.Sprintf("You are banned in room %v", roomName)
+	case r.banned:
+		return fmt.Sprintf("You are banned in room %v until %v", roomName, r.bannedUntil.Format(time.RFC3339))
+	case r.muted && r.mutedUntil.IsZero():
+		return fmt.Sprintf("You are muted in room %v", roomName)
+	case r.muted:
+		return fmt.Sprintf("You are muted in room %v until %v", roomName, r.mutedUntil.Format(time.RFC3339))
+	}
+	return ""
+}
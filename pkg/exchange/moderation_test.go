@@ -0,0 +1,108 @@
+package exchange
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModeration(t *testing.T) {
+	testData := []struct {
+		name   string
+		action string
+		actor  string
+		target string
+		member bool
+		denied bool
+	}{
+		{name: "owner kicks user", action: MsgKickUserMT, actor: testOwner, target: "mike", member: false},
+		{name: "owner bans user", action: MsgBanUserMT, actor: testOwner, target: "mike", member: false},
+		{name: "owner mutes user", action: MsgMuteUserMT, actor: testOwner, target: "mike", member: true},
+		{name: "user cannot kick owner", action: MsgKickUserMT, actor: "mike", target: testOwner, member: true, denied: true},
+		{name: "user cannot ban other user", action: MsgBanUserMT, actor: "mike", target: "anna", member: true, denied: true},
+	}
+
+	for _, data := range testData {
+		// given
+		rooms := newTestRooms(newMemoryStore())
+		clients := make(map[string]*Client)
+		conns := make(map[string]*recordingConn)
+		for _, name := range []string{testOwner, "mike", "anna"} {
+			clients[name], conns[name] = connect(t, rooms, name, NewRouter())
+			assert.NotNil(t, conns[name].received(MsgUserJoinedRoomMT, inRoom(MainRoomName())), data.name)
+		}
+
+		// when
+		rooms.Moderate(&Message{MsgType: data.action, RequestID: "moderate", Room: MainRoomName(), Target: data.target}, clients[data.actor])
+
+		// then
+		if data.denied {
+			assert.NotNil(t, conns[data.actor].received(MsgErrorMsgMT, withCode(ErrCodeForbidden)), data.name)
+			assert.Empty(t, conns[data.target].messages(data.action), data.name)
+		} else {
+			for name, conn := range conns {
+				assert.NotNil(t, conn.received(data.action, anyMessage), data.name)
+
+				// the target is notified directly and not by the room
+				conn := conn
+				assert.Never(t, func() bool { return len(conn.messages(data.action)) > 1 }, 100*time.Millisecond, testTick, name)
+			}
+		}
+
+		target := clients[data.target]
+		member := func() bool { return inMainRoom(rooms, target) == data.member }
+		assert.Eventually(t, member, testWaiting, testTick, data.name)
+	}
+}
+
+// testUsers is a user directory containing users with given names.
+type testUsers []string
+
+func (u testUsers) UserExists(name string) (bool, error) {
+	for _, user := range u {
+		if user == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func TestInvitation(t *testing.T) {
+	testData := []struct {
+		name     string
+		target   string
+		expected string
+	}{
+		{name: "known user is invited", target: "anna"},
+		{name: "unknown user is not invited", target: "ghost", expected: ErrCodeNotFound},
+		{name: "missing user is not invited", target: "", expected: ErrCodeInvalidPayload},
+		{name: "owner is not invited", target: testOwner, expected: ErrCodeConflict},
+	}
+
+	for _, data := range testData {
+		// given
+		rooms := newTestRooms(newMemoryStore())
+		owner, ownerConn := connect(t, rooms, testOwner, NewRouter())
+		rooms.CreateRoom("", "private", VisibilityPrivate, "", true, owner)
+		assert.NotNil(t, ownerConn.received(MsgUserJoinedRoomMT, inRoom("private")), data.name)
+
+		_, annaConn := connect(t, rooms, "anna", NewRouter())
+		assert.NotNil(t, annaConn.received(MsgUserJoinedRoomMT, inRoom(MainRoomName())), data.name)
+
+		handler := NewInvitationHandler(rooms, testUsers{testOwner, "anna"}, owner)
+
+		// when
+		err := handler.Handle(&Message{MsgType: MsgInviteMT, RequestID: "invite", Room: "private", Target: data.target})
+
+		// then
+		assert.NoError(t, err, data.name)
+		if data.expected != "" {
+			assert.NotNil(t, ownerConn.received(MsgErrorMsgMT, withCode(data.expected)), data.name)
+			assert.Empty(t, annaConn.messages(MsgInviteMT), data.name)
+			continue
+		}
+
+		assert.NotNil(t, annaConn.received(MsgInviteMT, inRoom("private")), data.name)
+	}
+}
@@ -0,0 +1,249 @@
+package exchange
+
+import (
+	"fmt"
+)
+
+// payload is a payload of a message sent by a client. Every type of such
+// messages has its own payload, which contains only fields used by the type.
+type payload interface {
+	// message returns message with fields of the payload.
+	message() *Message
+}
+
+// payloads maps types of messages sent by clients to constructors of their payloads.
+var payloads = map[string]func() payload{
+	MsgHelloMT:           func() payload { return &helloPayload{} },
+	MsgPongMT:            func() payload { return &emptyPayload{} },
+	MsgLogoutMT:          func() payload { return &emptyPayload{} },
+	MsgConversationsMT:   func() payload { return &emptyPayload{} },
+	MsgUserJoinedRoomMT:  func() payload { return &joinRoomPayload{} },
+	MsgUserLeftRoomMT:    func() payload { return &roomPayload{} },
+	MsgRoomMembersMT:     func() payload { return &roomPayload{} },
+	MsgTypingStartMT:     func() payload { return &roomPayload{} },
+	MsgTypingStopMT:      func() payload { return &roomPayload{} },
+	MsgInviteAcceptMT:    func() payload { return &roomPayload{} },
+	MsgInviteDeclineMT:   func() payload { return &roomPayload{} },
+	MsgCreateRoomMT:      func() payload { return &createRoomPayload{} },
+	MsgTextMsgMT:         func() payload { return &textPayload{} },
+	MsgDirectMsgMT:       func() payload { return &directPayload{} },
+	MsgHistoryRequestMT:  func() payload { return &historyPayload{} },
+	MsgThreadRequestMT:   func() payload { return &threadPayload{} },
+	MsgEditMsgMT:         func() payload { return &editPayload{} },
+	MsgDeleteMsgMT:       func() payload { return &deletePayload{} },
+	MsgReactMT:           func() payload { return &reactionPayload{} },
+	MsgUnreactMT:         func() payload { return &reactionPayload{} },
+	MsgMarkReadMT:        func() payload { return &markReadPayload{} },
+	MsgKickUserMT:        func() payload { return &targetPayload{} },
+	MsgAddModeratorMT:    func() payload { return &targetPayload{} },
+	MsgRemoveModeratorMT: func() payload { return &targetPayload{} },
+	MsgInviteMT:          func() payload { return &targetPayload{} },
+	MsgBanUserMT:         func() payload { return &restrictionPayload{} },
+	MsgMuteUserMT:        func() payload { return &restrictionPayload{} },
+	MsgRoomUpdateMT:      func() payload { return &roomUpdatePayload{} },
+	MsgResumeMT:          func() payload { return &resumePayload{} },
+}
+
+// readPayload sets payload of this envelope to the payload of its type decoded
+// with given function. If the payload cannot be decoded, the envelope is marked
+// as invalid. Payloads of unknown types are skipped, as the router rejects them.
+func (e *Envelope) readPayload(decode func(p payload) error) {
+	newPayload, known := payloads[e.Type]
+	if !known {
+		return
+	}
+
+	p := newPayload()
+	if err := decode(p); err != nil {
+		e.invalid = &ProtocolError{ErrCodeInvalidPayload, fmt.Sprintf("invalid payload of %v message: %v", e.Type, err)}
+		return
+	}
+
+	e.Payload = p.message()
+}
+
+// senderPayload contains fields which can be sent in every payload. They are
+// ignored, as the server knows the sender of every received message.
+type senderPayload struct {
+	SenderID   string `json:"senderId,omitempty"`
+	SenderName string `json:"senderName,omitempty"`
+}
+
+type emptyPayload struct {
+	senderPayload
+}
+
+func (p *emptyPayload) message() *Message {
+	return &Message{}
+}
+
+type helloPayload struct {
+	senderPayload
+	Version  int      `json:"version,omitempty"`
+	Features []string `json:"features,omitempty"`
+}
+
+func (p *helloPayload) message() *Message {
+	return &Message{Version: p.Version, Features: p.Features}
+}
+
+type roomPayload struct {
+	senderPayload
+	Room string `json:"room"`
+}
+
+func (p *roomPayload) message() *Message {
+	return &Message{Room: p.Room}
+}
+
+type joinRoomPayload struct {
+	senderPayload
+	Room     string `json:"room"`
+	Password string `json:"password,omitempty"`
+}
+
+func (p *joinRoomPayload) message() *Message {
+	return &Message{Room: p.Room, Password: p.Password}
+}
+
+type createRoomPayload struct {
+	senderPayload
+	Room       string `json:"room"`
+	Visibility string `json:"visibility,omitempty"`
+	Password   string `json:"password,omitempty"`
+	Persistent bool   `json:"persistent,omitempty"`
+}
+
+func (p *createRoomPayload) message() *Message {
+	return &Message{Room: p.Room, Visibility: p.Visibility, Password: p.Password, Persistent: p.Persistent}
+}
+
+type textPayload struct {
+	senderPayload
+	Room        string `json:"room"`
+	Content     string `json:"content"`
+	ClientMsgID string `json:"clientMsgId,omitempty"`
+	ParentID    string `json:"parentId,omitempty"`
+}
+
+func (p *textPayload) message() *Message {
+	return &Message{Room: p.Room, Content: p.Content, ClientMsgID: p.ClientMsgID, ParentID: p.ParentID}
+}
+
+type directPayload struct {
+	senderPayload
+	Recipient   string `json:"recipient"`
+	Content     string `json:"content"`
+	ClientMsgID string `json:"clientMsgId,omitempty"`
+}
+
+func (p *directPayload) message() *Message {
+	return &Message{Recipient: p.Recipient, Content: p.Content, ClientMsgID: p.ClientMsgID}
+}
+
+type historyPayload struct {
+	senderPayload
+	Room      string `json:"room,omitempty"`
+	Recipient string `json:"recipient,omitempty"`
+	Before    int64  `json:"before,omitempty"`
+	ID        string `json:"id,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+}
+
+func (p *historyPayload) message() *Message {
+	return &Message{Room: p.Room, Recipient: p.Recipient, Before: p.Before, ID: p.ID, Limit: p.Limit}
+}
+
+type threadPayload struct {
+	senderPayload
+	ParentID string `json:"parentId"`
+	Before   int64  `json:"before,omitempty"`
+	Limit    int    `json:"limit,omitempty"`
+}
+
+func (p *threadPayload) message() *Message {
+	return &Message{ParentID: p.ParentID, Before: p.Before, Limit: p.Limit}
+}
+
+type editPayload struct {
+	senderPayload
+	ID      string `json:"id"`
+	Content string `json:"content"`
+}
+
+func (p *editPayload) message() *Message {
+	return &Message{ID: p.ID, Content: p.Content}
+}
+
+type deletePayload struct {
+	senderPayload
+	ID string `json:"id"`
+}
+
+func (p *deletePayload) message() *Message {
+	return &Message{ID: p.ID}
+}
+
+type reactionPayload struct {
+	senderPayload
+	ID    string `json:"id"`
+	Emoji string `json:"emoji"`
+}
+
+func (p *reactionPayload) message() *Message {
+	return &Message{ID: p.ID, Emoji: p.Emoji}
+}
+
+type markReadPayload struct {
+	senderPayload
+	Room     string `json:"room"`
+	Sequence int64  `json:"seq"`
+}
+
+func (p *markReadPayload) message() *Message {
+	return &Message{Room: p.Room, Sequence: p.Sequence}
+}
+
+type targetPayload struct {
+	senderPayload
+	Room   string `json:"room"`
+	Target string `json:"target"`
+}
+
+func (p *targetPayload) message() *Message {
+	return &Message{Room: p.Room, Target: p.Target}
+}
+
+type restrictionPayload struct {
+	senderPayload
+	Room   string `json:"room"`
+	Target string `json:"target"`
+	Until  int64  `json:"until,omitempty"`
+}
+
+func (p *restrictionPayload) message() *Message {
+	return &Message{Room: p.Room, Target: p.Target, Until: p.Until}
+}
+
+type roomUpdatePayload struct {
+	senderPayload
+	Room           string  `json:"room"`
+	NewName        string  `json:"newName,omitempty"`
+	Topic          *string `json:"topic,omitempty"`
+	Description    *string `json:"description,omitempty"`
+	MaxMessageSize int     `json:"maxMessageSize,omitempty"`
+	Target         string  `json:"target,omitempty"`
+}
+
+func (p *roomUpdatePayload) message() *Message {
+	return &Message{Room: p.Room, NewName: p.NewName, Topic: p.Topic, Description: p.Description, MaxMessageSize: p.MaxMessageSize, Target: p.Target}
+}
+
+type resumePayload struct {
+	senderPayload
+	Sequences map[string]int64 `json:"sequences,omitempty"`
+}
+
+func (p *resumePayload) message() *Message {
+	return &Message{Sequences: p.Sequences}
+}
@@ -0,0 +1,4 @@
+// Package pb contains Protocol Buffers messages generated from envelope.proto.
+package pb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative envelope.proto
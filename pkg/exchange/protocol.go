@@ -0,0 +1,139 @@
+package exchange
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	// ProtocolVersion is the newest version of the protocol supported by the server.
+	ProtocolVersion = 1
+	// MinProtocolVersion is the oldest version of the protocol supported by the server.
+	MinProtocolVersion = 1
+)
+
+// Features which can be negotiated with HELLO message. Clients which don't
+// negotiate typing don't receive TYPING_START and TYPING_STOP messages.
+const FeatureTyping = "typing"
+
+// Features returns names of all features supported by the server.
+func Features() []string {
+	return []string{FeatureTyping}
+}
+
+// Codes of errors sent to clients.
+const (
+	ErrCodeUnknownType        = "UNKNOWN_TYPE"
+	ErrCodeUnsupportedVersion = "UNSUPPORTED_VERSION"
+	ErrCodeNotFound           = "NOT_FOUND"
+	ErrCodeForbidden          = "FORBIDDEN"
+	ErrCodeConflict           = "CONFLICT"
+	ErrCodeTooLarge           = "TOO_LARGE"
+	ErrCodeInternal           = "INTERNAL_ERROR"
+)
+
+// msgInvalidEnvelopeMT is a type under which envelopes that cannot be read
+// are passed through middlewares. It is never sent to clients.
+const msgInvalidEnvelopeMT = "INVALID_ENVELOPE"
+
+// Envelope is a frame exchanged with clients. Type describes which fields
+// of the payload are used and RequestID (chosen by client) is echoed in
+// responses to the request, including errors. Received payloads are decoded
+// into payloads of their types (see payloads), so they cannot contain fields
+// which are not used by their types.
+type Envelope struct {
+	Version   int      `json:"v"`
+	Type      string   `json:"type"`
+	RequestID string   `json:"requestId,omitempty"`
+	Payload   *Message `json:"payload,omitempty"`
+
+	// invalid is set if the envelope was received, but could not be read.
+	invalid *ProtocolError
+}
+
+// NewEnvelope returns envelope of given message sent to a client.
+func NewEnvelope(version int, msg *Message) *Envelope {
+	payload := *msg
+	payload.MsgType = ""
+	payload.RequestID = ""
+
+	return &Envelope{
+		Version:   version,
+		Type:      msg.MsgType,
+		RequestID: msg.RequestID,
+		Payload:   &payload,
+	}
+}
+
+// ProtocolError is an error of a received envelope, which is reported to the client with given code.
+type ProtocolError struct {
+	Code    string
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Message
+}
+
+// UnmarshalJSON decodes envelope sent by a client. Payload which doesn't
+// match the type of the envelope doesn't fail decoding, but marks the
+// envelope as invalid, so the client can be informed about it.
+func (e *Envelope) UnmarshalJSON(data []byte) error {
+	var received struct {
+		Version   int             `json:"v"`
+		Type      string          `json:"type"`
+		RequestID string          `json:"requestId"`
+		Payload   json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &received); err != nil {
+		return err
+	}
+
+	*e = Envelope{Version: received.Version, Type: received.Type, RequestID: received.RequestID}
+	e.readPayload(func(p payload) error {
+		if len(received.Payload) == 0 {
+			return nil
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(received.Payload))
+		dec.DisallowUnknownFields()
+		return dec.Decode(p)
+	})
+	return nil
+}
+
+// message returns message carried by this envelope. Envelope has to be
+// readable and in given protocol version (except HELLO, which negotiates the version).
+func (e *Envelope) message(version int) (*Message, *ProtocolError) {
+	if e.invalid != nil {
+		return nil, e.invalid
+	}
+
+	if e.Type != MsgHelloMT && e.Version != version {
+		return nil, &ProtocolError{ErrCodeUnsupportedVersion, fmt.Sprintf("protocol version %v is not supported, use version %v", e.Version, version)}
+	}
+
+	msg := e.Payload
+	if msg == nil {
+		msg = &Message{}
+	}
+
+	msg.MsgType = e.Type
+	msg.RequestID = e.RequestID
+	return msg, nil
+}
+
+// negotiateVersion returns the newest protocol version supported by both
+// server and client which supports versions up to given one.
+func negotiateVersion(version int) (int, error) {
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+
+	if version < MinProtocolVersion {
+		return 0, fmt.Errorf("protocol version %v is not supported, the oldest supported version is %v", version, MinProtocolVersion)
+	}
+
+	return version, nil
+}
@@ -0,0 +1,110 @@
+package exchange
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+)
+
+// SlowConsumerPolicy describes what happens when outbound queue of a client is full.
+type SlowConsumerPolicy string
+
+const (
+	// DropOldest policy removes the oldest queued message to make room for the new one.
+	DropOldest SlowConsumerPolicy = "drop-oldest"
+	// Disconnect policy discards queued messages, sends SLOW_CONSUMER error and disconnects the client.
+	Disconnect SlowConsumerPolicy = "disconnect"
+
+	// ErrCodeSlowConsumer is a code of errors sent to clients which don't receive messages fast enough.
+	ErrCodeSlowConsumer = "SLOW_CONSUMER"
+)
+
+// ParseSlowConsumerPolicy returns slow consumer policy with given name or
+// an error if there is no such policy.
+func ParseSlowConsumerPolicy(name string) (SlowConsumerPolicy, error) {
+	switch policy := SlowConsumerPolicy(name); policy {
+	case DropOldest, Disconnect:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown slow consumer policy %q, use %q or %q", name, DropOldest, Disconnect)
+}
+
+// deliveryMetrics contains number of messages dropped from outbound queues
+// and number of clients disconnected because they were too slow. Values are
+// published by expvar under 'delivery' key.
+var deliveryMetrics = expvar.NewMap("delivery")
+
+// newOutboundQueue returns new outboundQueue struct. Given function is
+// invoked when the queue overflows with Disconnect policy.
+func newOutboundQueue(size int, policy SlowConsumerPolicy, overflow func()) *outboundQueue {
+	return &outboundQueue{
+		size:     size,
+		policy:   policy,
+		ready:    make(chan struct{}, 1),
+		overflow: overflow,
+	}
+}
+
+// outboundQueue is a bounded queue of messages waiting to be sent to a client.
+// Pushing messages never blocks.
+type outboundQueue struct {
+	size     int
+	policy   SlowConsumerPolicy
+	lock     sync.Mutex
+	messages []*Message
+	// overflowed is set when the queue overflowed with Disconnect policy
+	overflowed bool
+	// ready receives a value when new messages are pushed
+	ready    chan struct{}
+	overflow func()
+}
+
+// push adds given message to the queue applying slow consumer policy if the queue is full.
+func (q *outboundQueue) push(msg *Message) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.overflowed {
+		deliveryMetrics.Add("dropped", 1)
+		return
+	}
+
+	if len(q.messages) >= q.size {
+		if q.policy == DropOldest {
+			q.messages[0] = nil
+			q.messages = q.messages[1:]
+			deliveryMetrics.Add("dropped", 1)
+		} else {
+			deliveryMetrics.Add("dropped", int64(len(q.messages))+1)
+			deliveryMetrics.Add("slowConsumers", 1)
+
+			q.overflowed = true
+			q.messages = []*Message{ErrorMessage(ErrCodeSlowConsumer, "", "You don't receive messages fast enough, disconnecting")}
+			q.notify()
+			// sending goroutine may be blocked by the slow connection, so it cannot disconnect the client
+			go q.overflow()
+			return
+		}
+	}
+
+	q.messages = append(q.messages, msg)
+	q.notify()
+}
+
+func (q *outboundQueue) notify() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// popAll removes and returns all queued messages. Returns 'true' if the
+// client should be disconnected after sending them.
+func (q *outboundQueue) popAll() ([]*Message, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	messages := q.messages
+	q.messages = nil
+	return messages, q.overflowed
+}
@@ -0,0 +1,200 @@
+package exchange
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/adrian83/chat/pkg/history"
+	"github.com/adrian83/chat/pkg/room"
+	logger "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	stressMessages  = 1000
+	stressClients   = 5
+	stressQueueSize = 64
+	stressBatch     = 16
+)
+
+type testUser string
+
+func (u testUser) Name() string {
+	return string(u)
+}
+
+// testStore is a message store which doesn't persist anything.
+type testStore struct {
+	messageStore
+}
+
+func (s *testStore) SaveMessage(msg history.Message) (*history.Message, error) {
+	return &msg, nil
+}
+
+func (s *testStore) LastMessages(string, int) ([]*history.Message, error) {
+	return nil, nil
+}
+
+func (s *testStore) LastSequence(string) (int64, error) {
+	return 0, nil
+}
+
+func (s *testStore) FindByClientMsgID(string, string) (*history.Message, error) {
+	return nil, nil
+}
+
+// testRoomStore is a room store which doesn't persist anything.
+type testRoomStore struct{}
+
+func (s *testRoomStore) SaveRoom(room.Definition) error     { return nil }
+func (s *testRoomStore) DeleteRoom(string) error            { return nil }
+func (s *testRoomStore) Rooms() ([]*room.Definition, error) { return nil, nil }
+
+// testConn is a connection which counts received text messages. Stalled
+// connection blocks on sending until it is closed.
+type testConn struct {
+	stalled  bool
+	texts    atomic.Int64
+	closed   chan struct{}
+	closeOne sync.Once
+}
+
+func newTestConn(stalled bool) *testConn {
+	return &testConn{stalled: stalled, closed: make(chan struct{})}
+}
+
+func (c *testConn) Send(envelope *Envelope) error {
+	if c.stalled {
+		<-c.closed
+		return errors.New("connection closed")
+	}
+
+	if envelope.Type == MsgTextMsgMT {
+		c.texts.Add(1)
+	}
+	return nil
+}
+
+func (c *testConn) Receive(*Envelope) error {
+	<-c.closed
+	return errors.New("connection closed")
+}
+
+func (c *testConn) Close() error {
+	c.closeOne.Do(func() { close(c.closed) })
+	return nil
+}
+
+func startTestClient(t *testing.T, rooms *Rooms, id string, conn *testConn, policy SlowConsumerPolicy) *Client {
+	client := NewClient(id, testUser(id), rooms, conn, NewRouter(), stressQueueSize, policy)
+	go client.Start()
+	t.Cleanup(func() { _ = conn.Close() })
+
+	rooms.AddClientToRoom("", MainRoomName(), "", client)
+	return client
+}
+
+func inMainRoom(rooms *Rooms, client *Client) bool {
+	_, err := rooms.rooms[MainRoomName()].FindClient(client.ID())
+	return err == nil
+}
+
+func runStressTest(t *testing.T, policy SlowConsumerPolicy) (*Rooms, *Client) {
+	logger.SetLevel(logger.WarnLevel)
+
+	rooms := NewRooms(&testStore{}, &testRoomStore{}, 0, 0, 4096, ResumeLimits{}, "")
+
+	stalled := startTestClient(t, rooms, "stalled", newTestConn(true), policy)
+
+	conns := make([]*testConn, 0, stressClients)
+	clients := make([]*Client, 0, stressClients)
+	for i := 0; i < stressClients; i++ {
+		conn := newTestConn(false)
+		conns = append(conns, conn)
+		clients = append(clients, startTestClient(t, rooms, fmt.Sprintf("fast-%v", i), conn, policy))
+	}
+
+	assert.Eventually(t, func() bool {
+		for _, client := range append(clients, stalled) {
+			if !inMainRoom(rooms, client) {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// messages are sent in batches smaller than the queue, so fast clients
+	// never overflow their queues, while the stalled one does
+	sender := clients[0]
+	for i := 0; i < stressMessages; i++ {
+		rooms.SendMessageOnRoom(&Message{
+			MsgType:     MsgTextMsgMT,
+			ClientMsgID: fmt.Sprintf("msg-%v", i),
+			SenderID:    sender.ID(),
+			SenderName:  sender.UserName(),
+			Room:        MainRoomName(),
+			Content:     fmt.Sprintf("message %v", i),
+		})
+
+		if sent := int64(i + 1); sent%stressBatch == 0 || sent == stressMessages {
+			for _, conn := range conns {
+				assert.Eventually(t, func() bool { return conn.texts.Load() == sent }, 5*time.Second, time.Millisecond)
+			}
+		}
+	}
+
+	return rooms, stalled
+}
+
+func TestStalledClientShouldBeDisconnectedWithoutBlockingOthers(t *testing.T) {
+	// given
+	slowConsumers := metricValue("slowConsumers")
+
+	// when
+	rooms, stalled := runStressTest(t, Disconnect)
+
+	// then
+	assert.Eventually(t, func() bool { return !inMainRoom(rooms, stalled) }, 5*time.Second, 10*time.Millisecond)
+	assert.Greater(t, metricValue("slowConsumers"), slowConsumers)
+}
+
+func TestStalledClientShouldLoseOldestMessagesWithoutBlockingOthers(t *testing.T) {
+	// given
+	dropped := metricValue("dropped")
+
+	// when
+	rooms, stalled := runStressTest(t, DropOldest)
+
+	// then
+	assert.True(t, inMainRoom(rooms, stalled))
+	assert.GreaterOrEqual(t, metricValue("dropped")-dropped, int64(stressMessages-stressQueueSize))
+}
+
+func TestParseSlowConsumerPolicy(t *testing.T) {
+	// given
+	names := []string{"drop-oldest", "disconnect", "", "drop-newest"}
+	expected := []SlowConsumerPolicy{DropOldest, Disconnect, "", ""}
+	valid := []bool{true, true, false, false}
+
+	for i, name := range names {
+		// when
+		policy, err := ParseSlowConsumerPolicy(name)
+
+		// then
+		assert.Equal(t, expected[i], policy, name)
+		assert.Equal(t, valid[i], err == nil, name)
+	}
+}
+
+func metricValue(name string) int64 {
+	value, ok := deliveryMetrics.Get(name).(interface{ Value() int64 })
+	if !ok {
+		return 0
+	}
+	return value.Value()
+}
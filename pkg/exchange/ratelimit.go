@@ -0,0 +1,275 @@
+package exchange
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	budgetText   = "text"
+	budgetCreate = "create"
+	budgetJoin   = "join"
+	budgetOther  = "other"
+
+	// ErrCodeRateLimited is a code of errors sent to clients exceeding rate limits.
+	ErrCodeRateLimited = "RATE_LIMITED"
+
+	// bucketsSweepInterval is a minimal interval between two removals of
+	// idle buckets of users.
+	bucketsSweepInterval = time.Minute
+)
+
+// budgets maps message types to rate limit budgets they use. Other
+// message types use 'other' budget.
+var budgets = map[string]string{
+	MsgTextMsgMT:        budgetText,
+	MsgDirectMsgMT:      budgetText,
+	MsgEditMsgMT:        budgetText,
+	MsgCreateRoomMT:     budgetCreate,
+	MsgUserJoinedRoomMT: budgetJoin,
+	MsgInviteAcceptMT:   budgetJoin,
+	MsgResumeMT:         budgetJoin,
+}
+
+// RateLimit describes token bucket refilled with 'PerSecond' tokens every
+// second and holding at most 'Burst' tokens.
+type RateLimit struct {
+	PerSecond float64
+	Burst     int
+}
+
+// RateLimits contains limits of messages sent by a single client. Limits of
+// all clients of a single user are 'UserMultiplier' times higher. Clients
+// exceeding limits are warned 'Warnings' times, then muted for 'MuteDuration'
+// and disconnected when they exceed limits after 'Mutes' mutes. Warnings and
+// mutes are forgotten when client doesn't exceed limits for 'QuietPeriod'.
+type RateLimits struct {
+	Text           RateLimit
+	Create         RateLimit
+	Join           RateLimit
+	Other          RateLimit
+	UserMultiplier float64
+	Warnings       int
+	MuteDuration   time.Duration
+	Mutes          int
+	QuietPeriod    time.Duration
+}
+
+func (l RateLimits) budget(name string) RateLimit {
+	switch name {
+	case budgetText:
+		return l.Text
+	case budgetCreate:
+		return l.Create
+	case budgetJoin:
+		return l.Join
+	}
+	return l.Other
+}
+
+func newTokenBucket(limit RateLimit, multiplier float64) *tokenBucket {
+	return &tokenBucket{
+		perSecond: limit.PerSecond * multiplier,
+		burst:     float64(limit.Burst) * multiplier,
+		tokens:    float64(limit.Burst) * multiplier,
+		updated:   time.Now(),
+	}
+}
+
+type tokenBucket struct {
+	perSecond float64
+	burst     float64
+	tokens    float64
+	updated   time.Time
+}
+
+// take removes single token from the bucket. Returns 'false' if the bucket is empty.
+func (b *tokenBucket) take(now time.Time) bool {
+	b.refill(now)
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.updated).Seconds() * b.perSecond
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.updated = now
+}
+
+// full returns 'true' if the bucket holds maximal number of tokens, so it
+// doesn't differ from a new one.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+type buckets map[string]*tokenBucket
+
+func (b buckets) take(budget string, limits RateLimits, multiplier float64, now time.Time) bool {
+	bucket, ok := b[budget]
+	if !ok {
+		bucket = newTokenBucket(limits.budget(budget), multiplier)
+		b[budget] = bucket
+	}
+	return bucket.take(now)
+}
+
+func (b buckets) full(now time.Time) bool {
+	for _, bucket := range b {
+		if !bucket.full(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewRateLimiter returns new RateLimiter struct enforcing given limits.
+func NewRateLimiter(limits RateLimits) *RateLimiter {
+	return &RateLimiter{
+		limits: limits,
+		users:  make(map[string]buckets),
+	}
+}
+
+// RateLimiter keeps token buckets shared by all clients of the same user.
+// Buckets of users which haven't sent messages long enough to refill them
+// are removed.
+type RateLimiter struct {
+	limits  RateLimits
+	lock    sync.Mutex
+	users   map[string]buckets
+	sweptAt time.Time
+}
+
+func (l *RateLimiter) takeUserToken(userName, budget string, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now.Sub(l.sweptAt) >= bucketsSweepInterval {
+		l.sweep(now)
+	}
+
+	userBuckets, ok := l.users[userName]
+	if !ok {
+		userBuckets = make(buckets)
+		l.users[userName] = userBuckets
+	}
+
+	return userBuckets.take(budget, l.limits, l.limits.UserMultiplier, now)
+}
+
+// sweep removes full buckets of users. It must be called with the lock held.
+func (l *RateLimiter) sweep(now time.Time) {
+	for userName, userBuckets := range l.users {
+		if userBuckets.full(now) {
+			delete(l.users, userName)
+		}
+	}
+	l.sweptAt = now
+}
+
+const (
+	penaltyWarning = iota
+	penaltyMute
+	penaltyDisconnect
+)
+
+// escalation tracks limit violations of a single client.
+type escalation struct {
+	violations int
+	mutes      int
+	mutedUntil time.Time
+	violatedAt time.Time
+}
+
+func (e *escalation) muted(now time.Time) bool {
+	return now.Before(e.mutedUntil)
+}
+
+// violate records violation of limits at given time and returns penalty
+// for it. Earlier violations are forgotten after 'QuietPeriod' without them.
+func (e *escalation) violate(limits RateLimits, now time.Time) int {
+	if limits.QuietPeriod > 0 && now.Sub(e.violatedAt) >= limits.QuietPeriod {
+		e.violations, e.mutes = 0, 0
+	}
+	e.violatedAt = now
+	e.violations++
+
+	switch {
+	case e.violations <= limits.Warnings:
+		return penaltyWarning
+
+	case e.mutes < limits.Mutes:
+		e.violations = 0
+		e.mutes++
+		e.mutedUntil = now.Add(limits.MuteDuration)
+		return penaltyMute
+	}
+
+	return penaltyDisconnect
+}
+
+// RateLimitMiddleware drops messages of given client exceeding limits of
+// given rate limiter. Client is warned with ERROR messages first, then it
+// is temporarily muted and finally disconnected. Requests of muted clients
+// are answered with ERROR messages containing end of the mute.
+func RateLimitMiddleware(limiter *RateLimiter, client *Client) Middleware {
+	// state of the client is used only by its receiving goroutine
+	clientBuckets := make(buckets)
+	var violations escalation
+
+	return func(next Handler) Handler {
+		return HandlerFunc(func(msg *Message) error {
+			if msg.MsgType == MsgLogoutMT {
+				return next.Handle(msg)
+			}
+
+			now := time.Now()
+			if violations.muted(now) {
+				// requests are answered, so clients don't wait for their results
+				if msg.RequestID != "" {
+					muted := ErrorMessage(ErrCodeRateLimited, msg.RequestID, fmt.Sprintf("You are sending too many messages, your messages are dropped until %v", violations.mutedUntil.Format(time.RFC3339)))
+					muted.Until = violations.mutedUntil.UnixMilli()
+					client.Send(muted)
+				}
+				return nil
+			}
+
+			budget, ok := budgets[msg.MsgType]
+			if !ok {
+				budget = budgetOther
+			}
+
+			if clientBuckets.take(budget, limiter.limits, 1, now) && limiter.takeUserToken(client.UserName(), budget, now) {
+				return next.Handle(msg)
+			}
+
+			handlerMetrics.Add("rateLimited", 1)
+
+			switch violations.violate(limiter.limits, now) {
+			case penaltyWarning:
+				client.Send(ErrorMessage(ErrCodeRateLimited, msg.RequestID, fmt.Sprintf("You are sending too many messages, slow down (warning %v of %v)", violations.violations, limiter.limits.Warnings)))
+
+			case penaltyMute:
+				client.Send(ErrorMessage(ErrCodeRateLimited, msg.RequestID, fmt.Sprintf("You are sending too many messages, your messages will be dropped for %v", limiter.limits.MuteDuration)))
+
+			default:
+				logger.Warnf("Client: %v. Disconnecting client exceeding rate limits", client)
+				client.Send(ErrorMessage(ErrCodeRateLimited, msg.RequestID, "You are sending too many messages, disconnecting"))
+				client.stop()
+			}
+
+			return fmt.Errorf("client %v exceeded rate limit of %v messages", client.ID(), budget)
+		})
+	}
+}
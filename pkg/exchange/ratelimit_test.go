@@ -0,0 +1,176 @@
+package exchange
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	start := time.Now()
+
+	testData := []struct {
+		name     string
+		limit    RateLimit
+		taken    int
+		elapsed  time.Duration
+		expected bool
+	}{
+		{name: "bucket is full", limit: RateLimit{PerSecond: 1, Burst: 2}, expected: true},
+		{name: "burst is used", limit: RateLimit{PerSecond: 1, Burst: 2}, taken: 2, expected: false},
+		{name: "token is refilled", limit: RateLimit{PerSecond: 1, Burst: 2}, taken: 2, elapsed: time.Second, expected: true},
+		{name: "token is partly refilled", limit: RateLimit{PerSecond: 1, Burst: 2}, taken: 2, elapsed: 500 * time.Millisecond, expected: false},
+		{name: "bucket isn't refilled", limit: RateLimit{PerSecond: 0, Burst: 1}, taken: 1, elapsed: time.Hour, expected: false},
+		{name: "empty bucket", limit: RateLimit{PerSecond: 10, Burst: 0}, expected: false},
+	}
+
+	for _, data := range testData {
+		// given
+		bucket := newTokenBucket(data.limit, 1)
+		bucket.updated = start
+		for i := 0; i < data.taken; i++ {
+			assert.True(t, bucket.take(start), data.name)
+		}
+
+		// when
+		taken := bucket.take(start.Add(data.elapsed))
+
+		// then
+		assert.Equal(t, data.expected, taken, data.name)
+	}
+}
+
+func TestTokenBucketBurstIsNotExceeded(t *testing.T) {
+	// given
+	start := time.Now()
+	bucket := newTokenBucket(RateLimit{PerSecond: 1, Burst: 2}, 1)
+	bucket.updated = start
+
+	// when
+	later := start.Add(time.Hour)
+	taken := []bool{bucket.take(later), bucket.take(later), bucket.take(later)}
+
+	// then
+	assert.Equal(t, []bool{true, true, false}, taken)
+}
+
+func TestEscalationOfViolations(t *testing.T) {
+	limits := RateLimits{Warnings: 2, Mutes: 1, MuteDuration: time.Second, QuietPeriod: time.Minute}
+
+	testData := []struct {
+		name      string
+		intervals []time.Duration
+		expected  []int
+	}{
+		{
+			name:      "client is warned, muted and disconnected",
+			intervals: []time.Duration{0, 0, 0, 0, 0, 0},
+			expected:  []int{penaltyWarning, penaltyWarning, penaltyMute, penaltyWarning, penaltyWarning, penaltyDisconnect},
+		},
+		{
+			name:      "warnings are forgotten after quiet period",
+			intervals: []time.Duration{0, 0, time.Minute, 0},
+			expected:  []int{penaltyWarning, penaltyWarning, penaltyWarning, penaltyWarning},
+		},
+		{
+			name:      "mutes are forgotten after quiet period",
+			intervals: []time.Duration{0, 0, 0, time.Minute, 0, 0},
+			expected:  []int{penaltyWarning, penaltyWarning, penaltyMute, penaltyWarning, penaltyWarning, penaltyMute},
+		},
+	}
+
+	for _, data := range testData {
+		// given
+		var e escalation
+		now := time.Now()
+		penalties := make([]int, 0, len(data.intervals))
+
+		// when
+		for _, interval := range data.intervals {
+			now = now.Add(interval)
+			penalties = append(penalties, e.violate(limits, now))
+		}
+
+		// then
+		assert.Equal(t, data.expected, penalties, data.name)
+	}
+}
+
+func TestEscalationMutesForMuteDuration(t *testing.T) {
+	// given
+	limits := RateLimits{Warnings: 0, Mutes: 1, MuteDuration: time.Second}
+	now := time.Now()
+	var e escalation
+
+	// when
+	penalty := e.violate(limits, now)
+
+	// then
+	assert.Equal(t, penaltyMute, penalty)
+	assert.True(t, e.muted(now.Add(time.Second-time.Millisecond)))
+	assert.False(t, e.muted(now.Add(time.Second)))
+}
+
+func TestRateLimiterRemovesIdleBuckets(t *testing.T) {
+	// given
+	limiter := NewRateLimiter(RateLimits{Other: RateLimit{PerSecond: 1, Burst: 1}, UserMultiplier: 1})
+	start := time.Now()
+
+	limiter.takeUserToken("anna", budgetOther, start)
+	limiter.takeUserToken("john", budgetOther, start.Add(bucketsSweepInterval-500*time.Millisecond))
+
+	// when
+	limiter.takeUserToken("mike", budgetOther, start.Add(bucketsSweepInterval))
+
+	// then
+	assert.NotContains(t, limiter.users, "anna")
+	assert.Contains(t, limiter.users, "john")
+	assert.Contains(t, limiter.users, "mike")
+}
+
+func TestRateLimitMiddlewareAnswersRequestsOfMutedClient(t *testing.T) {
+	testData := []struct {
+		name      string
+		requestID string
+		answered  bool
+	}{
+		{name: "request is answered with end of the mute", requestID: "request", answered: true},
+		{name: "message without request is dropped silently", requestID: "", answered: false},
+	}
+
+	for _, data := range testData {
+		// given
+		rooms := newTestRooms(newMemoryStore())
+		client, conn := connect(t, rooms, "anna", NewRouter())
+		assert.NotNil(t, conn.received(MsgUserJoinedRoomMT, inRoom(MainRoomName())), data.name)
+
+		limiter := NewRateLimiter(RateLimits{Other: RateLimit{PerSecond: 0, Burst: 1}, UserMultiplier: 1, Mutes: 1, MuteDuration: time.Minute})
+		handler := &recordingHandler{}
+		limited := RateLimitMiddleware(limiter, client)(handler)
+
+		_ = limited.Handle(&Message{MsgType: MsgPongMT})
+		_ = limited.Handle(&Message{MsgType: MsgPongMT, RequestID: "muting"})
+		assert.NotNil(t, conn.received(MsgErrorMsgMT, func(msg *Message) bool { return msg.RequestID == "muting" }), data.name)
+
+		// when
+		start := time.Now()
+		err := limited.Handle(&Message{MsgType: MsgPongMT, RequestID: data.requestID})
+
+		// then
+		assert.NoError(t, err, data.name)
+		assert.Len(t, handler.handled, 1, data.name)
+
+		answered := func(msg *Message) bool { return msg.RequestID == data.requestID }
+		if !data.answered {
+			assert.Never(t, func() bool { return findMessage(conn.messages(MsgErrorMsgMT), answered) != nil }, 100*time.Millisecond, testTick, data.name)
+			continue
+		}
+
+		muted := conn.received(MsgErrorMsgMT, answered)
+		if assert.NotNil(t, muted, data.name) {
+			assert.Equal(t, ErrCodeRateLimited, muted.Code, data.name)
+			assert.InDelta(t, start.Add(time.Minute).UnixMilli(), muted.Until, float64(time.Second.Milliseconds()), data.name)
+		}
+	}
+}
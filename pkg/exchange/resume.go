@@ -0,0 +1,143 @@
+package exchange
+
+import (
+	"sort"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// ResumeLimits defines which clients can resume their sessions after reconnection.
+type ResumeLimits struct {
+	// Window is a time during which user can return to rooms left because of disconnection.
+	Window time.Duration
+	// MaxMessages is the largest number of missed messages sent to resuming client.
+	// If more messages were missed, client is told to resync.
+	MaxMessages int
+}
+
+// departure records rooms user was in when its client disconnected.
+type departure struct {
+	rooms map[string]bool
+	at    time.Time
+}
+
+type resumeRequest struct {
+	client    *Client
+	sequences map[string]int64
+}
+
+// resumption is a request to add client to a room and send it messages
+// with sequence numbers greater than 'after'.
+type resumption struct {
+	client *Client
+	after  int64
+}
+
+// recordDeparture remembers rooms of given disconnecting client, so the user
+// can return to them within resume window.
+func (ch *Rooms) recordDeparture(client *Client) {
+	now := time.Now()
+	for user, dep := range ch.departures {
+		if now.Sub(dep.at) > ch.resumeLimits.Window {
+			delete(ch.departures, user)
+		}
+	}
+
+	dep, ok := ch.departures[client.UserName()]
+	if !ok {
+		dep = departure{rooms: make(map[string]bool)}
+	}
+
+	for _, name := range ch.clientRooms(client.ID()) {
+		dep.rooms[name] = true
+	}
+	dep.at = now
+
+	ch.departures[client.UserName()] = dep
+}
+
+// departed returns true if given user left given room because of
+// disconnection within resume window.
+func (ch *Rooms) departed(userName, roomName string) bool {
+	dep, ok := ch.departures[userName]
+	return ok && dep.rooms[roomName] && time.Since(dep.at) <= ch.resumeLimits.Window
+}
+
+// resume adds client to rooms it was in before reconnection. Rooms which
+// the user cannot enter anymore are skipped.
+func (ch *Rooms) resume(req resumeRequest) {
+	userName := req.client.UserName()
+	resumed := make([]string, 0, len(req.sequences))
+
+	for name, after := range req.sequences {
+		room, ok := ch.rooms[name]
+		if !ok {
+			continue
+		}
+
+		if !room.access.open(userName) && !ch.departed(userName, name) {
+			logger.Infof("Client %v cannot resume room %v", req.client, name)
+			continue
+		}
+
+		if ch.restriction(name, userName).banned {
+			continue
+		}
+
+		room.Resume(req.client, after)
+		resumed = append(resumed, name)
+	}
+
+	sort.Strings(resumed)
+
+	req.client.Send(ch.roomsList(userName))
+	req.client.Send(NewResumeMessage(resumed))
+
+	for _, name := range resumed {
+		req.client.Send(NewRoomInfoMessage(ch.rooms[name].info(), ""))
+	}
+}
+
+// Resume requests adding given client to rooms it was in before
+// reconnection. Sequences map names of rooms to numbers of the latest
+// messages the client has seen in them.
+func (ch *Rooms) Resume(sequences map[string]int64, client *Client) {
+	ch.resumeRequest <- resumeRequest{client: client, sequences: sequences}
+}
+
+// Resume adds given client to this room (if it isn't a member already) and
+// sends it messages with sequence number greater than 'after'.
+func (ch *Room) Resume(client *Client, after int64) {
+	ch.resumeChan <- resumption{client: client, after: after}
+}
+
+// catchUp sends given client messages it missed. If there is too many of them,
+// client is told to resync and gets latest messages as if it just entered the room.
+// Missed messages are counted by the storage worker, after the sequence number
+// of the room has been restored.
+func (ch *Room) catchUp(client *Client, after int64) {
+	ch.replay(client, func() []*Message {
+		missed := ch.LastSequence() - after
+		if after <= 0 || !ch.sequenceRestored.Load() || missed > int64(ch.rooms.resumeLimits.MaxMessages) {
+			return ch.resync()
+		}
+
+		if missed <= 0 {
+			return nil
+		}
+
+		messages, err := ch.rooms.store.MessagesAfter(ch.Name(), after, int(missed))
+		if err != nil {
+			logger.Warnf("Room: '%v'. Error while reading missed messages. Error: %v", ch.Name(), err)
+			return ch.resync()
+		}
+
+		return fromStoredMessages(messages)
+	})
+}
+
+// resync returns RESYNC message followed by latest messages sent in this room.
+func (ch *Room) resync() []*Message {
+	return append([]*Message{NewResyncMessage(ch.Name())}, ch.latestMessages()...)
+}
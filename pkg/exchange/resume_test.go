@@ -0,0 +1,71 @@
+package exchange
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/adrian83/chat/pkg/history"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumeCatchUp(t *testing.T) {
+	testData := []struct {
+		name     string
+		room     string
+		after    int64
+		resumed  []string
+		resync   bool
+		expected []int64
+	}{
+		{name: "missed messages are sent", room: MainRoomName(), after: 12, resumed: []string{MainRoomName()}, expected: []int64{13, 14, 15}},
+		{name: "nothing is sent to client up to date", room: MainRoomName(), after: 15, resumed: []string{MainRoomName()}},
+		{name: "client missing too many messages resyncs", room: MainRoomName(), after: 2, resumed: []string{MainRoomName()}, resync: true},
+		{name: "client without sequence resyncs", room: MainRoomName(), after: 0, resumed: []string{MainRoomName()}, resync: true},
+		{name: "unknown room is not resumed", room: "ghost", after: 12, resumed: []string{}},
+	}
+
+	for _, data := range testData {
+		// given
+		store := newMemoryStore()
+		for sequence := int64(1); sequence <= 15; sequence++ {
+			_, _ = store.SaveMessage(history.Message{Sequence: sequence, Room: MainRoomName(), SenderName: "mike", Content: fmt.Sprintf("message %v", sequence)})
+		}
+		rooms := newTestRooms(store)
+
+		conn := newRecordingConn()
+		client := NewClient(fmt.Sprintf("anna-%v", testClients.Add(1)), testUser("anna"), rooms, conn, NewRouter(), stressQueueSize, DropOldest)
+		go client.Start()
+		t.Cleanup(func() { _ = conn.Close() })
+		rooms.RegisterClient(client)
+
+		// when
+		rooms.Resume(map[string]int64{data.room: data.after}, client)
+
+		// then
+		resumed := conn.received(MsgResumeMT, anyMessage)
+		if assert.NotNil(t, resumed, data.name) {
+			assert.Equal(t, data.resumed, resumed.Rooms, data.name)
+		}
+
+		if data.resync {
+			assert.NotNil(t, conn.received(MsgResyncMT, inRoom(MainRoomName())), data.name)
+			latest := func(msg *Message) bool { return msg.Sequence == 15 }
+			assert.NotNil(t, conn.received(MsgTextMsgMT, latest), data.name)
+			continue
+		}
+
+		expected := func() bool { return len(conn.messages(MsgTextMsgMT)) == len(data.expected) }
+		assert.Eventually(t, expected, testWaiting, testTick, data.name)
+		assert.Never(t, func() bool { return !expected() }, 100*time.Millisecond, testTick, data.name)
+		assert.Empty(t, conn.messages(MsgResyncMT), data.name)
+
+		sequences := make([]int64, 0)
+		for _, msg := range conn.messages(MsgTextMsgMT) {
+			sequences = append(sequences, msg.Sequence)
+		}
+		if len(data.expected) > 0 {
+			assert.Equal(t, data.expected, sequences, data.name)
+		}
+	}
+}
@@ -2,6 +2,12 @@ package exchange
 
 import (
 	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/adrian83/chat/pkg/history"
+	"github.com/adrian83/chat/pkg/room"
 
 	logger "github.com/sirupsen/logrus"
 )
@@ -9,6 +15,13 @@ import (
 const (
 	// main is the name of the main room.
 	main = "main"
+
+	// sequenceAttempts is a number of attempts of reading the latest sequence
+	// number made when room starts. Sequence number is read again when a
+	// message is sent to the room if all of them fail.
+	sequenceAttempts = 3
+	// sequenceRetryDelay is a time between attempts of reading the latest sequence number.
+	sequenceRetryDelay = 200 * time.Millisecond
 )
 
 // MainRoomName returns name of the main room.
@@ -16,47 +29,96 @@ func MainRoomName() string {
 	return main
 }
 
-// NewRoom functions returns new Room struct.
-func NewRoom(name string, rooms *Rooms) *Room {
-	return &Room{
-		name:             name,
+// NewRoom functions returns new Room struct described by given definition.
+func NewRoom(def room.Definition, rooms *Rooms) *Room {
+	maxMessageSize := def.MaxMessageSize
+	if maxMessageSize <= 0 {
+		maxMessageSize = rooms.maxMessageSize
+	}
+
+	r := &Room{
+		moderation:       newModeration(def),
+		access:           newAccess(def),
+		persistent:       def.Persistent,
+		createdAt:        def.CreatedAt,
+		createdBy:        def.CreatedBy,
+		topic:            def.Topic,
+		description:      def.Description,
 		clients:          map[string]*Client{},
 		rooms:            rooms,
 		clientExists:     make(chan clientExist, 5),
 		removeClientChan: make(chan string, 5),
 		addClientChan:    make(chan *Client, 5),
+		resumeChan:       make(chan resumption, 5),
+		membersRequests:  make(chan *Client, 5),
+		emptyChecks:      make(chan chan bool, 5),
 		incomingMessages: make(chan *Message, 50),
 		interrupt:        make(chan bool, 5),
+		stopped:          make(chan struct{}),
+		storage:          make(chan func(), 50),
+		replays:          make(chan replay, 5),
+		checks:           make(chan checkedMessage, 5),
+		replaying:        make(map[string][]*Message),
+		accepted:         newAcceptedMessages(),
 	}
+	r.setName(def.Name)
+	r.maxMessageSize.Store(int64(maxMessageSize))
+
+	return r
 }
 
 // NewMainRoom returns new unremovable Room struct with name 'main'.
 func NewMainRoom(rooms *Rooms) *Room {
-	return NewRoom(main, rooms)
+	return NewRoom(room.Definition{Name: main, Owner: rooms.mainRoomOwner, Visibility: VisibilityPublic, Persistent: true}, rooms)
 }
 
 // Room represents chat room.
 type Room struct {
-	name             string
+	name             atomic.Pointer[string]
+	moderation       *moderation
+	access           *access
+	persistent       bool
+	createdAt        time.Time
+	createdBy        string
+	topic            string
+	description      string
+	maxMessageSize   atomic.Int64
+	restored         bool
 	clients          map[string]*Client
 	rooms            *Rooms
 	removeClientChan chan string
 	addClientChan    chan *Client
+	resumeChan       chan resumption
+	membersRequests  chan *Client
+	emptyChecks      chan chan bool
 	clientExists     chan clientExist
 	incomingMessages chan *Message
 	interrupt        chan bool
+	stopped          chan struct{}
+	storage          chan func()
+	replays          chan replay
+	replaying        map[string][]*Message
+	checks           chan checkedMessage
+	sequence         atomic.Int64
+	sequenceRestored atomic.Bool
+	accepted         *acceptedMessages
 }
 
 // FindClient returns client with given id if it exist in this room.
+// Stopped room contains no clients.
 func (ch *Room) FindClient(clientID string) (*Client, error) {
 	clientChan := make(chan *Client, 1)
 
-	ch.clientExists <- clientExist{
-		existChan: clientChan,
-		clientID:  clientID,
+	var client *Client
+	select {
+	case ch.clientExists <- clientExist{existChan: clientChan, clientID: clientID}:
+		select {
+		case client = <-clientChan:
+		case <-ch.stopped:
+		}
+	case <-ch.stopped:
 	}
 
-	client := <-clientChan
 	if client == nil {
 		return nil, fmt.Errorf("client with id %v cannot be found", clientID)
 	}
@@ -64,14 +126,48 @@ func (ch *Room) FindClient(clientID string) (*Client, error) {
 	return client, nil
 }
 
+// Empty returns 'true' if there are no clients in this room and no clients
+// are waiting for entering it. Stopped room is empty.
+func (ch *Room) Empty() bool {
+	result := make(chan bool, 1)
+
+	select {
+	case ch.emptyChecks <- result:
+	case <-ch.stopped:
+		return true
+	}
+
+	select {
+	case empty := <-result:
+		return empty
+	case <-ch.stopped:
+		return true
+	}
+}
+
+// Stop stops this room.
+func (ch *Room) Stop() {
+	ch.interrupt <- true
+}
+
 // Main returns true if this room is a main room.
 func (ch *Room) Main() bool {
-	return ch.name == main
+	return ch.Name() == main
+}
+
+// LastSequence returns sequence number of the latest message sent in this room.
+func (ch *Room) LastSequence() int64 {
+	return ch.sequence.Load()
+}
+
+// setName changes room's name.
+func (ch *Room) setName(name string) {
+	ch.name.Store(&name)
 }
 
 // Name returns room's name.
 func (ch *Room) Name() string {
-	return ch.name
+	return *ch.name.Load()
 }
 
 // SendToEveryone sends message to everyone in this room.
@@ -88,6 +184,11 @@ func (ch *Room) AddClient(client *Client) {
 	ch.addClientChan <- client
 }
 
+// SendMembers sends list of users present in this room to given client.
+func (ch *Room) SendMembers(client *Client) {
+	ch.membersRequests <- client
+}
+
 // RemoveClient removes client from this room.
 func (ch *Room) RemoveClient(clientID string) {
 	if ch == nil {
@@ -99,31 +200,122 @@ func (ch *Room) RemoveClient(clientID string) {
 
 // Start starts room. After invoking this method room can process sent messages.
 func (ch *Room) Start() {
+	go ch.runStorage()
+	ch.storage <- func() { ch.restoreSequence(sequenceAttempts) }
+
 	go func() {
+		// emptyTimeout fires when the room stayed empty for the grace period
+		var emptyTimer *time.Timer
+		var emptyTimeout <-chan time.Time
+
+		// restored rooms start empty, so they are removed like rooms left by their last client
+		if ch.restored && !ch.persistent {
+			emptyTimer = time.NewTimer(ch.rooms.emptyRoomGrace)
+			emptyTimeout = emptyTimer.C
+		}
+
 		for {
 			select {
 			case <-ch.interrupt:
+				close(ch.stopped)
+				close(ch.storage)
 				return
 
+			case r := <-ch.replays:
+				ch.finishReplay(r)
+
+			case c := <-ch.checks:
+				if ch.accept(c) {
+					ch.broadcast(c.msg)
+				}
+
+			case <-emptyTimeout:
+				emptyTimer, emptyTimeout = nil, nil
+				if len(ch.clients) == 0 {
+					ch.remove()
+				}
+
 			case clientID := <-ch.removeClientChan:
+				client, ok := ch.clients[clientID]
+				if !ok {
+					continue
+				}
+
 				delete(ch.clients, clientID)
+				delete(ch.replaying, clientID)
 
-				if len(ch.clients) == 0 {
-					logger.Infof("Room: '%v' is empty. Should be removed.", ch.Name())
-					ch.rooms.RemoveRoom(ch.Name())
-					ch.interrupt <- true
+				if len(ch.clients) == 0 && !ch.persistent {
+					if ch.rooms.emptyRoomGrace <= 0 {
+						ch.remove()
+						continue
+					}
+
+					logger.Infof("Room: '%v' is empty. Will be removed in %v.", ch.Name(), ch.rooms.emptyRoomGrace)
+					emptyTimer = time.NewTimer(ch.rooms.emptyRoomGrace)
+					emptyTimeout = emptyTimer.C
+				}
+
+				// user is still present as long as any of its clients is in the room
+				if ch.present(client.UserName()) {
+					continue
 				}
 
+				ch.broadcast(NewUserLeftRoomMessage(ch.Name(), client.ID(), client.UserName()))
+				ch.broadcast(NewRoomMembersMessage(ch.Name(), ch.members()))
+
 			case client := <-ch.addClientChan:
-				ch.clients[client.ID()] = client
+				if _, member := ch.clients[client.ID()]; member {
+					continue
+				}
+
+				if emptyTimer != nil {
+					emptyTimer.Stop()
+					emptyTimer, emptyTimeout = nil, nil
+				}
+
+				ch.join(client)
+				ch.replayHistory(client)
+				ch.broadcast(NewRoomMembersMessage(ch.Name(), ch.members()))
+
+			case r := <-ch.resumeChan:
+				if _, member := ch.clients[r.client.ID()]; member {
+					ch.catchUp(r.client, r.after)
+					continue
+				}
+
+				if emptyTimer != nil {
+					emptyTimer.Stop()
+					emptyTimer, emptyTimeout = nil, nil
+				}
+
+				ch.join(r.client)
+				ch.catchUp(r.client, r.after)
+				ch.broadcast(NewRoomMembersMessage(ch.Name(), ch.members()))
+
+			case client := <-ch.membersRequests:
+				client.Send(NewRoomMembersMessage(ch.Name(), ch.members()))
+
+			case result := <-ch.emptyChecks:
+				result <- len(ch.clients) == 0 && len(ch.addClientChan) == 0 && len(ch.resumeChan) == 0
 
 			case msg := <-ch.incomingMessages:
-				logger.Infof("Sending msg to %v room members.", len(ch.clients))
-				for _, client := range ch.clients {
-					logger.Infof("Sending msg to %v from room '%v'.", client, ch.name)
-					client.Send(msg)
+				if msg.Typing() {
+					ch.relayTyping(msg)
+					continue
+				}
+
+				if msg.Moderation() {
+					ch.relayModeration(msg)
+					continue
 				}
 
+				if msg.MsgType == MsgTextMsgMT {
+					ch.check(msg)
+					continue
+				}
+
+				ch.broadcast(msg)
+
 			case c := <-ch.clientExists:
 				c.existChan <- ch.clients[c.clientID]
 			}
@@ -131,6 +323,294 @@ func (ch *Room) Start() {
 	}()
 }
 
+// remove requests removal of this room. Rooms stop the room if it is still empty.
+func (ch *Room) remove() {
+	logger.Infof("Room: '%v' is empty. Should be removed.", ch.Name())
+	ch.rooms.RemoveRoom(ch)
+}
+
+// broadcast sends given message to all clients in this room.
+func (ch *Room) broadcast(msg *Message) {
+	stamp(msg)
+
+	logger.Infof("Sending msg to %v room members.", len(ch.clients))
+	for _, client := range ch.clients {
+		logger.Infof("Sending msg to %v from room '%v'.", client, ch.Name())
+		ch.deliver(client, msg)
+	}
+}
+
+// deliver sends given message to given client or holds it until messages
+// read from the store for the client are sent.
+func (ch *Room) deliver(client *Client, msg *Message) {
+	if held, waiting := ch.replaying[client.ID()]; waiting {
+		ch.replaying[client.ID()] = append(held, msg)
+		return
+	}
+
+	client.Send(msg)
+}
+
+// join adds given client to this room. Other members are notified only when
+// the first client of a user joins.
+func (ch *Room) join(client *Client) {
+	present := ch.present(client.UserName())
+	ch.clients[client.ID()] = client
+
+	joined := NewUserJoinedRoomMessage(ch.Name(), client.ID(), client.UserName())
+	if present {
+		stamp(joined)
+		client.Send(joined)
+		return
+	}
+
+	ch.broadcast(joined)
+}
+
+// present returns true if any client of given user is in this room.
+func (ch *Room) present(userName string) bool {
+	for _, client := range ch.clients {
+		if client.UserName() == userName {
+			return true
+		}
+	}
+	return false
+}
+
+// relayTyping sends given typing notification to all clients in this room
+// except clients of its sender. TYPING_START from clients outside this room
+// is dropped, while TYPING_STOP is relayed, as it is sent also when typing
+// of a client which has already left or disconnected expires.
+func (ch *Room) relayTyping(msg *Message) {
+	if _, ok := ch.clients[msg.SenderID]; !ok && msg.MsgType == MsgTypingStartMT {
+		return
+	}
+
+	for _, client := range ch.clients {
+		if client.UserName() != msg.SenderName && client.Supports(FeatureTyping) {
+			ch.deliver(client, msg)
+		}
+	}
+}
+
+// relayModeration sends given moderation notification to all clients in this
+// room except clients of its target, as they are notified directly.
+func (ch *Room) relayModeration(msg *Message) {
+	for _, client := range ch.clients {
+		if client.UserName() != msg.Target {
+			ch.deliver(client, msg)
+		}
+	}
+}
+
+// members returns sorted names of users present in this room.
+func (ch *Room) members() []string {
+	unique := make(map[string]bool)
+	for _, client := range ch.clients {
+		unique[client.UserName()] = true
+	}
+
+	names := make([]string, 0, len(unique))
+	for name := range unique {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// checkedMessage is a text message sent in a room with the message sent
+// earlier by the same sender with the same idempotency key (if there is any).
+type checkedMessage struct {
+	msg    *Message
+	stored *history.Message
+	err    error
+}
+
+// check schedules looking for a persisted message which given text message
+// is a retry of. Messages are accepted in the order they were sent, after
+// they are checked. Messages from clients who are not members of this room
+// and too long messages are rejected immediately.
+func (ch *Room) check(msg *Message) {
+	sender, ok := ch.clients[msg.SenderID]
+	if !ok {
+		logger.Infof("Room: '%v'. Dropping message from client %v who is not a member", ch.Name(), msg.SenderName)
+		return
+	}
+
+	if limit := ch.maxMessageSize.Load(); int64(len(msg.Content)) > limit {
+		sender.Send(ErrorMessage(ErrCodeTooLarge, msg.RequestID, fmt.Sprintf("Message is longer than %v bytes allowed in room %v", limit, ch.Name())))
+		return
+	}
+
+	// without the latest sequence number messages would get numbers of already persisted ones
+	if !ch.sequenceRestored.Load() {
+		ch.storage <- func() { ch.restoreSequence(1) }
+	}
+
+	ch.storage <- func() {
+		checked := checkedMessage{msg: msg}
+		if msg.ClientMsgID != "" {
+			checked.stored, checked.err = ch.rooms.store.FindByClientMsgID(msg.SenderName, msg.ClientMsgID)
+		}
+
+		select {
+		case ch.checks <- checked:
+		case <-ch.stopped:
+		}
+	}
+}
+
+// accept assigns identifier, time and next sequence number to given checked
+// text message, persists it and acknowledges it to the sender. Returns 'false'
+// if message shouldn't be delivered, because the sender has left this room,
+// it is a retry of already accepted one or the latest sequence number of
+// this room is unknown.
+func (ch *Room) accept(checked checkedMessage) bool {
+	msg := checked.msg
+
+	sender, ok := ch.clients[msg.SenderID]
+	if !ok {
+		logger.Infof("Room: '%v'. Dropping message from client %v who is not a member", ch.Name(), msg.SenderName)
+		return false
+	}
+
+	if checked.err != nil {
+		logger.Warnf("Room: '%v'. Error while looking for retried message. Error: %v", ch.Name(), checked.err)
+		sender.Send(ErrorMessage(ErrCodeInternal, msg.RequestID, fmt.Sprintf("Room %v cannot accept messages now, try again later", ch.Name())))
+		return false
+	}
+
+	if checked.stored != nil {
+		ack := NewAckMessage(fromStoredMessage(checked.stored))
+		ack.RequestID = msg.RequestID
+		sender.Send(ack)
+		return false
+	}
+
+	if ack, retried := ch.accepted.find(msg.SenderName, msg.ClientMsgID); retried {
+		reply := *ack
+		reply.RequestID = msg.RequestID
+		sender.Send(&reply)
+		return false
+	}
+
+	if !ch.sequenceRestored.Load() {
+		sender.Send(ErrorMessage(ErrCodeInternal, msg.RequestID, fmt.Sprintf("Room %v cannot accept messages now, try again later", ch.Name())))
+		return false
+	}
+
+	msg.Sequence = ch.sequence.Add(1)
+	msg.ID = ""
+	msg.Time = 0
+	stamp(msg)
+
+	ch.archive(msg)
+
+	ack := NewAckMessage(msg)
+	ch.accepted.add(msg.SenderName, msg.ClientMsgID, ack)
+	sender.Send(ack)
+
+	// request identifier concerns only the sender
+	msg.RequestID = ""
+
+	return true
+}
+
+// restoreSequence sets sequence number of this room to the number of the
+// latest persisted message, unless it is already set. Reading is attempted
+// given number of times. It is run by the storage worker, so the room
+// doesn't wait for the database.
+func (ch *Room) restoreSequence(attempts int) {
+	for attempt := 1; !ch.sequenceRestored.Load(); attempt++ {
+		sequence, err := ch.rooms.store.LastSequence(ch.Name())
+		if err == nil {
+			ch.sequence.Store(sequence)
+			ch.sequenceRestored.Store(true)
+			return
+		}
+
+		logger.Warnf("Room: '%v'. Error while reading last sequence number. Error: %v", ch.Name(), err)
+		if attempt == attempts {
+			return
+		}
+
+		time.Sleep(sequenceRetryDelay)
+	}
+}
+
+// runStorage runs jobs reading and writing messages of this room in the
+// order they were scheduled, so the room doesn't wait for the database and
+// messages are read only after all earlier messages have been written.
+func (ch *Room) runStorage() {
+	for job := range ch.storage {
+		job()
+	}
+}
+
+// archive schedules persisting of given message.
+func (ch *Room) archive(msg *Message) {
+	stored := toStoredMessage(msg)
+
+	ch.storage <- func() {
+		if _, err := ch.rooms.store.SaveMessage(stored); err != nil {
+			logger.Warnf("Room: '%v'. Error while storing message. Error: %v", ch.Name(), err)
+		}
+	}
+}
+
+type replay struct {
+	client   *Client
+	messages []*Message
+}
+
+// replay schedules sending messages returned by given function (which reads
+// them from the store) to given client. Messages sent in this room in the
+// meantime are held and delivered to the client after them.
+func (ch *Room) replay(client *Client, read func() []*Message) {
+	if _, waiting := ch.replaying[client.ID()]; waiting {
+		return
+	}
+	ch.replaying[client.ID()] = make([]*Message, 0)
+
+	ch.storage <- func() {
+		select {
+		case ch.replays <- replay{client: client, messages: read()}:
+		case <-ch.stopped:
+		}
+	}
+}
+
+// finishReplay sends given messages read from the store and messages held
+// in the meantime to the client waiting for them.
+func (ch *Room) finishReplay(r replay) {
+	held, waiting := ch.replaying[r.client.ID()]
+	if !waiting {
+		return
+	}
+	delete(ch.replaying, r.client.ID())
+
+	for _, msg := range append(r.messages, held...) {
+		r.client.Send(msg)
+	}
+}
+
+// replayHistory sends latest messages sent in this room to given client.
+func (ch *Room) replayHistory(client *Client) {
+	ch.replay(client, ch.latestMessages)
+}
+
+// latestMessages reads latest messages sent in this room from the store.
+func (ch *Room) latestMessages() []*Message {
+	messages, err := ch.rooms.store.LastMessages(ch.Name(), ch.rooms.historySize)
+	if err != nil {
+		logger.Warnf("Room: '%v'. Error while reading message history. Error: %v", ch.Name(), err)
+		return nil
+	}
+
+	return fromStoredMessages(messages)
+}
+
 type clientExist struct {
 	existChan chan *Client
 	clientID  string
@@ -1,7 +1,13 @@
 package exchange
 
 import (
+	"fmt"
 	"regexp"
+	"time"
+
+	"github.com/adrian83/chat/pkg/room"
+
+	"golang.org/x/crypto/bcrypt"
 
 	logger "github.com/sirupsen/logrus"
 )
@@ -11,17 +17,37 @@ var (
 	validRoomName  = regexp.MustCompile(roomNameRegexp)
 )
 
-// NewRooms returns new Rooms struct.
-func NewRooms() *Rooms {
+// NewRooms returns new Rooms struct. Messages sent in rooms are persisted
+// in given store and 'historySize' latest of them are replayed to every
+// client entering a room. Rooms persisted in given room store are restored
+// and non-persistent rooms are removed after staying empty for 'emptyRoomGrace'.
+// User named 'mainRoomOwner' moderates the main room.
+// Messages longer than 'maxMessageSize' bytes are rejected in rooms without
+// their own limit. Reconnecting clients resume their sessions within given limits.
+func NewRooms(store messageStore, roomStore roomStore, historySize int, emptyRoomGrace time.Duration, maxMessageSize int,
+	resumeLimits ResumeLimits, mainRoomOwner string) *Rooms {
 	ch := make(map[string]*Room)
 
 	roomsListRequests := make(chan *Client, 50)
 	removeClient := make(chan *Client, 50)
 	addClientToRoomRequest := make(chan clientAndRoom, 50)
 	removeClientFromRoomRequest := make(chan clientAndRoom, 50)
-	createRoomRequest := make(chan clientAndRoom, 50)
+	createRoomRequest := make(chan roomCreation, 50)
 	messageRequest := make(chan *Message, 50)
-	removeRoomRequests := make(chan string, 50)
+	removeRoomRequests := make(chan *Room, 50)
+	registerClient := make(chan clientMarkers, 50)
+	markReadRequest := make(chan readMarker, 50)
+	moderationRequest := make(chan moderationRequest, 50)
+	restrictionRequest := make(chan restrictionRequest, 50)
+	admissionRequest := make(chan admissionRequest, 50)
+	passwordHashRequest := make(chan passwordHashRequest, 50)
+	nickRequest := make(chan nickRequest, 50)
+	invitationRequest := make(chan invitationRequest, 50)
+	roomUpdateRequest := make(chan roomUpdateRequest, 50)
+	resumeRequest := make(chan resumeRequest, 50)
+	roomMembersRequest := make(chan clientAndRoom, 50)
+	directMessageRequest := make(chan *Message, 50)
+	messageLimitRequest := make(chan messageLimitRequest, 50)
 
 	rooms := Rooms{
 		rooms:                       ch,
@@ -32,41 +58,118 @@ func NewRooms() *Rooms {
 		messageRequest:              messageRequest,
 		removeRoomRequests:          removeRoomRequests,
 		removeClient:                removeClient,
+		registerClient:              registerClient,
+		markReadRequest:             markReadRequest,
+		moderationRequest:           moderationRequest,
+		restrictionRequest:          restrictionRequest,
+		admissionRequest:            admissionRequest,
+		passwordHashRequest:         passwordHashRequest,
+		nickRequest:                 nickRequest,
+		invitationRequest:           invitationRequest,
+		roomUpdateRequest:           roomUpdateRequest,
+		resumeRequest:               resumeRequest,
+		markers:                     make(map[string]map[string]int64),
+		roomMembersRequest:          roomMembersRequest,
+		directMessageRequest:        directMessageRequest,
+		messageLimitRequest:         messageLimitRequest,
+		users:                       make(usersMap),
+		store:                       store,
+		historySize:                 historySize,
+		roomStore:                   roomStore,
+		roomChanges:                 make(chan roomChange, 50),
+		emptyRoomGrace:              emptyRoomGrace,
+		maxMessageSize:              maxMessageSize,
+		resumeLimits:                resumeLimits,
+		mainRoomOwner:               mainRoomOwner,
+		departures:                  make(map[string]departure),
 	}
 	mainRoom := NewMainRoom(&rooms)
 	mainRoom.Start()
 	ch[mainRoom.Name()] = mainRoom
 
+	rooms.restoreRooms()
+
+	go rooms.persistRooms()
 	go rooms.start()
 
 	return &rooms
 }
 
 type clientAndRoom struct {
+	client        *Client
+	requestID     string
+	room          string
+	passwordValid bool
+}
+
+type roomCreation struct {
+	client       *Client
+	requestID    string
+	room         string
+	visibility   string
+	passwordHash []byte
+	persistent   bool
+}
+
+type clientMarkers struct {
+	client  *Client
+	markers map[string]int64
+}
+
+type readMarker struct {
+	client   *Client
+	room     string
+	sequence int64
+	result   chan int64
+}
+
+type nickRequest struct {
 	client *Client
+	nick   string
+	result chan bool
+}
+
+type messageLimitRequest struct {
 	room   string
+	result chan int
 }
 
 type RoomsMap map[string]*Room
 
-func (r RoomsMap) names() []string {
-	names := make([]string, 0)
-	for name := range r {
-		names = append(names, name)
-	}
-	return names
-}
-
 // Rooms struct represents collections of all rooms.
 type Rooms struct {
 	rooms                       RoomsMap
 	roomsListRequests           chan *Client
 	removeClient                chan *Client
-	removeRoomRequests          chan string
+	removeRoomRequests          chan *Room
 	addClientToRoomRequest      chan clientAndRoom
 	removeClientFromRoomRequest chan clientAndRoom
-	createRoomRequest           chan clientAndRoom
+	createRoomRequest           chan roomCreation
 	messageRequest              chan *Message
+	registerClient              chan clientMarkers
+	markReadRequest             chan readMarker
+	moderationRequest           chan moderationRequest
+	restrictionRequest          chan restrictionRequest
+	admissionRequest            chan admissionRequest
+	passwordHashRequest         chan passwordHashRequest
+	nickRequest                 chan nickRequest
+	invitationRequest           chan invitationRequest
+	roomUpdateRequest           chan roomUpdateRequest
+	resumeRequest               chan resumeRequest
+	markers                     map[string]map[string]int64
+	roomMembersRequest          chan clientAndRoom
+	directMessageRequest        chan *Message
+	messageLimitRequest         chan messageLimitRequest
+	users                       usersMap
+	store                       messageStore
+	historySize                 int
+	roomStore                   roomStore
+	roomChanges                 chan roomChange
+	emptyRoomGrace              time.Duration
+	maxMessageSize              int
+	resumeLimits                ResumeLimits
+	departures                  map[string]departure
+	mainRoomOwner               string
 }
 
 func (ch *Rooms) start() {
@@ -76,44 +179,56 @@ func (ch *Rooms) start() {
 		select {
 		case client := <-ch.roomsListRequests:
 			rooms := ch.clientRooms(client.ID())
-			msg := RoomsNamesMessage(rooms)
+			msg := RoomsNamesMessage(rooms, ch.protectedRooms(rooms), ch.unread(client.UserName(), rooms))
 			client.Send(msg)
 
 		case cac := <-ch.addClientToRoomRequest:
-			roomS := ch.rooms[cac.room]
-			roomS.AddClient(cac.client)
-
-			names := ch.rooms.names()
-			roomNamesMsg := RoomsNamesMessage(names)
-			cac.client.Send(roomNamesMsg)
-
-			ujc := NewUserJoinedRoomMessage(cac.room, cac.client.ID())
-			cac.client.Send(ujc)
+			roomS, ok := ch.rooms[cac.room]
+			if !ok {
+				cac.client.Send(ErrorMessage(ErrCodeNotFound, cac.requestID, fmt.Sprintf("Room %v doesn't exist", cac.room)))
+				continue
+			}
 
-		case roomName := <-ch.removeRoomRequests:
+			if r := roomS.moderation.restriction(cac.client.UserName(), time.Now()); r.banned {
+				cac.client.Send(ErrorMessage(ErrCodeForbidden, cac.requestID, restrictionError(r, cac.room)))
+				continue
+			}
 
-			if roomName == MainRoomName() {
-				logger.Info("Cannot remove 'main' room")
+			if !roomS.admits(cac.client.UserName(), cac.passwordValid) {
+				cac.client.Send(ErrorMessage(ErrCodeForbidden, cac.requestID, fmt.Sprintf("You are not allowed to enter room %v", cac.room)))
 				continue
 			}
 
-			delete(ch.rooms, roomName)
-			msg := NewRemoveRoomMessage(roomName)
-			ch.sendToEveryone(MainRoomName(), msg)
+			for _, client := range ch.users.connections(cac.client) {
+				if _, err := roomS.FindClient(client.ID()); err == nil {
+					continue
+				}
+				ch.enter(roomS, client)
+			}
+
+		case room := <-ch.removeRoomRequests:
+			ch.removeRoom(room)
 
 		case cac := <-ch.removeClientFromRoomRequest:
 			logger.Infof("Remove client '%v' from room '%v'", cac.client, cac.room)
 
-			room := ch.rooms[cac.room]
-			room.RemoveClient(cac.client.ID())
-			ujc := NewUserLeftRoomMessage(cac.room, cac.client.ID())
-			cac.client.Send(ujc)
+			if room, ok := ch.rooms[cac.room]; ok {
+				ch.removeUser(room, cac.client.UserName())
+			}
+
+		case cac := <-ch.roomMembersRequest:
+			if !ch.admitted(cac.room, cac.client.UserName()) {
+				cac.client.Send(ErrorMessage(ErrCodeForbidden, cac.requestID, fmt.Sprintf("You are not allowed to see members of room %v", cac.room)))
+				continue
+			}
+
+			ch.rooms[cac.room].SendMembers(cac.client)
 
 		case cac := <-ch.createRoomRequest:
 			logger.Infof("Create room request from %v. Room name: %v", cac.client, cac.room)
 
 			if !ch.roomNameValid(cac.room) {
-				cac.client.Send(ErrorMessage("Invalid room name"))
+				cac.client.Send(ErrorMessage(ErrCodeInvalidPayload, cac.requestID, "Invalid room name"))
 				continue
 			}
 
@@ -124,23 +239,103 @@ func (ch *Rooms) start() {
 			}
 
 			// create new room with given name
-			newRoom := NewRoom(cac.room, ch)
+			newRoom := NewRoom(room.Definition{
+				Name:         cac.room,
+				Owner:        cac.client.UserName(),
+				Visibility:   cac.visibility,
+				PasswordHash: cac.passwordHash,
+				Persistent:   cac.persistent,
+				CreatedBy:    cac.client.UserName(),
+				CreatedAt:    time.Now().UTC(),
+			}, ch)
 			newRoom.Start()
-			newRoom.AddClient(cac.client)
+			for _, client := range ch.users.connections(cac.client) {
+				newRoom.AddClient(client)
+			}
 			// add room to rooms' collection
 			ch.rooms[cac.room] = newRoom
+			ch.saveRoom(newRoom)
 
-			ncm := NewCreateRoomMessage(cac.room)
+			ncm := NewCreateRoomMessage(cac.room, cac.visibility)
+			if newRoom.access.private() {
+				ch.users.send(cac.client.UserName(), ncm)
+				continue
+			}
 			ch.sendToEveryone(MainRoomName(), ncm)
 
-			ujc := NewUserJoinedRoomMessage(cac.room, cac.client.ID())
-			cac.client.Send(ujc)
+		case cm := <-ch.registerClient:
+			// new connection enters rooms the user is already in through other connections
+			for _, name := range ch.userRooms(cm.client.UserName()) {
+				ch.enter(ch.rooms[name], cm.client)
+			}
+
+			ch.users.add(cm.client)
+
+			if _, known := ch.markers[cm.client.UserName()]; !known {
+				ch.markers[cm.client.UserName()] = cm.markers
+			}
+
+			cm.client.Send(ch.roomsList(cm.client.UserName()))
+
+		case rm := <-ch.markReadRequest:
+			rm.result <- ch.markRead(rm)
+
+		case req := <-ch.moderationRequest:
+			ch.moderate(req)
+
+		case req := <-ch.roomUpdateRequest:
+			ch.updateRoom(req)
+
+		case req := <-ch.invitationRequest:
+			ch.invite(req)
+
+		case req := <-ch.resumeRequest:
+			ch.resume(req)
+
+		case req := <-ch.restrictionRequest:
+			req.result <- ch.restriction(req.room, req.user)
+
+		case req := <-ch.admissionRequest:
+			req.result <- ch.admitted(req.room, req.user)
+
+		case req := <-ch.messageLimitRequest:
+			if room, ok := ch.rooms[req.room]; ok {
+				req.result <- int(room.maxMessageSize.Load())
+				continue
+			}
+			req.result <- ch.maxMessageSize
+
+		case req := <-ch.passwordHashRequest:
+			req.result <- ch.passwordHash(req.room)
+
+		case req := <-ch.nickRequest:
+			if req.nick != "" && ch.users.nickTaken(req.nick, req.client.UserName()) {
+				req.result <- false
+				continue
+			}
+
+			ch.users.setNick(req.client, req.nick)
+			req.result <- true
 
 		case client := <-ch.removeClient:
+			ch.recordDeparture(client)
+			ch.users.remove(client)
+
+			if _, online := ch.users[client.UserName()]; !online {
+				delete(ch.markers, client.UserName())
+			}
+
 			for _, room := range ch.rooms {
 				room.RemoveClient(client.ID())
 			}
 
+		case msg := <-ch.directMessageRequest:
+			logger.Infof("Send direct message from %v to %v", msg.SenderName, msg.Recipient)
+			ch.users.send(msg.Recipient, msg)
+			if msg.Recipient != msg.SenderName {
+				ch.users.send(msg.SenderName, msg)
+			}
+
 		case msg := <-ch.messageRequest:
 			logger.Infof("Send message: %v", msg)
 			ch.sendToEveryone(msg.Room, msg)
@@ -148,6 +343,45 @@ func (ch *Rooms) start() {
 	}
 }
 
+// removeRoom removes and stops given room unless it is persistent, it has
+// been replaced by other room with the same name or it isn't empty anymore.
+// Name of a room changes only in this loop, so it is current here.
+func (ch *Rooms) removeRoom(room *Room) {
+	name := room.Name()
+	if room.persistent || ch.rooms[name] != room || !room.Empty() {
+		logger.Infof("Room %v is not removed", name)
+		return
+	}
+
+	delete(ch.rooms, name)
+	room.Stop()
+	ch.deleteRoom(name)
+	ch.sendToEveryone(MainRoomName(), NewRemoveRoomMessage(name))
+}
+
+// enter adds given client to given room and sends it list of rooms and room info.
+func (ch *Rooms) enter(room *Room, client *Client) {
+	room.AddClient(client)
+	client.Send(ch.roomsList(client.UserName()))
+	client.Send(NewRoomInfoMessage(room.info(), ""))
+}
+
+// userRooms returns names of rooms in which given user has at least one client.
+func (ch *Rooms) userRooms(userName string) []string {
+	unique := make(map[string]bool)
+	for id := range ch.users.clients(userName) {
+		for _, name := range ch.clientRooms(id) {
+			unique[name] = true
+		}
+	}
+
+	names := make([]string, 0, len(unique))
+	for name := range unique {
+		names = append(names, name)
+	}
+	return names
+}
+
 func (ch *Rooms) roomNameValid(name string) bool {
 	if name == "" {
 		logger.Info("invalid room name, name cannot be empty")
@@ -156,6 +390,7 @@ func (ch *Rooms) roomNameValid(name string) bool {
 
 	if !validRoomName.MatchString(name) {
 		logger.Infof("invalid room name, name must match %v", roomNameRegexp)
+		return false
 	}
 
 	return true
@@ -170,6 +405,53 @@ func (ch *Rooms) sendToEveryone(roomName string, msg *Message) {
 	}
 }
 
+// markRead moves read marker described by given request forward. Returns
+// sequence number the marker has been moved to or zero if it hasn't moved.
+func (ch *Rooms) markRead(rm readMarker) int64 {
+	room, ok := ch.rooms[rm.room]
+	if !ok {
+		return 0
+	}
+
+	markers, known := ch.markers[rm.client.UserName()]
+	sequence := min(rm.sequence, room.LastSequence())
+	if !known || markers[rm.room] >= sequence {
+		return 0
+	}
+
+	markers[rm.room] = sequence
+
+	unread := ch.unread(rm.client.UserName(), []string{rm.room})
+	ch.users.send(rm.client.UserName(), NewMarkReadMessage(rm.room, sequence, unread[rm.room]))
+
+	return sequence
+}
+
+// unread returns numbers of messages not read by given user in given rooms
+// or nil if read markers of the user are not known.
+func (ch *Rooms) unread(userName string, roomNames []string) map[string]int64 {
+	markers, known := ch.markers[userName]
+	if !known {
+		return nil
+	}
+
+	unread := make(map[string]int64, len(roomNames))
+	for _, name := range roomNames {
+		room, ok := ch.rooms[name]
+		if !ok {
+			continue
+		}
+
+		if count := room.LastSequence() - markers[name]; count > 0 {
+			unread[name] = count
+		} else {
+			unread[name] = 0
+		}
+	}
+
+	return unread
+}
+
 func (ch *Rooms) clientRooms(id string) []string {
 	rooms := make([]string, 0)
 	for _, room := range ch.rooms {
@@ -181,12 +463,106 @@ func (ch *Rooms) clientRooms(id string) []string {
 	return rooms
 }
 
-// CreateRoom creates new request for creating new room.
-func (ch *Rooms) CreateRoom(roomName string, client *Client) {
-	ch.createRoomRequest <- clientAndRoom{
+// CreateRoom creates new request (with given identifier) for creating new room
+// with given visibility. Password is required only for password-protected rooms.
+// Persistent rooms are not removed when they become empty.
+func (ch *Rooms) CreateRoom(requestID, roomName, visibility, password string, persistent bool, client *Client) {
+	if visibility == "" {
+		visibility = VisibilityPublic
+	}
+
+	if !validVisibility(visibility) {
+		client.Send(ErrorMessage(ErrCodeInvalidPayload, requestID, fmt.Sprintf("Invalid room visibility %v", visibility)))
+		return
+	}
+
+	var passwordHash []byte
+	if visibility == VisibilityPassword {
+		if password == "" {
+			client.Send(ErrorMessage(ErrCodeInvalidPayload, requestID, "Password-protected room requires password"))
+			return
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			logger.Errorf("Cannot hash password of room %v. Error: %v", roomName, err)
+			client.Send(ErrorMessage(ErrCodeInternal, requestID, "Cannot create room"))
+			return
+		}
+		passwordHash = hash
+	}
+
+	ch.createRoomRequest <- roomCreation{
+		client:       client,
+		requestID:    requestID,
+		room:         roomName,
+		visibility:   visibility,
+		passwordHash: passwordHash,
+		persistent:   persistent,
+	}
+}
+
+// RegisterClient makes given client reachable by direct messages sent to
+// its user and sends it list of rooms with numbers of unread messages.
+func (ch *Rooms) RegisterClient(client *Client) {
+	markers, err := ch.store.ReadMarkers(client.UserName())
+	if err != nil {
+		logger.Warnf("Cannot read read markers of user %v. Error: %v", client.UserName(), err)
+		markers = make(map[string]int64)
+	}
+
+	ch.registerClient <- clientMarkers{
+		client:  client,
+		markers: markers,
+	}
+}
+
+// MarkRead moves read marker of the user of given client in given room to
+// given sequence number (but not past the latest message) and notifies all
+// clients of the user about it. Returns sequence number the marker has been
+// moved to or zero if the marker would not move forward.
+func (ch *Rooms) MarkRead(roomName string, sequence int64, client *Client) int64 {
+	result := make(chan int64, 1)
+
+	ch.markReadRequest <- readMarker{
+		client:   client,
+		room:     roomName,
+		sequence: sequence,
+		result:   result,
+	}
+
+	return <-result
+}
+
+// ClaimNick sets given nickname of the user given client belongs to unless it
+// is a name or nickname of other online user. Empty nickname restores user name.
+func (ch *Rooms) ClaimNick(nick string, client *Client) bool {
+	result := make(chan bool, 1)
+
+	ch.nickRequest <- nickRequest{
 		client: client,
-		room:   roomName,
+		nick:   nick,
+		result: result,
+	}
+
+	return <-result
+}
+
+// MessageLimit returns maximal length in bytes of messages sent in room with
+// given name. Direct messages (without room) are limited by the configured maximum.
+func (ch *Rooms) MessageLimit(roomName string) int {
+	if roomName == "" {
+		return ch.maxMessageSize
 	}
+
+	result := make(chan int, 1)
+	ch.messageLimitRequest <- messageLimitRequest{room: roomName, result: result}
+	return <-result
+}
+
+// SendDirectMessage sends given message to all clients of its recipient and sender.
+func (ch *Rooms) SendDirectMessage(message *Message) {
+	ch.directMessageRequest <- message
 }
 
 // RemoveClient removes client from all rooms.
@@ -195,9 +571,9 @@ func (ch *Rooms) RemoveClient(client *Client) {
 	ch.removeClient <- client
 }
 
-// RemoveRoom removes room with given name.
-func (ch *Rooms) RemoveRoom(roomName string) {
-	ch.removeRoomRequests <- roomName
+// RemoveRoom removes given room if it is still empty.
+func (ch *Rooms) RemoveRoom(room *Room) {
+	ch.removeRoomRequests <- room
 }
 
 // ClientsRooms will return list of rooms to given client.
@@ -205,11 +581,15 @@ func (ch *Rooms) ClientsRooms(client *Client) {
 	ch.roomsListRequests <- client
 }
 
-// AddClientToRoom adds given client to room with given name.
-func (ch *Rooms) AddClientToRoom(roomName string, client *Client) {
+// AddClientToRoom adds given client to room with given name if the client
+// is allowed to enter it. Password is checked only for password-protected rooms.
+// Errors are sent as responses to request with given identifier.
+func (ch *Rooms) AddClientToRoom(requestID, roomName, password string, client *Client) {
 	ch.addClientToRoomRequest <- clientAndRoom{
-		client: client,
-		room:   roomName,
+		client:        client,
+		requestID:     requestID,
+		room:          roomName,
+		passwordValid: ch.passwordValid(roomName, password),
 	}
 }
 
@@ -221,6 +601,17 @@ func (ch *Rooms) RemoveClientFromRoom(roomName string, client *Client) {
 	}
 }
 
+// RoomMembers sends list of users present in room with given name to given
+// client if it is allowed to see them. Errors are sent as responses to
+// request with given identifier.
+func (ch *Rooms) RoomMembers(requestID, roomName string, client *Client) {
+	ch.roomMembersRequest <- clientAndRoom{
+		client:    client,
+		requestID: requestID,
+		room:      roomName,
+	}
+}
+
 // SendMessageOnRoom sends given message to all clients of given room.
 func (ch *Rooms) SendMessageOnRoom(message *Message) {
 	ch.messageRequest <- message
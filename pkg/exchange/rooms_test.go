@@ -0,0 +1,552 @@
+package exchange
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/adrian83/chat/pkg/history"
+	logger "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testOwner   = "owner"
+	testWaiting = 2 * time.Second
+	testTick    = 5 * time.Millisecond
+)
+
+var testClients atomic.Int64
+
+// memoryStore is a message store which keeps messages in memory.
+type memoryStore struct {
+	messageStore
+
+	lock     sync.Mutex
+	messages []*history.Message
+	markers  map[string]map[string]int64
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{markers: make(map[string]map[string]int64)}
+}
+
+func (s *memoryStore) SaveMessage(msg history.Message) (*history.Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if msg.ID == "" {
+		msg.ID = fmt.Sprintf("msg-%v", len(s.messages)+1)
+	}
+	s.messages = append(s.messages, &msg)
+
+	saved := msg
+	return &saved, nil
+}
+
+func (s *memoryStore) SaveDirectMessage(msg history.Message) (*history.Message, error) {
+	return s.SaveMessage(msg)
+}
+
+// find returns copies of stored messages accepted by given filter sorted by sequence numbers.
+func (s *memoryStore) find(filter func(*history.Message) bool) []*history.Message {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	found := make([]*history.Message, 0)
+	for _, msg := range s.messages {
+		if filter(msg) {
+			stored := *msg
+			found = append(found, &stored)
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Sequence < found[j].Sequence })
+	return found
+}
+
+// last returns at most 'limit' last of given messages.
+func last(messages []*history.Message, limit int) []*history.Message {
+	if len(messages) > limit {
+		return messages[len(messages)-limit:]
+	}
+	return messages
+}
+
+func (s *memoryStore) LastMessages(room string, limit int) ([]*history.Message, error) {
+	return last(s.find(func(m *history.Message) bool { return m.Room == room && m.ParentID == "" }), limit), nil
+}
+
+func (s *memoryStore) LastSequence(room string) (int64, error) {
+	var sequence int64
+	for _, msg := range s.find(func(m *history.Message) bool { return m.Room == room }) {
+		sequence = max(sequence, msg.Sequence)
+	}
+	return sequence, nil
+}
+
+func (s *memoryStore) MessagesAfter(room string, sequence int64, limit int) ([]*history.Message, error) {
+	messages := s.find(func(m *history.Message) bool { return m.Room == room && m.Sequence > sequence })
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+func (s *memoryStore) MessagesBefore(room string, before int64, limit int) ([]*history.Message, error) {
+	return last(s.find(func(m *history.Message) bool {
+		return m.Room == room && m.ParentID == "" && m.Sequence < before
+	}), limit), nil
+}
+
+func (s *memoryStore) DirectMessagesBefore(userName, peer string, before time.Time, beforeID string, limit int) ([]*history.Message, error) {
+	messages := s.find(func(m *history.Message) bool {
+		return m.Direct() && history.ConversationID(m.SenderName, m.Recipient) == history.ConversationID(userName, peer)
+	})
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		if messages[i].Time.Equal(messages[j].Time) {
+			return messages[i].ID < messages[j].ID
+		}
+		return messages[i].Time.Before(messages[j].Time)
+	})
+
+	older := make([]*history.Message, 0, len(messages))
+	for _, msg := range messages {
+		if before.IsZero() || msg.Time.Before(before) || (msg.Time.Equal(before) && msg.ID < beforeID) {
+			older = append(older, msg)
+		}
+	}
+	return last(older, limit), nil
+}
+
+func (s *memoryStore) FindByClientMsgID(senderName, clientMsgID string) (*history.Message, error) {
+	found := s.find(func(m *history.Message) bool { return m.SenderName == senderName && m.ClientMsgID == clientMsgID })
+	if len(found) == 0 {
+		return nil, nil
+	}
+	return found[0], nil
+}
+
+func (s *memoryStore) FindMessage(id string) (*history.Message, error) {
+	found := s.find(func(m *history.Message) bool { return m.ID == id })
+	if len(found) == 0 {
+		return nil, nil
+	}
+	return found[0], nil
+}
+
+// update applies given change to stored message with given identifier and
+// returns its copy or nil if there is no such message or it has been deleted.
+func (s *memoryStore) update(id string, change func(*history.Message)) (*history.Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, msg := range s.messages {
+		if msg.ID == id && !msg.Deleted {
+			change(msg)
+			updated := *msg
+			return &updated, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) EditMessage(id, content string, at time.Time) (*history.Message, error) {
+	return s.update(id, func(m *history.Message) {
+		m.Revisions = append(m.Revisions, history.Revision{Content: m.Content, Time: at})
+		m.Content = content
+	})
+}
+
+func (s *memoryStore) DeleteMessage(id string, at time.Time) (*history.Message, error) {
+	return s.update(id, func(m *history.Message) {
+		m.Revisions = append(m.Revisions, history.Revision{Content: m.Content, Time: at})
+		m.Content = ""
+		m.Deleted = true
+	})
+}
+
+func (s *memoryStore) SaveReadMarker(userName, room string, sequence int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.markers[userName]; !ok {
+		s.markers[userName] = make(map[string]int64)
+	}
+	s.markers[userName][room] = sequence
+	return nil
+}
+
+func (s *memoryStore) ReadMarkers(userName string) (map[string]int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	markers := make(map[string]int64)
+	for room, sequence := range s.markers[userName] {
+		markers[room] = sequence
+	}
+	return markers, nil
+}
+
+func (s *memoryStore) RenameRoom(oldName, newName string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, msg := range s.messages {
+		if msg.Room == oldName {
+			msg.Room = newName
+		}
+	}
+	return nil
+}
+
+// recordingConn is a connection which records all sent envelopes.
+type recordingConn struct {
+	lock      sync.Mutex
+	envelopes []*Envelope
+	closed    chan struct{}
+	closeOne  sync.Once
+}
+
+func newRecordingConn() *recordingConn {
+	return &recordingConn{closed: make(chan struct{})}
+}
+
+func (c *recordingConn) Send(envelope *Envelope) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.envelopes = append(c.envelopes, envelope)
+	return nil
+}
+
+func (c *recordingConn) Receive(*Envelope) error {
+	<-c.closed
+	return errors.New("connection closed")
+}
+
+func (c *recordingConn) Close() error {
+	c.closeOne.Do(func() { close(c.closed) })
+	return nil
+}
+
+// messages returns sent messages of given type.
+func (c *recordingConn) messages(msgType string) []*Message {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	messages := make([]*Message, 0)
+	for _, envelope := range c.envelopes {
+		if envelope.Type != msgType || envelope.Payload == nil {
+			continue
+		}
+
+		msg := *envelope.Payload
+		msg.MsgType = envelope.Type
+		msg.RequestID = envelope.RequestID
+		messages = append(messages, &msg)
+	}
+	return messages
+}
+
+// received waits until a message of given type accepted by given filter is
+// sent and returns it or nil if it isn't sent in time.
+func (c *recordingConn) received(msgType string, filter func(*Message) bool) *Message {
+	deadline := time.Now().Add(testWaiting)
+	for time.Now().Before(deadline) {
+		if msg := findMessage(c.messages(msgType), filter); msg != nil {
+			return msg
+		}
+		time.Sleep(testTick)
+	}
+	return nil
+}
+
+// findMessage returns the first of given messages accepted by given filter or nil.
+func findMessage(messages []*Message, filter func(*Message) bool) *Message {
+	for _, msg := range messages {
+		if filter(msg) {
+			return msg
+		}
+	}
+	return nil
+}
+
+// anyMessage accepts every message.
+func anyMessage(*Message) bool {
+	return true
+}
+
+// inRoom accepts messages concerning room with given name.
+func inRoom(room string) func(*Message) bool {
+	return func(msg *Message) bool { return msg.Room == room }
+}
+
+// withCode accepts errors with given code.
+func withCode(code string) func(*Message) bool {
+	return func(msg *Message) bool { return msg.Code == code }
+}
+
+func newTestRooms(store messageStore) *Rooms {
+	logger.SetLevel(logger.WarnLevel)
+	return NewRooms(store, &testRoomStore{}, 10, 0, 100, ResumeLimits{Window: time.Minute, MaxMessages: 10}, testOwner)
+}
+
+// connect starts a client of user with given name and adds it to the main room
+// like a new connection is.
+func connect(t *testing.T, rooms *Rooms, userName string, router *Router) (*Client, *recordingConn) {
+	conn := newRecordingConn()
+	id := fmt.Sprintf("%v-%v", userName, testClients.Add(1))
+	client := NewClient(id, testUser(userName), rooms, conn, router, stressQueueSize, DropOldest)
+	go client.Start()
+	t.Cleanup(func() { _ = conn.Close() })
+
+	rooms.RegisterClient(client)
+	rooms.AddClientToRoom("", MainRoomName(), "", client)
+	return client, conn
+}
+
+func TestBannedUserCannotEnterRoom(t *testing.T) {
+	testData := []struct {
+		name  string
+		until time.Duration
+		enter bool
+	}{
+		{name: "user is banned forever", enter: false},
+		{name: "user is banned for an hour", until: time.Hour, enter: false},
+		{name: "ban has expired", until: -time.Hour, enter: true},
+	}
+
+	for _, data := range testData {
+		// given
+		rooms := newTestRooms(newMemoryStore())
+		owner, ownerConn := connect(t, rooms, testOwner, NewRouter())
+		assert.NotNil(t, ownerConn.received(MsgUserJoinedRoomMT, inRoom(MainRoomName())), data.name)
+
+		ban := &Message{MsgType: MsgBanUserMT, Room: MainRoomName(), Target: "mike"}
+		if data.until != 0 {
+			ban.Until = time.Now().Add(data.until).UnixMilli()
+		}
+		rooms.Moderate(ban, owner)
+		assert.NotNil(t, ownerConn.received(MsgBanUserMT, anyMessage), data.name)
+
+		// when
+		_, conn := connect(t, rooms, "mike", NewRouter())
+
+		// then
+		if data.enter {
+			assert.NotNil(t, conn.received(MsgUserJoinedRoomMT, inRoom(MainRoomName())), data.name)
+			continue
+		}
+
+		assert.NotNil(t, conn.received(MsgErrorMsgMT, withCode(ErrCodeForbidden)), data.name)
+		assert.Empty(t, conn.messages(MsgUserJoinedRoomMT), data.name)
+	}
+}
+
+func TestRemovingEmptyRoom(t *testing.T) {
+	testData := []struct {
+		name       string
+		grace      time.Duration
+		persistent bool
+		rename     string
+		rejoin     bool
+		removed    string
+	}{
+		{name: "empty room is removed", removed: "room"},
+		{name: "empty room is removed after grace period", grace: 50 * time.Millisecond, removed: "room"},
+		{name: "renamed room is removed under new name", rename: "renamed", removed: "renamed"},
+		{name: "persistent room isn't removed", persistent: true},
+		{name: "room entered again during grace period isn't removed", grace: 100 * time.Millisecond, rejoin: true},
+	}
+
+	for _, data := range testData {
+		// given
+		rooms := NewRooms(newMemoryStore(), &testRoomStore{}, 10, data.grace, 100, ResumeLimits{}, testOwner)
+		owner, ownerConn := connect(t, rooms, testOwner, NewRouter())
+		_, annaConn := connect(t, rooms, "anna", NewRouter())
+		assert.NotNil(t, annaConn.received(MsgUserJoinedRoomMT, inRoom(MainRoomName())), data.name)
+
+		rooms.CreateRoom("", "room", VisibilityPublic, "", data.persistent, owner)
+		assert.NotNil(t, ownerConn.received(MsgUserJoinedRoomMT, inRoom("room")), data.name)
+
+		name := "room"
+		if data.rename != "" {
+			rooms.UpdateRoom(&Message{Room: name, NewName: data.rename}, owner)
+			assert.NotNil(t, ownerConn.received(MsgRoomInfoMT, inRoom(data.rename)), data.name)
+			name = data.rename
+		}
+
+		// when
+		rooms.RemoveClientFromRoom(name, owner)
+		assert.NotNil(t, ownerConn.received(MsgUserLeftRoomMT, inRoom(name)), data.name)
+
+		if data.rejoin {
+			rooms.AddClientToRoom("", name, "", owner)
+		}
+
+		// then
+		if data.removed != "" {
+			assert.NotNil(t, annaConn.received(MsgRemoveRoomMT, inRoom(data.removed)), data.name)
+			assert.Len(t, annaConn.messages(MsgRemoveRoomMT), 1, data.name)
+			continue
+		}
+
+		removed := func() bool { return len(annaConn.messages(MsgRemoveRoomMT)) > 0 }
+		assert.Never(t, removed, 3*data.grace+100*time.Millisecond, testTick, data.name)
+	}
+}
+
+func TestRoomNameValid(t *testing.T) {
+	testData := []struct {
+		name     string
+		room     string
+		expected bool
+	}{
+		{name: "letters and digits", room: "room1", expected: true},
+		{name: "dots, dashes and underscores", room: "my_room-2.0", expected: true},
+		{name: "empty name", room: "", expected: false},
+		{name: "spaces", room: "my room", expected: false},
+		{name: "slash", room: "rooms/1", expected: false},
+		{name: "non-ASCII letters", room: "pokój", expected: false},
+	}
+
+	for _, data := range testData {
+		// given
+		rooms := &Rooms{}
+
+		// when
+		valid := rooms.roomNameValid(data.room)
+
+		// then
+		assert.Equal(t, data.expected, valid, data.name)
+	}
+}
+
+func TestRoomRecognizesRetriedMessages(t *testing.T) {
+	testData := []struct {
+		name      string
+		persisted bool
+		sent      int
+		delivered int
+	}{
+		{name: "new message is delivered", sent: 1, delivered: 1},
+		{name: "retry of persisted message is not delivered", persisted: true, sent: 1, delivered: 0},
+		{name: "retry of accepted message is not delivered", sent: 2, delivered: 1},
+	}
+
+	for _, data := range testData {
+		// given
+		store := newMemoryStore()
+		if data.persisted {
+			_, _ = store.SaveMessage(history.Message{ID: "persisted", Sequence: 1, Room: MainRoomName(), SenderName: "anna", ClientMsgID: "c-1", Content: "hi"})
+		}
+
+		rooms := newTestRooms(store)
+		anna, annaConn := connect(t, rooms, "anna", NewRouter())
+		assert.NotNil(t, annaConn.received(MsgUserJoinedRoomMT, inRoom(MainRoomName())), data.name)
+
+		// when
+		for i := 0; i < data.sent; i++ {
+			rooms.SendMessageOnRoom(&Message{MsgType: MsgTextMsgMT, RequestID: fmt.Sprintf("req-%v", i), SenderID: anna.ID(),
+				SenderName: "anna", Room: MainRoomName(), ClientMsgID: "c-1", Content: "hi"})
+		}
+
+		// then
+		assert.Eventually(t, func() bool { return len(annaConn.messages(MsgAckMT)) == data.sent }, testWaiting, testTick, data.name)
+
+		acks := annaConn.messages(MsgAckMT)
+		for _, ack := range acks {
+			assert.Equal(t, acks[0].ID, ack.ID, data.name)
+			assert.Equal(t, int64(1), ack.Sequence, data.name)
+		}
+		if data.persisted {
+			assert.Equal(t, "persisted", acks[0].ID, data.name)
+		}
+
+		// persisted message is also replayed when anna joins the room
+		delivered := func() bool {
+			count := 0
+			for _, msg := range annaConn.messages(MsgTextMsgMT) {
+				if msg.ID != "persisted" {
+					count++
+				}
+			}
+			return count == data.delivered
+		}
+		assert.Eventually(t, delivered, testWaiting, testTick, data.name)
+		assert.Never(t, func() bool { return !delivered() }, 100*time.Millisecond, testTick, data.name)
+		assert.Len(t, store.find(anyStoredMessage), 1, data.name)
+	}
+}
+
+// anyStoredMessage accepts every stored message.
+func anyStoredMessage(*history.Message) bool {
+	return true
+}
+
+// unavailableStore is a message store which fails reading the latest
+// sequence number given number of times.
+type unavailableStore struct {
+	*memoryStore
+	failures atomic.Int64
+}
+
+func (s *unavailableStore) LastSequence(room string) (int64, error) {
+	if s.failures.Add(-1) >= 0 {
+		return 0, errors.New("store is unavailable")
+	}
+	return s.memoryStore.LastSequence(room)
+}
+
+func TestRoomRestoresSequenceAfterStoreFailures(t *testing.T) {
+	testData := []struct {
+		name     string
+		failures int64
+		rejected int
+	}{
+		{name: "sequence is restored when room starts", failures: 0},
+		{name: "sequence is restored after retries", failures: sequenceAttempts - 1},
+		{name: "sequence is restored when message is sent", failures: sequenceAttempts},
+		{name: "message is rejected until sequence is restored", failures: sequenceAttempts + 1, rejected: 1},
+	}
+
+	for _, data := range testData {
+		// given
+		store := &unavailableStore{memoryStore: newMemoryStore()}
+		store.failures.Store(data.failures)
+		_, _ = store.SaveMessage(history.Message{Sequence: 7, Room: MainRoomName(), SenderName: "anna", Content: "hi"})
+
+		rooms := newTestRooms(store)
+		anna, annaConn := connect(t, rooms, "anna", NewRouter())
+		assert.NotNil(t, annaConn.received(MsgUserJoinedRoomMT, inRoom(MainRoomName())), data.name)
+
+		// when
+		for i := 0; i <= data.rejected; i++ {
+			requestID := fmt.Sprintf("req-%v", i)
+			rooms.SendMessageOnRoom(&Message{MsgType: MsgTextMsgMT, RequestID: requestID, SenderID: anna.ID(),
+				SenderName: "anna", Room: MainRoomName(), ClientMsgID: requestID, Content: "hi"})
+
+			if i < data.rejected {
+				assert.NotNil(t, annaConn.received(MsgErrorMsgMT, withCode(ErrCodeInternal)), data.name)
+			}
+		}
+
+		// then
+		ack := annaConn.received(MsgAckMT, anyMessage)
+		if assert.NotNil(t, ack, data.name) {
+			assert.Equal(t, int64(8), ack.Sequence, data.name)
+			assert.Equal(t, fmt.Sprintf("req-%v", data.rejected), ack.RequestID, data.name)
+		}
+
+		errs := annaConn.messages(MsgErrorMsgMT)
+		assert.Len(t, errs, data.rejected, data.name)
+		for _, err := range errs {
+			assert.Equal(t, ErrCodeInternal, err.Code, data.name)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package exchange
+
+import (
+	"fmt"
+	"time"
+)
+
+type roomUpdateRequest struct {
+	client         *Client
+	requestID      string
+	room           string
+	newName        string
+	topic          *string
+	description    *string
+	owner          string
+	maxMessageSize int
+}
+
+// info returns description of this room sent to clients in ROOM_INFO messages.
+// It is used only by the Rooms event loop.
+func (ch *Room) info() *RoomInfo {
+	var createdAt int64
+	if !ch.createdAt.IsZero() {
+		createdAt = ch.createdAt.UnixMilli()
+	}
+
+	return &RoomInfo{
+		Name:           ch.Name(),
+		Topic:          ch.topic,
+		Description:    ch.description,
+		Owner:          ch.moderation.owner,
+		Moderators:     ch.moderation.moderatorNames(),
+		CreatedBy:      ch.createdBy,
+		CreatedAt:      createdAt,
+		Visibility:     ch.access.visibility,
+		Persistent:     ch.persistent,
+		MaxMessageSize: int(ch.maxMessageSize.Load()),
+	}
+}
+
+// updateRoom applies changes of room settings requested by the room owner
+// and notifies all users who can see the room about them.
+func (ch *Rooms) updateRoom(req roomUpdateRequest) {
+	room, ok := ch.rooms[req.room]
+	if !ok {
+		req.client.Send(ErrorMessage(ErrCodeNotFound, req.requestID, fmt.Sprintf("Room %v doesn't exist", req.room)))
+		return
+	}
+
+	if room.Main() || req.client.UserName() != room.moderation.owner {
+		req.client.Send(ErrorMessage(ErrCodeForbidden, req.requestID, fmt.Sprintf("Only owner can change settings of room %v", req.room)))
+		return
+	}
+
+	renamed := req.newName != "" && req.newName != req.room
+	if renamed {
+		if !ch.roomNameValid(req.newName) {
+			req.client.Send(ErrorMessage(ErrCodeInvalidPayload, req.requestID, "Invalid room name"))
+			return
+		}
+
+		if _, exists := ch.rooms[req.newName]; exists {
+			req.client.Send(ErrorMessage(ErrCodeConflict, req.requestID, fmt.Sprintf("Room %v already exists", req.newName)))
+			return
+		}
+	}
+
+	if req.maxMessageSize > ch.maxMessageSize {
+		req.client.Send(ErrorMessage(ErrCodeInvalidPayload, req.requestID, fmt.Sprintf("Message size limit cannot exceed %v bytes", ch.maxMessageSize)))
+		return
+	}
+
+	if req.owner != "" && req.owner != room.moderation.owner {
+		if r := room.moderation.restriction(req.owner, time.Now()); r.banned {
+			req.client.Send(ErrorMessage(ErrCodeForbidden, req.requestID, fmt.Sprintf("User %v is banned in room %v", req.owner, req.room)))
+			return
+		}
+
+		_, pending := room.access.invitations[req.owner]
+		if room.access.private() && !room.open(req.owner) && !pending {
+			req.client.Send(ErrorMessage(ErrCodeForbidden, req.requestID, fmt.Sprintf("User %v is not invited to room %v", req.owner, req.room)))
+			return
+		}
+	}
+
+	if req.topic != nil {
+		room.topic = *req.topic
+	}
+
+	if req.description != nil {
+		room.description = *req.description
+	}
+
+	if req.maxMessageSize > 0 {
+		room.maxMessageSize.Store(int64(req.maxMessageSize))
+	}
+
+	if req.owner != "" {
+		room.moderation.owner = req.owner
+		delete(room.moderation.moderators, req.owner)
+		delete(room.access.invitations, req.owner)
+		room.access.invited[req.owner] = true
+	}
+
+	previousName := ""
+	if renamed {
+		previousName = req.room
+		delete(ch.rooms, req.room)
+		ch.rooms[req.newName] = room
+		room.setName(req.newName)
+
+		for _, markers := range ch.markers {
+			if sequence, ok := markers[req.room]; ok {
+				delete(markers, req.room)
+				markers[req.newName] = sequence
+			}
+		}
+
+		ch.renameRoom(room, req.room)
+	} else {
+		ch.saveRoom(room)
+	}
+
+	ch.publishRoomInfo(room, previousName)
+}
+
+// publishRoomInfo sends current settings of given room to all users who can see the room.
+func (ch *Rooms) publishRoomInfo(room *Room, previousName string) {
+	msg := NewRoomInfoMessage(room.info(), previousName)
+	for userName := range ch.users {
+		if ch.roomVisible(room, userName) {
+			ch.users.send(userName, msg)
+		}
+	}
+}
+
+// UpdateRoom requests changes of room settings described by given message on behalf of given client.
+func (ch *Rooms) UpdateRoom(msg *Message, client *Client) {
+	ch.roomUpdateRequest <- roomUpdateRequest{
+		client:         client,
+		requestID:      msg.RequestID,
+		room:           msg.Room,
+		newName:        msg.NewName,
+		topic:          msg.Topic,
+		description:    msg.Description,
+		owner:          msg.Target,
+		maxMessageSize: msg.MaxMessageSize,
+	}
+}
@@ -0,0 +1,153 @@
+package exchange
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransferringOwnershipOfPrivateRoom(t *testing.T) {
+	testData := []struct {
+		name     string
+		invite   bool
+		accept   bool
+		ban      bool
+		expected string
+	}{
+		{name: "new owner isn't invited", expected: ErrCodeForbidden},
+		{name: "new owner has pending invitation", invite: true},
+		{name: "new owner accepted invitation", invite: true, accept: true},
+		{name: "new owner is banned", invite: true, accept: true, ban: true, expected: ErrCodeForbidden},
+	}
+
+	for _, data := range testData {
+		// given
+		rooms := newTestRooms(newMemoryStore())
+		owner, ownerConn := connect(t, rooms, testOwner, NewRouter())
+		rooms.CreateRoom("", "private", VisibilityPrivate, "", true, owner)
+		assert.NotNil(t, ownerConn.received(MsgUserJoinedRoomMT, inRoom("private")), data.name)
+
+		anna, annaConn := connect(t, rooms, "anna", NewRouter())
+		assert.NotNil(t, annaConn.received(MsgUserJoinedRoomMT, inRoom(MainRoomName())), data.name)
+
+		if data.invite {
+			rooms.Invite(&Message{MsgType: MsgInviteMT, Room: "private", Target: "anna"}, owner)
+			assert.NotNil(t, annaConn.received(MsgInviteMT, inRoom("private")), data.name)
+		}
+
+		if data.accept {
+			rooms.Invite(&Message{MsgType: MsgInviteAcceptMT, Room: "private"}, anna)
+			assert.NotNil(t, annaConn.received(MsgUserJoinedRoomMT, inRoom("private")), data.name)
+		}
+
+		if data.ban {
+			rooms.Moderate(&Message{MsgType: MsgBanUserMT, Room: "private", Target: "anna"}, owner)
+			assert.NotNil(t, ownerConn.received(MsgBanUserMT, inRoom("private")), data.name)
+		}
+
+		// when
+		rooms.UpdateRoom(&Message{RequestID: "transfer", Room: "private", Target: "anna"}, owner)
+
+		// then
+		if data.expected != "" {
+			assert.NotNil(t, ownerConn.received(MsgErrorMsgMT, withCode(data.expected)), data.name)
+			continue
+		}
+
+		info := annaConn.received(MsgRoomInfoMT, func(msg *Message) bool { return msg.Info != nil && msg.Info.Owner == "anna" })
+		assert.NotNil(t, info, data.name)
+		assert.True(t, rooms.Admitted("private", "anna"), data.name)
+		assert.True(t, rooms.Admitted("private", testOwner), data.name)
+	}
+}
+
+func TestUpdatingRoomSettings(t *testing.T) {
+	topic := "news"
+
+	testData := []struct {
+		name     string
+		update   *Message
+		expected string
+		info     func(*RoomInfo) bool
+	}{
+		{
+			name:   "topic is changed",
+			update: &Message{Room: "room", Topic: &topic},
+			info:   func(info *RoomInfo) bool { return info.Topic == topic },
+		},
+		{
+			name:   "message size limit is lowered",
+			update: &Message{Room: "room", MaxMessageSize: 50},
+			info:   func(info *RoomInfo) bool { return info.MaxMessageSize == 50 },
+		},
+		{
+			name:     "message size limit cannot exceed configured maximum",
+			update:   &Message{Room: "room", MaxMessageSize: 101},
+			expected: ErrCodeInvalidPayload,
+		},
+		{
+			name:   "room is renamed",
+			update: &Message{Room: "room", NewName: "renamed"},
+			info:   func(info *RoomInfo) bool { return info.Name == "renamed" },
+		},
+		{
+			name:     "room cannot be renamed to invalid name",
+			update:   &Message{Room: "room", NewName: "new room"},
+			expected: ErrCodeInvalidPayload,
+		},
+		{
+			name:     "room cannot be renamed to name of other room",
+			update:   &Message{Room: "room", NewName: "other"},
+			expected: ErrCodeConflict,
+		},
+		{
+			name:     "main room cannot be changed",
+			update:   &Message{Room: MainRoomName(), Topic: &topic},
+			expected: ErrCodeForbidden,
+		},
+		{
+			name:     "missing room cannot be changed",
+			update:   &Message{Room: "missing", Topic: &topic},
+			expected: ErrCodeNotFound,
+		},
+	}
+
+	for _, data := range testData {
+		// given
+		rooms := newTestRooms(newMemoryStore())
+		owner, ownerConn := connect(t, rooms, testOwner, NewRouter())
+		for _, name := range []string{"room", "other"} {
+			rooms.CreateRoom("", name, VisibilityPublic, "", true, owner)
+			assert.NotNil(t, ownerConn.received(MsgUserJoinedRoomMT, inRoom(name)), data.name)
+		}
+
+		// when
+		data.update.RequestID = "update"
+		rooms.UpdateRoom(data.update, owner)
+
+		// then
+		if data.expected != "" {
+			assert.NotNil(t, ownerConn.received(MsgErrorMsgMT, withCode(data.expected)), data.name)
+			continue
+		}
+
+		info := ownerConn.received(MsgRoomInfoMT, func(msg *Message) bool { return msg.Info != nil && data.info(msg.Info) })
+		assert.NotNil(t, info, data.name)
+	}
+}
+
+func TestUpdatingRoomSettingsByOtherUser(t *testing.T) {
+	// given
+	rooms := newTestRooms(newMemoryStore())
+	owner, ownerConn := connect(t, rooms, testOwner, NewRouter())
+	rooms.CreateRoom("", "room", VisibilityPublic, "", true, owner)
+	assert.NotNil(t, ownerConn.received(MsgUserJoinedRoomMT, inRoom("room")))
+
+	anna, annaConn := connect(t, rooms, "anna", NewRouter())
+
+	// when
+	rooms.UpdateRoom(&Message{RequestID: "update", Room: "room", NewName: "mine"}, anna)
+
+	// then
+	assert.NotNil(t, annaConn.received(MsgErrorMsgMT, withCode(ErrCodeForbidden)))
+}
@@ -0,0 +1,133 @@
+package exchange
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// httpTransportBuffer is a number of envelopes buffered in each direction of HTTP transport.
+const httpTransportBuffer = 64
+
+var errTransportClosed = errors.New("transport closed")
+
+// NewHTTPTransport returns transport used by clients which cannot use
+// websockets. Envelopes sent to the client are taken from Outbound channel
+// by Server-Sent Events stream or long-polling requests, envelopes received
+// from the client are posted with Post. Heartbeats work as on websocket
+// connection.
+func NewHTTPTransport(heartbeat Heartbeat) *HTTPTransport {
+	transport := &HTTPTransport{
+		token:     uuid.New().String(),
+		heartbeat: heartbeat,
+		inbound:   make(chan *Envelope, httpTransportBuffer),
+		outbound:  make(chan *Envelope, httpTransportBuffer),
+		closed:    make(chan struct{}),
+	}
+
+	if heartbeat.Interval > 0 {
+		go sendHeartbeats(transport, heartbeat.Interval, transport.closed)
+	}
+
+	return transport
+}
+
+// HTTPTransport exchanges envelopes with a client through separate HTTP requests.
+type HTTPTransport struct {
+	token     string
+	heartbeat Heartbeat
+	inbound   chan *Envelope
+	outbound  chan *Envelope
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Token returns identifier of this transport, which client uses in subsequent requests.
+func (t *HTTPTransport) Token() string {
+	return t.token
+}
+
+// Outbound returns channel of envelopes waiting for being delivered to the client.
+func (t *HTTPTransport) Outbound() <-chan *Envelope {
+	return t.outbound
+}
+
+// Done returns channel which is closed when transport is closed.
+func (t *HTTPTransport) Done() <-chan struct{} {
+	return t.closed
+}
+
+// Send waits until there is a place for given envelope in outbound buffer.
+func (t *HTTPTransport) Send(envelope *Envelope) error {
+	timeout, stop := t.timer(t.heartbeat.WriteTimeout)
+	defer stop()
+
+	select {
+	case t.outbound <- envelope:
+		return nil
+	case <-timeout:
+		return errors.New("client doesn't receive messages")
+	case <-t.closed:
+		return errTransportClosed
+	}
+}
+
+// Receive waits for an envelope posted by a client. PONG messages are
+// skipped. If nothing is received before read timeout, transport is closed.
+func (t *HTTPTransport) Receive(envelope *Envelope) error {
+	for {
+		timeout, stop := t.timer(t.heartbeat.ReadTimeout)
+
+		select {
+		case received := <-t.inbound:
+			stop()
+			if received.Type == MsgPongMT {
+				continue
+			}
+
+			*envelope = *received
+			return nil
+
+		case <-timeout:
+			t.Close()
+			return errors.New("client missed heartbeats")
+
+		case <-t.closed:
+			stop()
+			return errTransportClosed
+		}
+	}
+}
+
+// Post passes envelope received from the client to Receive. It returns error
+// if transport is closed or given context is done before that.
+func (t *HTTPTransport) Post(ctx context.Context, envelope *Envelope) error {
+	select {
+	case t.inbound <- envelope:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.closed:
+		return errTransportClosed
+	}
+}
+
+// Close closes transport. It can be invoked many times.
+func (t *HTTPTransport) Close() error {
+	t.closeOnce.Do(func() { close(t.closed) })
+	return nil
+}
+
+// timer returns channel which fires after given timeout or nil (which
+// never fires) if timeout is not set, and a function stopping the timer.
+func (t *HTTPTransport) timer(timeout time.Duration) (<-chan time.Time, func()) {
+	if timeout <= 0 {
+		return nil, func() {}
+	}
+
+	timer := time.NewTimer(timeout)
+	return timer.C, func() { timer.Stop() }
+}
@@ -0,0 +1,109 @@
+package exchange
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// typingRefresh is a minimal interval between two TYPING_START messages
+	// relayed for the same client and room.
+	typingRefresh = 3 * time.Second
+	// typingTimeout is a time after which typing state expires if no
+	// TYPING_START or TYPING_STOP message has been received.
+	typingTimeout = 6 * time.Second
+)
+
+type typingState struct {
+	// checkedAt is a time of the last TYPING_START which wasn't throttled
+	checkedAt time.Time
+	// relayed is 'true' if any TYPING_START has been relayed to the room
+	relayed bool
+	expiry  *time.Timer
+}
+
+// NewTypingHandler returns new TypingHandler struct.
+func NewTypingHandler(rooms *Rooms, client *Client) *TypingHandler {
+	return &TypingHandler{
+		rooms:  rooms,
+		client: client,
+		states: make(map[string]*typingState),
+	}
+}
+
+// TypingHandler relays typing notifications of a client to other members
+// of a room. Notifications are throttled, so no more than one TYPING_START
+// per room is relayed every 'typingRefresh', and typing state expires
+// after 'typingTimeout' if client stops sending them. Typing of banned
+// and muted users is not relayed.
+type TypingHandler struct {
+	rooms  *Rooms
+	client *Client
+	lock   sync.Mutex
+	states map[string]*typingState
+}
+
+func (h *TypingHandler) Handle(msg *Message) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if msg.MsgType == MsgTypingStopMT {
+		h.stop(msg.Room)
+		return nil
+	}
+
+	h.start(msg.Room)
+	return nil
+}
+
+func (h *TypingHandler) start(room string) {
+	state, active := h.states[room]
+	if !active {
+		state = &typingState{}
+		state.expiry = time.AfterFunc(typingTimeout, func() { h.expire(room, state) })
+		h.states[room] = state
+	} else {
+		state.expiry.Reset(typingTimeout)
+	}
+
+	if time.Since(state.checkedAt) < typingRefresh {
+		return
+	}
+	state.checkedAt = time.Now()
+
+	// restrictions are checked only for notifications which aren't throttled
+	if r := h.rooms.Restriction(room, h.client.UserName()); r.banned || r.muted {
+		return
+	}
+
+	state.relayed = true
+	h.rooms.SendMessageOnRoom(NewTypingMessage(MsgTypingStartMT, room, h.client.ID(), h.client.UserName()))
+}
+
+func (h *TypingHandler) stop(room string) {
+	state, active := h.states[room]
+	if !active {
+		return
+	}
+
+	state.expiry.Stop()
+	delete(h.states, room)
+
+	if !state.relayed {
+		return
+	}
+
+	h.rooms.SendMessageOnRoom(NewTypingMessage(MsgTypingStopMT, room, h.client.ID(), h.client.UserName()))
+}
+
+func (h *TypingHandler) expire(room string, state *typingState) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	// typing could have been stopped and started again while this timer was firing
+	if h.states[room] != state {
+		return
+	}
+
+	h.stop(room)
+}
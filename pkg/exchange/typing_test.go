@@ -0,0 +1,53 @@
+package exchange
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTypingNotifications(t *testing.T) {
+	testData := []struct {
+		name   string
+		muted  bool
+		sent   []string
+		starts int
+		stops  int
+	}{
+		{name: "typing is relayed once per refresh", sent: []string{MsgTypingStartMT, MsgTypingStartMT, MsgTypingStartMT}, starts: 1},
+		{name: "stop is relayed after start", sent: []string{MsgTypingStartMT, MsgTypingStopMT}, starts: 1, stops: 1},
+		{name: "stop without start is not relayed", sent: []string{MsgTypingStopMT}},
+		{name: "typing of muted user is not relayed", muted: true, sent: []string{MsgTypingStartMT, MsgTypingStartMT, MsgTypingStopMT}},
+	}
+
+	for _, data := range testData {
+		// given
+		rooms := newTestRooms(newMemoryStore())
+		owner, ownerConn := connect(t, rooms, testOwner, NewRouter())
+		assert.NotNil(t, ownerConn.received(MsgUserJoinedRoomMT, inRoom(MainRoomName())), data.name)
+		owner.negotiate(ProtocolVersion, []string{FeatureTyping})
+
+		mike, mikeConn := connect(t, rooms, "mike", NewRouter())
+		assert.NotNil(t, mikeConn.received(MsgUserJoinedRoomMT, inRoom(MainRoomName())), data.name)
+
+		if data.muted {
+			rooms.Moderate(&Message{MsgType: MsgMuteUserMT, Room: MainRoomName(), Target: "mike"}, owner)
+			assert.NotNil(t, mikeConn.received(MsgMuteUserMT, anyMessage), data.name)
+		}
+
+		handler := NewTypingHandler(rooms, mike)
+
+		// when
+		for _, msgType := range data.sent {
+			assert.NoError(t, handler.Handle(&Message{MsgType: msgType, Room: MainRoomName()}), data.name)
+		}
+
+		// then
+		relayed := func() bool {
+			return len(ownerConn.messages(MsgTypingStartMT)) == data.starts && len(ownerConn.messages(MsgTypingStopMT)) == data.stops
+		}
+		assert.Eventually(t, relayed, testWaiting, testTick, data.name)
+		assert.Never(t, func() bool { return !relayed() }, 100*time.Millisecond, testTick, data.name)
+	}
+}
@@ -0,0 +1,94 @@
+package exchange
+
+import "strings"
+
+// userClients contains live clients of a single user and nickname shared by them.
+type userClients struct {
+	nick    string
+	clients map[string]*Client
+}
+
+// usersMap groups live clients by the name of the user they belong to.
+type usersMap map[string]*userClients
+
+// user returns clients of user with given name, adding the user if it is missing.
+func (u usersMap) user(userName string) *userClients {
+	user, ok := u[userName]
+	if !ok {
+		user = &userClients{clients: make(map[string]*Client)}
+		u[userName] = user
+	}
+	return user
+}
+
+// add registers given client. The client takes over nickname of its user.
+func (u usersMap) add(client *Client) {
+	user := u.user(client.UserName())
+	user.clients[client.ID()] = client
+	client.SetNick(user.nick)
+}
+
+func (u usersMap) remove(client *Client) {
+	user, ok := u[client.UserName()]
+	if !ok {
+		return
+	}
+
+	delete(user.clients, client.ID())
+
+	if len(user.clients) == 0 {
+		delete(u, client.UserName())
+	}
+}
+
+// clients returns live clients of user with given name.
+func (u usersMap) clients(userName string) map[string]*Client {
+	if user, ok := u[userName]; ok {
+		return user.clients
+	}
+	return nil
+}
+
+// connections returns all live clients of the user given client belongs to,
+// including given client even if it hasn't been registered yet.
+func (u usersMap) connections(client *Client) []*Client {
+	clients := []*Client{client}
+	for id, c := range u.clients(client.UserName()) {
+		if id != client.ID() {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
+// send sends given message to all clients of user with given name.
+func (u usersMap) send(userName string, msg *Message) {
+	for _, client := range u.clients(userName) {
+		client.Send(msg)
+	}
+}
+
+// setNick sets nickname of the user given client belongs to on all its clients,
+// including given client even if it hasn't been registered yet. Empty nickname
+// restores user name.
+func (u usersMap) setNick(client *Client, nick string) {
+	u.user(client.UserName()).nick = nick
+	for _, c := range u.connections(client) {
+		c.SetNick(nick)
+	}
+}
+
+// nickTaken returns true if given nickname is a name or nickname of a live
+// user other than given one. Letter case is ignored.
+func (u usersMap) nickTaken(nick, userName string) bool {
+	for name, user := range u {
+		if name == userName {
+			continue
+		}
+
+		if strings.EqualFold(name, nick) || strings.EqualFold(user.nick, nick) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,294 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/adrian83/chat/pkg/exchange"
+	"github.com/gorilla/mux"
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxPostedEnvelopeSize is the largest body of request posting an envelope.
+	maxPostedEnvelopeSize = 1 << 20
+	// maxPolledEnvelopes is the largest number of envelopes returned by a single poll.
+	maxPolledEnvelopes = 100
+)
+
+// Client exchanges messages with a user until it is stopped. Start blocks
+// until then.
+type Client interface {
+	Start()
+}
+
+// Connect authenticates user sending given request and returns client
+// (not started yet) exchanging messages through given transport.
+type Connect func(req *http.Request, transport exchange.Transport) (Client, error)
+
+// TransportHandler struct responsible for handling Server-Sent Events and
+// long-polling transports, which are used by browsers unable to keep
+// websocket connections. Transports are identified by tokens and can be
+// used only within sessions which opened them. Envelopes returned by a poll
+// are delivered at least once: they are returned again by the next poll
+// until the client acknowledges their batch.
+type TransportHandler struct {
+	connect     Connect
+	heartbeat   exchange.Heartbeat
+	pollTimeout time.Duration
+	transports  map[string]*openTransport
+	lock        sync.Mutex
+}
+
+type openTransport struct {
+	sessionID string
+	transport *exchange.HTTPTransport
+	// polling serializes polls, so batches are numbered in order
+	polling sync.Mutex
+	batch   int64
+	pending []*exchange.Envelope
+}
+
+// polledEnvelopes is a response to poll request. Client acknowledges
+// envelopes by sending their batch in the next poll.
+type polledEnvelopes struct {
+	Batch     int64                `json:"batch"`
+	Envelopes []*exchange.Envelope `json:"envelopes"`
+}
+
+// NewTransportHandler returns new TransportHandler struct. Long-polling
+// requests wait at most 'pollTimeout' for messages.
+func NewTransportHandler(connect Connect, heartbeat exchange.Heartbeat, pollTimeout time.Duration) *TransportHandler {
+	return &TransportHandler{
+		connect:     connect,
+		heartbeat:   heartbeat,
+		pollTimeout: pollTimeout,
+		transports:  make(map[string]*openTransport),
+	}
+}
+
+// StreamEvents opens new transport and streams messages sent to the client
+// as Server-Sent Events. The first event ('token') contains the token of the
+// transport. Stream ends when the transport is closed or the client disconnects.
+func (h *TransportHandler) StreamEvents(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	transport, ok := h.open(w, req)
+	if !ok {
+		return
+	}
+	defer transport.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	fmt.Fprintf(w, "event: token\ndata: %v\n\n", transport.Token())
+	flusher.Flush()
+
+	for {
+		select {
+		case envelope := <-transport.Outbound():
+			data, err := json.Marshal(envelope)
+			if err != nil {
+				logger.Warnf("Error while encoding envelope. Error: %v", err)
+				continue
+			}
+
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				logger.Infof("Error while writing event. Error: %v", err)
+				return
+			}
+			flusher.Flush()
+
+		case <-transport.Done():
+			return
+
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// OpenPolling opens new long-polling transport and responds with its token.
+func (h *TransportHandler) OpenPolling(w http.ResponseWriter, req *http.Request) {
+	transport, ok := h.open(w, req)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, map[string]string{"token": transport.Token()})
+}
+
+// Poll responds with batch of messages sent to the client. Batch of the
+// previous poll is returned again until the client acknowledges it with
+// 'ack' query parameter. If there are no messages, poll waits until one is
+// sent or poll timeout passes, then it responds with empty list. Closed
+// transport is reported with 410 status.
+func (h *TransportHandler) Poll(w http.ResponseWriter, req *http.Request) {
+	open, ok := h.find(w, req)
+	if !ok {
+		return
+	}
+
+	var ack int64
+	if value := req.URL.Query().Get("ack"); value != "" {
+		var err error
+		if ack, err = strconv.ParseInt(value, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid acknowledgement: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	open.polling.Lock()
+	defer open.polling.Unlock()
+
+	if ack >= open.batch {
+		open.pending = nil
+	}
+
+	if len(open.pending) == 0 {
+		envelopes, ok := h.receive(w, req, open.transport)
+		if !ok {
+			return
+		}
+
+		if len(envelopes) > 0 {
+			open.batch++
+			open.pending = envelopes
+		}
+	}
+
+	envelopes := open.pending
+	if envelopes == nil {
+		envelopes = make([]*exchange.Envelope, 0)
+	}
+
+	writeJSON(w, polledEnvelopes{Batch: open.batch, Envelopes: envelopes})
+}
+
+// receive waits at most poll timeout for envelopes sent to the client of
+// given transport. Returns 'false' if the response has been already written
+// or the request has been cancelled.
+func (h *TransportHandler) receive(w http.ResponseWriter, req *http.Request, transport *exchange.HTTPTransport) ([]*exchange.Envelope, bool) {
+	timeout := time.NewTimer(h.pollTimeout)
+	defer timeout.Stop()
+
+	envelopes := make([]*exchange.Envelope, 0)
+
+	select {
+	case envelope := <-transport.Outbound():
+		envelopes = append(envelopes, envelope)
+	case <-timeout.C:
+	case <-transport.Done():
+		http.Error(w, "transport closed", http.StatusGone)
+		return nil, false
+	case <-req.Context().Done():
+		return nil, false
+	}
+
+drain:
+	for len(envelopes) > 0 && len(envelopes) < maxPolledEnvelopes {
+		select {
+		case envelope := <-transport.Outbound():
+			envelopes = append(envelopes, envelope)
+		default:
+			break drain
+		}
+	}
+
+	return envelopes, true
+}
+
+// Post passes envelope sent in request body to the client of the transport.
+func (h *TransportHandler) Post(w http.ResponseWriter, req *http.Request) {
+	open, ok := h.find(w, req)
+	if !ok {
+		return
+	}
+
+	var envelope exchange.Envelope
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxPostedEnvelopeSize)).Decode(&envelope); err != nil {
+		http.Error(w, fmt.Sprintf("invalid envelope: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := open.transport.Post(req.Context(), &envelope); err != nil {
+		http.Error(w, "transport closed", http.StatusGone)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// open creates new transport, starts client using it and registers the
+// transport until it is closed.
+func (h *TransportHandler) open(w http.ResponseWriter, req *http.Request) (*exchange.HTTPTransport, bool) {
+	sessionID, err := ReadSessionIDFromCookie(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+
+	transport := exchange.NewHTTPTransport(h.heartbeat)
+
+	client, err := h.connect(req, transport)
+	if err != nil {
+		transport.Close()
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+
+	h.lock.Lock()
+	h.transports[transport.Token()] = &openTransport{sessionID: sessionID, transport: transport}
+	h.lock.Unlock()
+
+	go func() {
+		<-transport.Done()
+
+		h.lock.Lock()
+		delete(h.transports, transport.Token())
+		h.lock.Unlock()
+	}()
+
+	go client.Start()
+
+	return transport, true
+}
+
+// find returns transport with token given in request path, if it was opened within the same session.
+func (h *TransportHandler) find(w http.ResponseWriter, req *http.Request) (*openTransport, bool) {
+	sessionID, err := ReadSessionIDFromCookie(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+
+	h.lock.Lock()
+	open, ok := h.transports[mux.Vars(req)["token"]]
+	h.lock.Unlock()
+
+	if !ok || open.sessionID != sessionID {
+		http.Error(w, "transport not found", http.StatusGone)
+		return nil, false
+	}
+
+	return open, true
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		logger.Warnf("Error while writing response. Error: %v", err)
+	}
+}
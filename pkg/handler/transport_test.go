@@ -0,0 +1,200 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adrian83/chat/pkg/exchange"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPollTimeout = 50 * time.Millisecond
+
+// echoClient sends every received envelope back through its transport.
+type echoClient struct {
+	transport exchange.Transport
+}
+
+func (c *echoClient) Start() {
+	defer c.transport.Close()
+
+	for {
+		var envelope exchange.Envelope
+		if err := c.transport.Receive(&envelope); err != nil {
+			return
+		}
+
+		if err := c.transport.Send(&envelope); err != nil {
+			return
+		}
+	}
+}
+
+func echoConnect(req *http.Request, transport exchange.Transport) (Client, error) {
+	return &echoClient{transport: transport}, nil
+}
+
+func newTransportRouter(heartbeat exchange.Heartbeat) *mux.Router {
+	transportHandler := NewTransportHandler(echoConnect, heartbeat, testPollTimeout)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/poll", transportHandler.OpenPolling).Methods("POST")
+	router.HandleFunc("/poll/{token}", transportHandler.Poll).Methods("GET")
+	router.HandleFunc("/poll/{token}", transportHandler.Post).Methods("POST")
+	return router
+}
+
+func request(router http.Handler, method, url, sessionID, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	if sessionID != "" {
+		req.AddCookie(&http.Cookie{Name: sessionIDName, Value: sessionID})
+	}
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	return resp
+}
+
+func openPolling(t *testing.T, router http.Handler, sessionID string) string {
+	resp := request(router, "POST", "/poll", sessionID, "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var body map[string]string
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	return body["token"]
+}
+
+func poll(t *testing.T, router http.Handler, token, sessionID, ack string) polledEnvelopes {
+	resp := request(router, "GET", "/poll/"+token+"?ack="+ack, sessionID, "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var body polledEnvelopes
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	return body
+}
+
+func TestOpenPollingShouldRespondWithToken(t *testing.T) {
+	// given
+	router := newTransportRouter(exchange.Heartbeat{})
+
+	// when
+	token := openPolling(t, router, "session-1")
+
+	// then
+	assert.NotEmpty(t, token)
+}
+
+func TestOpenPollingShouldRequireSession(t *testing.T) {
+	// given
+	router := newTransportRouter(exchange.Heartbeat{})
+
+	// when
+	resp := request(router, "POST", "/poll", "", "")
+
+	// then
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+}
+
+func TestPollShouldReturnEmptyBatchAfterTimeout(t *testing.T) {
+	// given
+	router := newTransportRouter(exchange.Heartbeat{})
+	token := openPolling(t, router, "session-1")
+
+	// when
+	polled := poll(t, router, token, "session-1", "0")
+
+	// then
+	assert.Equal(t, int64(0), polled.Batch)
+	assert.Empty(t, polled.Envelopes)
+}
+
+func TestPostedEnvelopeShouldBeReturnedByPoll(t *testing.T) {
+	// given
+	router := newTransportRouter(exchange.Heartbeat{})
+	token := openPolling(t, router, "session-1")
+
+	// when
+	resp := request(router, "POST", "/poll/"+token, "session-1", `{"v":1,"type":"PING","requestId":"req-1"}`)
+	polled := poll(t, router, token, "session-1", "0")
+
+	// then
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, int64(1), polled.Batch)
+	assert.Equal(t, []*exchange.Envelope{{Version: 1, Type: "PING", RequestID: "req-1"}}, polled.Envelopes)
+}
+
+func TestPostShouldRejectInvalidEnvelope(t *testing.T) {
+	// given
+	router := newTransportRouter(exchange.Heartbeat{})
+	token := openPolling(t, router, "session-1")
+
+	// when
+	resp := request(router, "POST", "/poll/"+token, "session-1", `{"type":`)
+
+	// then
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestPollShouldReturnBatchAgainUntilItIsAcknowledged(t *testing.T) {
+	// given
+	router := newTransportRouter(exchange.Heartbeat{})
+	token := openPolling(t, router, "session-1")
+	request(router, "POST", "/poll/"+token, "session-1", `{"v":1,"type":"PING","requestId":"req-1"}`)
+	first := poll(t, router, token, "session-1", "0")
+
+	// when
+	repeated := poll(t, router, token, "session-1", "0")
+	acknowledged := poll(t, router, token, "session-1", "1")
+
+	// then
+	assert.Equal(t, first, repeated)
+	assert.Equal(t, int64(1), acknowledged.Batch)
+	assert.Empty(t, acknowledged.Envelopes)
+}
+
+func TestPollShouldRejectInvalidAcknowledgement(t *testing.T) {
+	// given
+	router := newTransportRouter(exchange.Heartbeat{})
+	token := openPolling(t, router, "session-1")
+
+	// when
+	resp := request(router, "GET", "/poll/"+token+"?ack=first", "session-1", "")
+
+	// then
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestTransportShouldNotBeFoundInOtherSession(t *testing.T) {
+	// given
+	router := newTransportRouter(exchange.Heartbeat{})
+	token := openPolling(t, router, "session-1")
+
+	// when
+	polled := request(router, "GET", "/poll/"+token, "session-2", "")
+	posted := request(router, "POST", "/poll/"+token, "session-2", `{"v":1,"type":"PING"}`)
+	withoutSession := request(router, "GET", "/poll/"+token, "", "")
+
+	// then
+	assert.Equal(t, http.StatusGone, polled.Code)
+	assert.Equal(t, http.StatusGone, posted.Code)
+	assert.Equal(t, http.StatusUnauthorized, withoutSession.Code)
+}
+
+func TestTransportShouldBeClosedAfterHeartbeatTimeout(t *testing.T) {
+	// given
+	router := newTransportRouter(exchange.Heartbeat{ReadTimeout: testPollTimeout})
+	token := openPolling(t, router, "session-1")
+
+	// when
+	closed := func() bool {
+		return request(router, "GET", "/poll/"+token, "session-1", "").Code == http.StatusGone
+	}
+
+	// then
+	assert.Eventually(t, closed, time.Second, 10*time.Millisecond)
+}
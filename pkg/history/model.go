@@ -0,0 +1,133 @@
+package history
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Message is a struct containing data of a message sent in a room
+// or directly to other user.
+type Message struct {
+	ID           string     `json:"id" gorethink:"id,omitempty"`
+	ClientMsgID  string     `json:"clientMsgId" gorethink:"clientMsgId,omitempty"`
+	Sequence     int64      `json:"sequence" gorethink:"sequence,omitempty"`
+	Room         string     `json:"room" gorethink:"room"`
+	ParentID     string     `json:"parentId" gorethink:"parentId,omitempty"`
+	SenderName   string     `json:"senderName" gorethink:"senderName"`
+	Recipient    string     `json:"recipient" gorethink:"recipient,omitempty"`
+	Conversation string     `json:"conversation" gorethink:"conversation,omitempty"`
+	Content      string     `json:"content" gorethink:"content"`
+	Time         time.Time  `json:"time" gorethink:"time"`
+	Deleted      bool       `json:"deleted" gorethink:"deleted"`
+	Revisions    []Revision `json:"revisions" gorethink:"revisions"`
+	ReplyCount   int        `json:"replyCount" gorethink:"replyCount"`
+	LastReply    *time.Time `json:"lastReply" gorethink:"lastReply,omitempty"`
+	Reactions    []Reaction `json:"reactions" gorethink:"-"`
+}
+
+func (m *Message) addReaction(emoji, userName string) {
+	for i := range m.Reactions {
+		if m.Reactions[i].Emoji == emoji {
+			m.Reactions[i].Users = append(m.Reactions[i].Users, userName)
+			return
+		}
+	}
+
+	m.Reactions = append(m.Reactions, Reaction{Emoji: emoji, Users: []string{userName}})
+}
+
+// Reaction is a struct containing names of users who reacted to
+// a message with the same emoji.
+type Reaction struct {
+	Emoji string   `json:"emoji"`
+	Users []string `json:"users"`
+}
+
+// UserReaction is a struct containing data of a single reaction of a user to a message.
+type UserReaction struct {
+	ID        string    `json:"id" gorethink:"id"`
+	MessageID string    `json:"messageId" gorethink:"messageId"`
+	Emoji     string    `json:"emoji" gorethink:"emoji"`
+	User      string    `json:"user" gorethink:"user"`
+	Time      time.Time `json:"time" gorethink:"time"`
+}
+
+// UserReactionID returns identifier of a reaction of given user to given message with given emoji.
+func UserReactionID(messageID, emoji, userName string) string {
+	hash := sha1.Sum([]byte(strings.Join([]string{messageID, emoji, userName}, "\n")))
+	return hex.EncodeToString(hash[:])
+}
+
+// Revision is a previous content of an edited or deleted message.
+type Revision struct {
+	Content string    `json:"content" gorethink:"content"`
+	Time    time.Time `json:"time" gorethink:"time"`
+}
+
+// Reply returns 'true' if message is a reply in a thread, 'false' otherwise.
+func (m *Message) Reply() bool {
+	return m.ParentID != ""
+}
+
+// Edited returns time of the latest edition of the message or zero time
+// if the message has never been edited.
+func (m *Message) Edited() time.Time {
+	if len(m.Revisions) == 0 {
+		return time.Time{}
+	}
+	return m.Revisions[len(m.Revisions)-1].Time
+}
+
+// Direct returns 'true' if message was sent directly to other user, 'false' otherwise.
+func (m *Message) Direct() bool {
+	return m.Recipient != ""
+}
+
+// Conversation is a struct containing data about direct messages exchanged by two users.
+type Conversation struct {
+	ID           string    `json:"id" gorethink:"id"`
+	Participants []string  `json:"participants" gorethink:"participants"`
+	LastMessage  time.Time `json:"lastMessage" gorethink:"lastMessage"`
+}
+
+// Peer returns name of the participant other than given user.
+func (c *Conversation) Peer(userName string) string {
+	for _, participant := range c.Participants {
+		if participant != userName {
+			return participant
+		}
+	}
+	return userName
+}
+
+// ReadMarker is a struct containing sequence number of the latest message
+// in a room read by a user.
+type ReadMarker struct {
+	ID       string `json:"id" gorethink:"id"`
+	User     string `json:"user" gorethink:"user"`
+	Room     string `json:"room" gorethink:"room"`
+	Sequence int64  `json:"sequence" gorethink:"sequence"`
+}
+
+// ReadMarkerID returns identifier of a read marker of given user in given room.
+func ReadMarkerID(userName, room string) string {
+	hash := sha1.Sum([]byte(strings.Join([]string{userName, room}, "\n")))
+	return hex.EncodeToString(hash[:])
+}
+
+// ConversationID returns identifier of a conversation between two given users.
+// The identifier doesn't depend on the order of the users.
+func ConversationID(userName1, userName2 string) string {
+	participants := conversationParticipants(userName1, userName2)
+	hash := sha1.Sum([]byte(strings.Join(participants, "\n")))
+	return hex.EncodeToString(hash[:])
+}
+
+func conversationParticipants(userName1, userName2 string) []string {
+	participants := []string{userName1, userName2}
+	sort.Strings(participants)
+	return participants
+}
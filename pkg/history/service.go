@@ -0,0 +1,435 @@
+package history
+
+import (
+	"time"
+
+	"github.com/adrian83/chat/pkg/db"
+)
+
+const (
+	roomProp         = "room"
+	timeProp         = "time"
+	sequenceProp     = "sequence"
+	contentProp      = "content"
+	deletedProp      = "deleted"
+	revisionsProp    = "revisions"
+	replyCountProp   = "replyCount"
+	lastReplyProp    = "lastReply"
+	userProp         = "user"
+	participantsProp = "participants"
+	lastMessageProp  = "lastMessage"
+)
+
+type Database interface {
+	UUID() (string, error)
+	Insert(interface{}) error
+	Upsert(interface{}) error
+	UpsertGreater(entity interface{}, property string) error
+	Select(query *db.Query, result interface{}) error
+	Get(id string, result interface{}) (bool, error)
+	Update(id string, changes interface{}) error
+	UpdateUnless(id, property string, changes, result interface{}) (bool, error)
+	UpdateAll(query *db.Query, changes interface{}) error
+	Delete(id string) error
+}
+
+// Service struct representing repository for messages sent in rooms
+// and directly between users.
+type Service struct {
+	messages      Database
+	conversations Database
+	reactions     Database
+	readMarkers   Database
+}
+
+// NewHistoryService returns new instance of Service.
+func NewHistoryService(messages, conversations, reactions, readMarkers Database) *Service {
+	return &Service{
+		messages:      messages,
+		conversations: conversations,
+		reactions:     reactions,
+		readMarkers:   readMarkers,
+	}
+}
+
+// SaveMessage persists given message. If message has no identifier, new
+// one is generated. If message is a reply in a thread, reply counter and
+// last reply time of the thread's parent message are updated. Returns
+// stored message or an error if something bad has happened.
+func (s *Service) SaveMessage(msg Message) (*Message, error) {
+	if msg.ID == "" {
+		uuid, err := s.messages.UUID()
+		if err != nil {
+			return nil, err
+		}
+
+		msg.ID = uuid
+	}
+
+	if err := s.messages.Insert(msg); err != nil {
+		return nil, err
+	}
+
+	if msg.Reply() {
+		if err := s.recordReply(msg.ParentID, msg.Time); err != nil {
+			return nil, err
+		}
+	}
+
+	return &msg, nil
+}
+
+func (s *Service) recordReply(parentID string, at time.Time) error {
+	changes := map[string]interface{}{
+		replyCountProp: db.Increment(replyCountProp),
+		lastReplyProp:  at,
+	}
+
+	return s.messages.Update(parentID, changes)
+}
+
+// SaveDirectMessage persists given message sent directly from one user to
+// another and updates conversation of these users. Returns stored message
+// or an error if something bad has happened.
+func (s *Service) SaveDirectMessage(msg Message) (*Message, error) {
+	msg.Conversation = ConversationID(msg.SenderName, msg.Recipient)
+
+	stored, err := s.SaveMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	conversation := Conversation{
+		ID:           msg.Conversation,
+		Participants: conversationParticipants(msg.SenderName, msg.Recipient),
+		LastMessage:  msg.Time,
+	}
+
+	if err := s.conversations.Upsert(conversation); err != nil {
+		return nil, err
+	}
+
+	return stored, nil
+}
+
+// LastMessages returns at most 'limit' latest messages sent in given room,
+// ordered from the oldest to the newest.
+func (s *Service) LastMessages(room string, limit int) ([]*Message, error) {
+	query := db.NewQuery().
+		Between(db.RoomSequenceIndex, []interface{}{room, db.MinValue}, []interface{}{room, db.MaxValue})
+
+	return s.latestMessages(query, db.RoomSequenceIndex, limit)
+}
+
+// FindMessage returns message with given identifier (with its reactions)
+// or nil if there is no such message.
+func (s *Service) FindMessage(id string) (*Message, error) {
+	var msg Message
+	found, err := s.messages.Get(id, &msg)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	if err := s.attachReactions([]*Message{&msg}); err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+// EditMessage replaces content of message with given identifier with given
+// content unless the message has been deleted. The previous content is kept
+// in message revisions. Returns updated message, nil if there is no such
+// message or it has been deleted or an error if something bad has happened.
+func (s *Service) EditMessage(id, content string, at time.Time) (*Message, error) {
+	changes := map[string]interface{}{
+		contentProp:   content,
+		revisionsProp: db.Append(revisionsProp, revision(at)),
+	}
+
+	return s.updateMessage(id, changes)
+}
+
+// DeleteMessage marks message with given identifier as deleted and clears
+// its content unless it has already been deleted. The deleted content is
+// kept in message revisions. Returns updated message, nil if there is no
+// such message or it has been deleted or an error if something bad has happened.
+func (s *Service) DeleteMessage(id string, at time.Time) (*Message, error) {
+	changes := map[string]interface{}{
+		contentProp:   "",
+		deletedProp:   true,
+		revisionsProp: db.Append(revisionsProp, revision(at)),
+	}
+
+	return s.updateMessage(id, changes)
+}
+
+// revision returns revision keeping the current content of an updated message.
+func revision(at time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		contentProp: db.Current(contentProp),
+		timeProp:    at,
+	}
+}
+
+// updateMessage atomically applies given changes to message with given
+// identifier unless it has been deleted and returns the updated message (with its reactions).
+func (s *Service) updateMessage(id string, changes map[string]interface{}) (*Message, error) {
+	var msg Message
+	updated, err := s.messages.UpdateUnless(id, deletedProp, changes, &msg)
+	if err != nil || !updated {
+		return nil, err
+	}
+
+	if err := s.attachReactions([]*Message{&msg}); err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+// AddReaction stores reaction of given user to given message with given emoji.
+func (s *Service) AddReaction(messageID, emoji, userName string, at time.Time) error {
+	reaction := UserReaction{
+		ID:        UserReactionID(messageID, emoji, userName),
+		MessageID: messageID,
+		Emoji:     emoji,
+		User:      userName,
+		Time:      at,
+	}
+
+	return s.reactions.Upsert(reaction)
+}
+
+// RemoveReaction removes reaction of given user to given message with given emoji.
+func (s *Service) RemoveReaction(messageID, emoji, userName string) error {
+	return s.reactions.Delete(UserReactionID(messageID, emoji, userName))
+}
+
+// SaveReadMarker stores sequence number of the latest message in given room
+// read by given user. Stored marker is never moved backwards.
+func (s *Service) SaveReadMarker(userName, room string, sequence int64) error {
+	marker := ReadMarker{
+		ID:       ReadMarkerID(userName, room),
+		User:     userName,
+		Room:     room,
+		Sequence: sequence,
+	}
+
+	return s.readMarkers.UpsertGreater(marker, sequenceProp)
+}
+
+// ReadMarkers returns sequence numbers of the latest messages read by given user mapped by room names.
+func (s *Service) ReadMarkers(userName string) (map[string]int64, error) {
+	query := db.NewQuery().
+		Equal(userProp, userName)
+
+	markers := make([]*ReadMarker, 0)
+	if err := s.readMarkers.Select(query, &markers); err != nil {
+		return nil, err
+	}
+
+	sequences := make(map[string]int64, len(markers))
+	for _, marker := range markers {
+		sequences[marker.Room] = marker.Sequence
+	}
+
+	return sequences, nil
+}
+
+// RenameRoom moves messages and read markers of room with given old name to given new name.
+func (s *Service) RenameRoom(oldName, newName string) error {
+	query := db.NewQuery().
+		Equal(roomProp, oldName)
+
+	if err := s.messages.UpdateAll(query, map[string]interface{}{roomProp: newName}); err != nil {
+		return err
+	}
+
+	markers := make([]*ReadMarker, 0)
+	if err := s.readMarkers.Select(query, &markers); err != nil {
+		return err
+	}
+
+	for _, marker := range markers {
+		if err := s.SaveReadMarker(marker.User, newName, marker.Sequence); err != nil {
+			return err
+		}
+
+		if err := s.readMarkers.Delete(marker.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FindByClientMsgID returns message sent by given user with given client
+// generated identifier or nil if there is no such message.
+func (s *Service) FindByClientMsgID(senderName, clientMsgID string) (*Message, error) {
+	query := db.NewQuery().
+		GetAll(db.SenderClientMsgIDIndex, []interface{}{senderName, clientMsgID}).
+		Limit(1)
+
+	messages := make([]*Message, 0)
+	if err := s.messages.Select(query, &messages); err != nil {
+		return nil, err
+	}
+
+	if len(messages) == 0 {
+		return nil, nil
+	}
+
+	return messages[0], nil
+}
+
+// LastSequence returns sequence number of the latest message sent in given
+// room or zero if no messages have been sent in the room.
+func (s *Service) LastSequence(room string) (int64, error) {
+	query := db.NewQuery().
+		Between(db.RoomSequenceIndex, []interface{}{room, db.MinValue}, []interface{}{room, db.MaxValue}).
+		OrderBy(db.RoomSequenceIndex, true).
+		Limit(1)
+
+	messages := make([]*Message, 0)
+	if err := s.messages.Select(query, &messages); err != nil {
+		return 0, err
+	}
+
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	return messages[0].Sequence, nil
+}
+
+// MessagesAfter returns at most 'limit' messages sent in given room with
+// sequence number greater than given one, ordered from the oldest to the newest.
+func (s *Service) MessagesAfter(room string, sequence int64, limit int) ([]*Message, error) {
+	query := db.NewQuery().
+		Between(db.RoomSequenceIndex, []interface{}{room, sequence + 1}, []interface{}{room, db.MaxValue}).
+		OrderBy(db.RoomSequenceIndex, false).
+		Limit(limit)
+
+	messages := make([]*Message, 0)
+	if err := s.messages.Select(query, &messages); err != nil {
+		return nil, err
+	}
+
+	if err := s.attachReactions(messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// MessagesBefore returns at most 'limit' latest messages sent in given room
+// with sequence number lower than given one, ordered from the oldest to the newest.
+func (s *Service) MessagesBefore(room string, before int64, limit int) ([]*Message, error) {
+	query := db.NewQuery().
+		Between(db.RoomSequenceIndex, []interface{}{room, db.MinValue}, []interface{}{room, before})
+
+	return s.latestMessages(query, db.RoomSequenceIndex, limit)
+}
+
+// ThreadMessagesBefore returns at most 'limit' latest replies to given
+// message with sequence number lower than given one, ordered from the oldest to the newest.
+func (s *Service) ThreadMessagesBefore(parentID string, before int64, limit int) ([]*Message, error) {
+	query := db.NewQuery().
+		Between(db.ParentSequenceIndex, []interface{}{parentID, db.MinValue}, []interface{}{parentID, before})
+
+	return s.latestMessages(query, db.ParentSequenceIndex, limit)
+}
+
+// DirectMessagesBefore returns at most 'limit' latest messages exchanged
+// directly by given users, which were sent before given time or at the same
+// time but have lower identifier than given one, ordered from the oldest to
+// the newest. Zero time means that the latest messages are requested.
+func (s *Service) DirectMessagesBefore(userName, peer string, before time.Time, beforeID string, limit int) ([]*Message, error) {
+	conversation := ConversationID(userName, peer)
+
+	upper := []interface{}{conversation, db.MaxValue}
+	if !before.IsZero() {
+		upper = []interface{}{conversation, before, beforeID}
+	}
+
+	query := db.NewQuery().
+		Between(db.ConversationTimeIDIndex, []interface{}{conversation, db.MinValue}, upper)
+
+	return s.latestMessages(query, db.ConversationTimeIDIndex, limit)
+}
+
+// Conversations returns all conversations of given user, starting
+// from the most recently active one.
+func (s *Service) Conversations(userName string) ([]*Conversation, error) {
+	query := db.NewQuery().
+		Contains(participantsProp, userName).
+		OrderBy(lastMessageProp, true)
+
+	conversations := make([]*Conversation, 0)
+	if err := s.conversations.Select(query, &conversations); err != nil {
+		return nil, err
+	}
+
+	return conversations, nil
+}
+
+// latestMessages returns at most 'limit' messages matching given query with
+// the greatest values of given property or index, ordered from the oldest to the newest.
+func (s *Service) latestMessages(query *db.Query, orderBy string, limit int) ([]*Message, error) {
+	query.OrderBy(orderBy, true).Limit(limit)
+
+	messages := make([]*Message, 0)
+	if err := s.messages.Select(query, &messages); err != nil {
+		return nil, err
+	}
+
+	reverse(messages)
+
+	if err := s.attachReactions(messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// attachReactions fills reactions of given messages. Reactions with the
+// same emoji are aggregated and ordered by the time of the first of them.
+func (s *Service) attachReactions(messages []*Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	byID := make(map[string]*Message, len(messages))
+	ids := make([]interface{}, 0, len(messages))
+	for _, msg := range messages {
+		byID[msg.ID] = msg
+		ids = append(ids, msg.ID)
+	}
+
+	query := db.NewQuery().
+		GetAll(db.ReactionMessageIndex, ids...).
+		OrderBy(timeProp, false)
+
+	reactions := make([]*UserReaction, 0)
+	if err := s.reactions.Select(query, &reactions); err != nil {
+		return err
+	}
+
+	for _, reaction := range reactions {
+		msg, ok := byID[reaction.MessageID]
+		if !ok {
+			continue
+		}
+
+		msg.addReaction(reaction.Emoji, reaction.User)
+	}
+
+	return nil
+}
+
+func reverse(messages []*Message) {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+}
@@ -0,0 +1,35 @@
+package room
+
+import "time"
+
+// Definition is a struct containing data needed to recreate a room after restart.
+type Definition struct {
+	Name           string        `json:"name" gorethink:"name"`
+	Owner          string        `json:"owner" gorethink:"owner"`
+	Visibility     string        `json:"visibility" gorethink:"visibility"`
+	PasswordHash   []byte        `json:"-" gorethink:"passwordHash,omitempty"`
+	Topic          string        `json:"topic" gorethink:"topic"`
+	Description    string        `json:"description" gorethink:"description"`
+	CreatedBy      string        `json:"createdBy" gorethink:"createdBy"`
+	MaxMessageSize int           `json:"maxMessageSize" gorethink:"maxMessageSize"`
+	Persistent     bool          `json:"persistent" gorethink:"persistent"`
+	CreatedAt      time.Time     `json:"createdAt" gorethink:"createdAt"`
+	Moderators     []string      `json:"moderators" gorethink:"moderators"`
+	Bans           []Restriction `json:"bans" gorethink:"bans"`
+	Mutes          []Restriction `json:"mutes" gorethink:"mutes"`
+	Invited        []string      `json:"invited" gorethink:"invited"`
+	Invitations    []Invitation  `json:"invitations" gorethink:"invitations"`
+}
+
+// Restriction is a ban or mute of a user in a room. Restriction without
+// 'Until' time never expires.
+type Restriction struct {
+	User  string     `json:"user" gorethink:"user"`
+	Until *time.Time `json:"until" gorethink:"until,omitempty"`
+}
+
+// Invitation is a pending invitation of a user to a room.
+type Invitation struct {
+	User    string `json:"user" gorethink:"user"`
+	Inviter string `json:"inviter" gorethink:"inviter"`
+}
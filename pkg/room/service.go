@@ -0,0 +1,42 @@
+package room
+
+import (
+	"github.com/adrian83/chat/pkg/db"
+)
+
+type Database interface {
+	Upsert(interface{}) error
+	Delete(id string) error
+	Select(query *db.Query, result interface{}) error
+}
+
+// Service struct representing repository for room definitions.
+type Service struct {
+	db Database
+}
+
+// NewRoomService returns new instance of Service.
+func NewRoomService(db Database) *Service {
+	return &Service{db: db}
+}
+
+// SaveRoom persists given room definition replacing previous definition
+// of the room with the same name.
+func (s *Service) SaveRoom(def Definition) error {
+	return s.db.Upsert(def)
+}
+
+// DeleteRoom removes definition of room with given name.
+func (s *Service) DeleteRoom(name string) error {
+	return s.db.Delete(name)
+}
+
+// Rooms returns definitions of all persisted rooms ordered by creation time.
+func (s *Service) Rooms() ([]*Definition, error) {
+	var defs []*Definition
+	if err := s.db.Select(db.NewQuery().OrderBy("createdAt", false), &defs); err != nil {
+		return nil, err
+	}
+
+	return defs, nil
+}
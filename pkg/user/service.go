@@ -40,3 +40,13 @@ func (s *Service) FindUser(name string) (*User, error) {
 
 	return &user, nil
 }
+
+// UserExists returns 'true' if user with given name exists, 'false' otherwise.
+func (s *Service) UserExists(name string) (bool, error) {
+	user, err := s.FindUser(name)
+	if err != nil {
+		return false, err
+	}
+
+	return !user.Empty(), nil
+}
@@ -3,6 +3,7 @@ const senderId = document.getElementById('session-id').value;
 const senderName = document.getElementById('username').value;
 
 var errorId = 1;
+var oldestSequences = {};
 
 
 console.log("senderId: " + senderId);
@@ -26,6 +27,73 @@ const MSG_REMOVE_ROOM = "REMOVE_ROOM";
 const MSG_USER_JOINED_ROOM = "USER_JOINED_ROOM";
 const MSG_LOGOUT = "LOGOUT_USER";
 const MSG_ERROR = "ERROR"
+const MSG_HISTORY_REQUEST = "HISTORY_REQUEST";
+const MSG_HISTORY_PAGE = "HISTORY_PAGE";
+const MSG_DIRECT = "DIRECT_MSG";
+const MSG_CONVERSATIONS_LIST = "CONVERSATIONS_LIST";
+const MSG_ROOM_MEMBERS = "ROOM_MEMBERS";
+const MSG_TYPING_START = "TYPING_START";
+const MSG_TYPING_STOP = "TYPING_STOP";
+const MSG_ACK = "ACK";
+const MSG_EDIT = "EDIT_MSG";
+const MSG_DELETE = "DELETE_MSG";
+const MSG_REACT = "REACT";
+const MSG_UNREACT = "UNREACT";
+const MSG_THREAD_REQUEST = "THREAD_REQUEST";
+const MSG_THREAD_PAGE = "THREAD_PAGE";
+const MSG_MARK_READ = "MARK_READ";
+const MSG_KICK_USER = "KICK_USER";
+const MSG_BAN_USER = "BAN_USER";
+const MSG_MUTE_USER = "MUTE_USER";
+const MSG_ADD_MODERATOR = "ADD_MODERATOR";
+const MSG_REMOVE_MODERATOR = "REMOVE_MODERATOR";
+const MSG_INVITE = "INVITE";
+const MSG_INVITE_ACCEPT = "INVITE_ACCEPT";
+const MSG_INVITE_DECLINE = "INVITE_DECLINE";
+const MSG_ROOM_UPDATE = "ROOM_UPDATE";
+const MSG_ROOM_INFO = "ROOM_INFO";
+const MSG_COMMAND_RESULT = "COMMAND_RESULT";
+const MSG_PING = "PING";
+const MSG_PONG = "PONG";
+const MSG_RESUME = "RESUME";
+const MSG_RESYNC = "RESYNC";
+const MSG_HELLO = "HELLO";
+
+const PROTOCOL_VERSION = 1;
+const FEATURES = ["typing"];
+
+const ID_PREFIX_INFO_PANEL = "info-";
+
+var roomInfos = {};
+
+const ID_ROOM_VISIBILITY_SELECT = "ch-visibility";
+const ID_ROOM_PASSWORD_INPUT = "ch-password";
+const ID_ROOM_PERSISTENT_CHECKBOX = "ch-persistent";
+const VISIBILITY_PASSWORD = "password";
+
+var protectedRooms = new Set();
+
+var activeRoom = MAIN_ROOM_NAME;
+var lastSequences = {};
+var unreadCounts = {};
+
+const QUICK_REACTIONS = ["\u{1F44D}", "\u{2764}\u{FE0F}", "\u{1F602}"];
+
+var displayedMessages = {};
+
+const ID_PREFIX_MESSAGE = "msg-";
+
+const ID_PREFIX_MEMBERS_PANEL = "members-";
+const ID_PREFIX_TYPING_PANEL = "typing-";
+
+var typingUsers = {};
+const TYPING_REFRESH_MS = 2000;
+// typing indicator disappears if no TYPING_START arrives within this time
+const TYPING_EXPIRY_MS = 8000;
+
+const ID_DIRECT_RECIPIENT_INPUT = "dm-recipient";
+const ID_DIRECT_CONTENT_INPUT = "dm-content";
+const ID_CONVERSATIONS_LIST = "ch-list2";
 
 
 
@@ -49,23 +117,60 @@ function createContentPanelId(roomName) {
     return ID_PREFIX_CONTENT_PANEL + escapeText(roomName);
 }
 
+function createMembersPanelId(roomName) {
+    return ID_PREFIX_MEMBERS_PANEL + escapeText(roomName);
+}
+
+function createInfoPanelId(roomName) {
+    return ID_PREFIX_INFO_PANEL + escapeText(roomName);
+}
+
+function createTypingPanelId(roomName) {
+    return ID_PREFIX_TYPING_PANEL + escapeText(roomName);
+}
+
+function newClientMsgId() {
+    return Date.now().toString(36) + "-" + Math.random().toString(36).substring(2);
+}
+
+var lastRequestId = 0;
+
 function send(msgDict) {
-    console.log("sending", msgDict);
-    wsSocket.send(JSON.stringify(msgDict));
+    var payload = Object.assign({}, msgDict);
+    delete payload["msgType"];
+
+    var envelope = {
+        "v": PROTOCOL_VERSION,
+        "type": msgDict["msgType"],
+        "requestId": (++lastRequestId).toString(),
+        "payload": payload
+    };
+    console.log("sending", envelope);
+    socket.send(JSON.stringify(envelope));
+}
+
+
+function sendHello() {
+    send({ "msgType": MSG_HELLO, "version": PROTOCOL_VERSION, "features": FEATURES });
 }
 
 
 function sendCreateRoomMessage() {
     var roomNameInput = document.getElementById(ID_ROOM_NAME_INPUT);
     var roomName = roomNameInput.value;
+    var passwordInput = document.getElementById(ID_ROOM_PASSWORD_INPUT);
     var msgDict = {
         "msgType": MSG_CREATE_ROOM,
         "senderId": senderId,
-        "room": roomName
+        "room": roomName,
+        "visibility": document.getElementById(ID_ROOM_VISIBILITY_SELECT).value,
+        "password": passwordInput.value,
+        "persistent": document.getElementById(ID_ROOM_PERSISTENT_CHECKBOX).checked
     };
     send(msgDict);
 
     roomNameInput.value = "";
+    passwordInput.value = "";
 }
 
 
@@ -75,16 +180,102 @@ function enterRoom(roomName) {
         "senderId": senderId,
         "room": roomName
     };
+    if (protectedRooms.has(roomName)) {
+        msgDict["password"] = prompt("Password of room " + roomName);
+    }
+    send(msgDict);
+}
+
+
+var typingSentAt = {};
+
+function sendTyping(roomName, msgType) {
+    if (msgType == MSG_TYPING_START) {
+        if (Date.now() - (typingSentAt[roomName] || 0) < TYPING_REFRESH_MS) {
+            return;
+        }
+        typingSentAt[roomName] = Date.now();
+    } else {
+        delete typingSentAt[roomName];
+    }
+
+    var msgDict = {
+        "msgType": msgType,
+        "senderId": senderId,
+        "room": roomName
+    };
+    send(msgDict);
+}
+
+
+function requestHistory(roomName) {
+    var msgDict = {
+        "msgType": MSG_HISTORY_REQUEST,
+        "senderId": senderId,
+        "room": roomName,
+        "before": oldestSequences[roomName] || 0
+    };
+    send(msgDict);
+}
+
+
+function sendDirectMessage() {
+    var recipientInput = document.getElementById(ID_DIRECT_RECIPIENT_INPUT);
+    var contentInput = document.getElementById(ID_DIRECT_CONTENT_INPUT);
+    if (!recipientInput.value || !contentInput.value) {
+        return;
+    }
+
+    var msgDict = {
+        "msgType": MSG_DIRECT,
+        "senderId": senderId,
+        "recipient": recipientInput.value,
+        "content": contentInput.value,
+        "clientMsgId": newClientMsgId()
+    };
+    send(msgDict);
+
+    contentInput.value = "";
+}
+
+
+function requestConversations() {
+    var msgDict = {
+        "msgType": MSG_CONVERSATIONS_LIST,
+        "senderId": senderId
+    };
+    send(msgDict);
+}
+
+
+function requestDirectHistory(peer) {
+    var msgDict = {
+        "msgType": MSG_HISTORY_REQUEST,
+        "senderId": senderId,
+        "recipient": peer
+    };
     send(msgDict);
 }
 
 
 function onConnect(event) {
     console.log(event);
+    reconnectDelay = RECONNECT_MIN_DELAY_MS;
+    sendHello();
+    if (connected) {
+        document.getElementById('connection-info').style.display = 'none';
+        resume();
+        return;
+    }
+    connected = true;
+
     document.getElementById('connection-info').style.display = 'none';
     document.getElementById('panels').style.display = 'block';
     document.getElementById('logout-info').style.display = 'block';
     document.getElementById('ch-create').onclick = sendCreateRoomMessage;
+    document.getElementById('dm-send').onclick = sendDirectMessage;
+
+    requestConversations();
 }
 
 
@@ -103,6 +294,48 @@ function setFocusOnTab(roomName) {
     document.getElementById(createRoomTabId(roomName)).classList.add("active");
     document.getElementById(createContentPanelId(roomName)).style.display = "block";
     document.getElementById(createMessageInputId(roomName)).focus();
+
+    activeRoom = roomName;
+    markRead(roomName);
+}
+
+
+function markRead(roomName) {
+    if (!lastSequences[roomName] || !unreadCounts[roomName]) {
+        return;
+    }
+
+    var msgDict = {
+        "msgType": MSG_MARK_READ,
+        "senderId": senderId,
+        "room": roomName,
+        "seq": lastSequences[roomName]
+    };
+    send(msgDict);
+}
+
+
+function updateUnreadCount(roomName, count) {
+    unreadCounts[roomName] = count;
+
+    var badge = document.getElementById("unread-" + escapeText(roomName));
+    if (badge) {
+        badge.innerText = count > 0 ? count : "";
+    }
+}
+
+
+function countMessage(msg) {
+    if (!msg['seq'] || msg['seq'] <= (lastSequences[msg['room']] || 0)) {
+        return;
+    }
+
+    lastSequences[msg['room']] = msg['seq'];
+    updateUnreadCount(msg['room'], (unreadCounts[msg['room']] || 0) + 1);
+
+    if (msg['room'] == activeRoom && document.hasFocus()) {
+        markRead(msg['room']);
+    }
 }
 
 
@@ -124,27 +357,19 @@ function generateSendMessageOnClickListener(room, msgInput) {
             return;
         }
 
-        msg = {
+        var msg = {
+            "msgType": MSG_TEXT,
             "senderId": senderId,
             "room": room,
-            "senderName": senderName
-        }
-
-        if (text == "exit") {
-            if (room == MAIN_ROOM_NAME) {
-                return;
-            }
-            msg["msgType"] = MSG_USER_LEFT_ROOM;
-        } else if (text == "logout") {
-            msg["msgType"] = MSG_LOGOUT;
-        } else {
-            msg["msgType"] = MSG_TEXT;
-            msg["content"] = text;
-        }
+            "senderName": senderName,
+            "content": text,
+            "clientMsgId": newClientMsgId()
+        };
 
         console.log("Sending message: '" + msg + "'");
 
         send(msg);
+        sendTyping(room, MSG_TYPING_STOP);
 
         msgInput.value = "";
     }
@@ -176,6 +401,8 @@ function addRoomTab(roomName) {
     msgTextInput.addEventListener("keydown", function (event) {
         if (event.key === "Enter") {
             generateSendMessageOnClickListener(roomName, msgTextInput)();
+        } else {
+            sendTyping(roomName, MSG_TYPING_START);
         }
     });
 
@@ -195,15 +422,35 @@ function addRoomTab(roomName) {
     inputGroupDiv.appendChild(msgTextInput);
     inputGroupDiv.appendChild(sendMsgSpan);
 
+    var olderMsgsLink = document.createElement("a");
+    olderMsgsLink.text = "Show older messages";
+    olderMsgsLink.href = "#";
+    olderMsgsLink.onclick = () => requestHistory(roomName);
+
+    var infoParagraph = document.createElement("p");
+    infoParagraph.id = createInfoPanelId(roomName);
+
+    var membersParagraph = document.createElement("p");
+    membersParagraph.id = createMembersPanelId(roomName);
+
+    var typingParagraph = document.createElement("p");
+    typingParagraph.id = createTypingPanelId(roomName);
+
     var contentDiv = document.createElement("div");
     contentDiv.id = createContentPanelId(roomName);
     contentDiv.appendChild(document.createElement("br"));
+    contentDiv.appendChild(infoParagraph);
+    contentDiv.appendChild(membersParagraph);
     contentDiv.appendChild(inputGroupDiv);
+    contentDiv.appendChild(typingParagraph);
     contentDiv.appendChild(document.createElement("br"));
+    contentDiv.appendChild(olderMsgsLink);
     contentDiv.appendChild(conversationDiv);
 
     var content = document.getElementById('ch-contents');
     content.appendChild(contentDiv);
+
+    renderRoomInfo(roomName);
 }
 
 
@@ -225,7 +472,7 @@ function existingRooms() {
     var rooms = roomsList.getElementsByTagName('a');
     var names = [];
     for (let i = 0; i < rooms.length; i++) {
-        var roomName = rooms[i].text;
+        var roomName = rooms[i].dataset.room;
         names.push(roomName);
     }
     return names;
@@ -238,11 +485,18 @@ function addRoomToRoomsList(roomName) {
         return;
     }
 
+    var unreadBadge = document.createElement("span");
+    unreadBadge.id = "unread-" + escapeText(roomName);
+    unreadBadge.classList.add("badge");
+    unreadBadge.innerText = unreadCounts[roomName] > 0 ? unreadCounts[roomName] : "";
+
     var roomLinkElem = document.createElement("a");
     roomLinkElem.text = roomName;
+    roomLinkElem.dataset.room = roomName;
     roomLinkElem.classList.add("list-group-item");
     roomLinkElem.href = "#";
     roomLinkElem.onclick = createSelectRoomOnClickListener(roomName);
+    roomLinkElem.appendChild(unreadBadge);
 
     var roomLinksList = document.getElementById(ID_ROOM_NAMES_LIST);
     roomLinksList.appendChild(roomLinkElem);
@@ -287,12 +541,408 @@ function refreshRoomsList(roomList) {
 }
 
 
-function displayMessage(roomName, senderName, content) {
+function rememberMessageSequence(roomName, sequence) {
+    if (sequence && (!oldestSequences[roomName] || sequence < oldestSequences[roomName])) {
+        oldestSequences[roomName] = sequence;
+    }
+}
+
+
+function messageText(msg) {
+    var author = msg['senderNick'] || msg['senderName'];
+    var prefix = msg['recipient'] ? "(direct) " + author + " -> " + msg['recipient'] : author;
+    if (msg['deleted']) {
+        return prefix + ": (deleted)";
+    }
+    return prefix + ": " + msg['content'] + (msg['edited'] ? " (edited)" : "");
+}
+
+
+function sendMessageChange(msgType, msgId, content) {
+    var msgDict = {
+        "msgType": msgType,
+        "senderId": senderId,
+        "id": msgId,
+        "content": content
+    };
+    send(msgDict);
+}
+
+
+function sendReaction(msgType, msgId, emoji) {
+    var msgDict = {
+        "msgType": msgType,
+        "senderId": senderId,
+        "id": msgId,
+        "emoji": emoji
+    };
+    send(msgDict);
+}
+
+
+function sendReply(parent, content) {
+    var msgDict = {
+        "msgType": MSG_TEXT,
+        "senderId": senderId,
+        "room": parent['room'],
+        "parentId": parent['id'],
+        "content": content,
+        "clientMsgId": newClientMsgId()
+    };
+    send(msgDict);
+}
+
+
+function requestThread(parentId) {
+    var msgDict = {
+        "msgType": MSG_THREAD_REQUEST,
+        "senderId": senderId,
+        "parentId": parentId
+    };
+    send(msgDict);
+}
+
+
+function reacted(msg, emoji) {
+    var reaction = (msg['reactions'] || []).find((r) => r['emoji'] == emoji);
+    return reaction != null && reaction['users'].includes(senderName);
+}
+
+
+function createReactionLink(msg, emoji, count) {
+    var reactionLink = document.createElement("a");
+    reactionLink.text = " " + emoji + (count ? " " + count : "");
+    reactionLink.href = "#";
+    reactionLink.onclick = () => sendReaction(reacted(msg, emoji) ? MSG_UNREACT : MSG_REACT, msg['id'], emoji);
+    return reactionLink;
+}
+
+
+function applyReaction(msg, emoji, userName, added) {
+    var reactions = msg['reactions'] || [];
+    var reaction = reactions.find((r) => r['emoji'] == emoji);
+    if (!reaction) {
+        reaction = {"emoji": emoji, "count": 0, "users": []};
+        reactions.push(reaction);
+    }
+
+    reaction['users'] = reaction['users'].filter((u) => u != userName);
+    if (added) {
+        reaction['users'].push(userName);
+    }
+    reaction['count'] = reaction['users'].length;
+
+    msg['reactions'] = reactions.filter((r) => r['count'] > 0);
+}
+
+
+function createMessageParagraph(msg) {
+    if (msg['id']) {
+        displayedMessages[msg['id']] = msg;
+    }
+
     var textParagraph = document.createElement("p");
-    textParagraph.innerText = senderName + ": " + content;
+    if (msg['id']) {
+        textParagraph.id = ID_PREFIX_MESSAGE + msg['id'];
+    }
+    if (msg['parentId']) {
+        textParagraph.style.marginLeft = "30px";
+    }
+
+    var textSpan = document.createElement("span");
+    textSpan.innerText = messageText(msg);
+    textParagraph.appendChild(textSpan);
+
+    if (msg['id'] && msg['senderName'] == senderName && !msg['deleted']) {
+        var editLink = document.createElement("a");
+        editLink.text = " [edit]";
+        editLink.href = "#";
+        editLink.onclick = () => {
+            var content = prompt("Edit message", msg['content']);
+            if (content) {
+                sendMessageChange(MSG_EDIT, msg['id'], content);
+            }
+        };
+
+        var deleteLink = document.createElement("a");
+        deleteLink.text = " [delete]";
+        deleteLink.href = "#";
+        deleteLink.onclick = () => sendMessageChange(MSG_DELETE, msg['id']);
+
+        textParagraph.appendChild(editLink);
+        textParagraph.appendChild(deleteLink);
+    }
+
+    if (msg['id'] && !msg['deleted'] && !msg['parentId'] && !msg['recipient']) {
+        var replyLink = document.createElement("a");
+        replyLink.text = " [reply]";
+        replyLink.href = "#";
+        replyLink.onclick = () => {
+            var content = prompt("Reply in thread");
+            if (content) {
+                sendReply(msg, content);
+            }
+        };
+        textParagraph.appendChild(replyLink);
+
+        if (msg['replyCount']) {
+            var threadLink = document.createElement("a");
+            threadLink.text = " [" + msg['replyCount'] + " replies]";
+            threadLink.href = "#";
+            threadLink.onclick = () => requestThread(msg['id']);
+            textParagraph.appendChild(threadLink);
+        }
+    }
+
+    if (msg['id'] && !msg['deleted']) {
+        var shown = [];
+        (msg['reactions'] || []).forEach((reaction) => {
+            textParagraph.appendChild(createReactionLink(msg, reaction['emoji'], reaction['count']));
+            shown.push(reaction['emoji']);
+        });
+        QUICK_REACTIONS.filter((emoji) => !shown.includes(emoji)).forEach((emoji) => {
+            textParagraph.appendChild(createReactionLink(msg, emoji, 0));
+        });
+    }
+
+    return textParagraph;
+}
+
+
+function displayMessage(msg) {
+    if (msg['parentId']) {
+        displayReply(msg);
+        return;
+    }
+
+    if (msg['id'] && document.getElementById(ID_PREFIX_MESSAGE + msg['id'])) {
+        return;
+    }
+
+    var conversationDiv = document.getElementById(createConversationPanelId(msg['room']));
+    conversationDiv.appendChild(createMessageParagraph(msg));
+
+    rememberMessageSequence(msg['room'], msg['seq']);
+}
+
 
+function displayReply(reply) {
+    var parent = displayedMessages[reply['parentId']];
+    var parentParagraph = document.getElementById(ID_PREFIX_MESSAGE + reply['parentId']);
+    if (!parent || !parentParagraph || document.getElementById(ID_PREFIX_MESSAGE + reply['id'])) {
+        return;
+    }
+
+    var lastReply = parentParagraph;
+    while (lastReply.nextSibling && lastReply.nextSibling.style.marginLeft) {
+        lastReply = lastReply.nextSibling;
+    }
+    lastReply.after(createMessageParagraph(reply));
+
+    if (reply['msgType'] == MSG_TEXT) {
+        parent['replyCount'] = (parent['replyCount'] || 0) + 1;
+        parent['lastReply'] = reply['time'];
+        displayMessageChange(parent);
+    }
+}
+
+
+function displayThreadPage(threadMsg) {
+    (threadMsg['messages'] || []).forEach((reply) => {
+        reply['msgType'] = MSG_THREAD_PAGE;
+        displayReply(reply);
+    });
+}
+
+
+function displayReaction(reactionMsg) {
+    var msg = displayedMessages[reactionMsg['id']];
+    if (!msg) {
+        return;
+    }
+
+    applyReaction(msg, reactionMsg['emoji'], reactionMsg['senderName'], reactionMsg['msgType'] == MSG_REACT);
+    displayMessageChange(msg);
+}
+
+
+function displayMessageChange(msg) {
+    var textParagraph = document.getElementById(ID_PREFIX_MESSAGE + msg['id']);
+    if (textParagraph) {
+        textParagraph.replaceWith(createMessageParagraph(msg));
+    }
+}
+
+
+function displayHistoryPage(roomName, messages) {
     var conversationDiv = document.getElementById(createConversationPanelId(roomName));
-    conversationDiv.appendChild(textParagraph);
+
+    messages.slice().reverse().forEach((msg) => {
+        conversationDiv.insertBefore(createMessageParagraph(msg), conversationDiv.firstChild);
+
+        rememberMessageSequence(roomName, msg['seq']);
+    });
+}
+
+
+function renameRoom(previousName, roomName) {
+    document.querySelectorAll("#" + ID_ROOM_NAMES_LIST + " a").forEach((link) => {
+        if (link.dataset.room == previousName) {
+            link.remove();
+        }
+    });
+    addRoomToRoomsList(roomName);
+
+    if (isTabOpened(previousName)) {
+        removeRoomTab(previousName);
+        document.getElementById(createContentPanelId(previousName)).remove();
+        addRoomTab(roomName);
+        setFocusOnTab(roomName);
+        requestHistory(roomName);
+    }
+}
+
+function displayRoomInfo(msg) {
+    var info = msg['info'];
+    roomInfos[info['name']] = info;
+    if (msg['previousRoom']) {
+        delete roomInfos[msg['previousRoom']];
+        renameRoom(msg['previousRoom'], info['name']);
+    }
+
+    renderRoomInfo(info['name']);
+}
+
+function renderRoomInfo(roomName) {
+    var info = roomInfos[roomName];
+    var infoParagraph = document.getElementById(createInfoPanelId(roomName));
+    if (!info || !infoParagraph) {
+        return;
+    }
+
+    var text = info['topic'] ? info['topic'] : "No topic";
+    if (info['description']) {
+        text += " - " + info['description'];
+    }
+    text += " (owner: " + info['owner'] + ")";
+    infoParagraph.innerText = text;
+}
+
+
+function displayRoomEvent(roomName, text) {
+    var conversationDiv = document.getElementById(createConversationPanelId(roomName));
+    if (!conversationDiv) {
+        return;
+    }
+
+    var eventParagraph = document.createElement("p");
+    eventParagraph.innerHTML = "<i></i>";
+    eventParagraph.firstChild.innerText = text;
+    conversationDiv.appendChild(eventParagraph);
+}
+
+
+function answerInvitation(msg) {
+    var accepted = confirm(msg['senderName'] + " invites you to room " + msg['room'] + ". Accept?");
+    var msgDict = {
+        "msgType": accepted ? MSG_INVITE_ACCEPT : MSG_INVITE_DECLINE,
+        "senderId": senderId,
+        "room": msg['room']
+    };
+    send(msgDict);
+}
+
+function displayInvitationAnswer(msg) {
+    var answer = msg['msgType'] == MSG_INVITE_ACCEPT ? " accepted" : " declined";
+    var text = msg['senderName'] + answer + " invitation to room " + msg['room'];
+
+    if (isTabOpened(msg['room'])) {
+        displayRoomEvent(msg['room'], text);
+    } else {
+        handleErrors(text);
+    }
+}
+
+
+function displayModeration(msg) {
+    var actions = {};
+    actions[MSG_KICK_USER] = "kicked";
+    actions[MSG_BAN_USER] = "banned";
+    actions[MSG_MUTE_USER] = "muted";
+    actions[MSG_ADD_MODERATOR] = "made moderator";
+    actions[MSG_REMOVE_MODERATOR] = "removed from moderators";
+
+    var text = targetName(msg) + " was " + actions[msg['msgType']] + " by " + msg['senderName'];
+    if (msg['until']) {
+        text += " until " + new Date(msg['until']).toLocaleString();
+    }
+
+    if (isTabOpened(msg['room'])) {
+        displayRoomEvent(msg['room'], text);
+    } else {
+        handleErrors(text);
+    }
+}
+
+function targetName(msg) {
+    return msg['target'] == senderName ? "You" : msg['target'];
+}
+
+
+function displayRoomMembers(roomName, members) {
+    var membersParagraph = document.getElementById(createMembersPanelId(roomName));
+    if (!membersParagraph) {
+        return;
+    }
+
+    membersParagraph.innerText = "Members: " + members.join(", ");
+}
+
+
+function displayTyping(roomName, userName, typing) {
+    var typers = typingUsers[roomName] || new Map();
+    clearTimeout(typers.get(userName));
+    if (typing) {
+        typers.set(userName, setTimeout(function () {
+            displayTyping(roomName, userName, false);
+        }, TYPING_EXPIRY_MS));
+    } else {
+        typers.delete(userName);
+    }
+    typingUsers[roomName] = typers;
+
+    var typingParagraph = document.getElementById(createTypingPanelId(roomName));
+    if (!typingParagraph) {
+        return;
+    }
+
+    typingParagraph.innerText = typers.size > 0 ? Array.from(typers.keys()).join(", ") + " typing..." : "";
+}
+
+
+function displayDirectMessage(msg) {
+    var conversationDiv = document.getElementById(createConversationPanelId(MAIN_ROOM_NAME));
+    conversationDiv.appendChild(createMessageParagraph(msg));
+}
+
+
+function refreshConversationsList(conversations) {
+    var list = document.getElementById(ID_CONVERSATIONS_LIST);
+    while (list.firstChild) {
+        list.firstChild.remove();
+    }
+
+    conversations.forEach((conversation) => {
+        var peerLinkElem = document.createElement("a");
+        peerLinkElem.text = "@" + conversation['peer'];
+        peerLinkElem.classList.add("list-group-item");
+        peerLinkElem.href = "#";
+        peerLinkElem.onclick = () => {
+            document.getElementById(ID_DIRECT_RECIPIENT_INPUT).value = conversation['peer'];
+            requestDirectHistory(conversation['peer']);
+        };
+        list.appendChild(peerLinkElem);
+    });
 }
 
 
@@ -345,23 +995,79 @@ function addAttribute(elem, name, value) {
 
 
 function logout() {
-    wsSocket.close();
+    loggingOut = true;
+    socket.close();
     window.location.href = "/logout";
 }
 
 
+function onDisconnect(event) {
+    console.log("Connection closed: " + event.code + " " + event.reason);
+    if (event.reason) {
+        handleErrors("Disconnected: " + event.reason);
+    }
+
+    if (loggingOut) {
+        return;
+    }
+
+    document.getElementById('connection-info').style.display = 'block';
+    setTimeout(connect, reconnectDelay);
+    reconnectDelay = Math.min(reconnectDelay * 2, RECONNECT_MAX_DELAY_MS);
+}
+
+
+function resume() {
+    var sequences = {};
+    var rooms = document.getElementById(ID_ROOM_TABS_LIST).getElementsByTagName('a');
+    for (let i = 0; i < rooms.length; i++) {
+        sequences[rooms[i].text] = lastSequences[rooms[i].text] || 0;
+    }
+
+    send({ "msgType": MSG_RESUME, "senderId": senderId, "sequences": sequences });
+}
+
+
+function closeNotResumedTabs(resumedRooms) {
+    var rooms = document.getElementById(ID_ROOM_TABS_LIST).getElementsByTagName('a');
+    Array.from(rooms).map((room) => room.text)
+        .filter((room) => !resumedRooms.includes(room))
+        .forEach((room) => removeRoomTab(room));
+}
+
+
+function clearConversation(roomName) {
+    var conversationDiv = document.getElementById(createConversationPanelId(roomName));
+    if (conversationDiv) {
+        conversationDiv.replaceChildren();
+    }
+}
+
+
 function handleMessage(message) {
     var stringMsg = message['data'];
     console.log("Received: " + stringMsg);
-    var jsonMsg = JSON.parse(stringMsg);
-    var msgType = jsonMsg['msgType'];
+    var envelope = JSON.parse(stringMsg);
+    var msgType = envelope['type'];
+    var jsonMsg = envelope['payload'] || {};
+    jsonMsg['msgType'] = msgType;
+    jsonMsg['requestId'] = envelope['requestId'];
     switch (msgType) {
         case MSG_ROOMS_LIST:
             var rooms = jsonMsg['rooms'];
+            (jsonMsg['protected'] || []).forEach((room) => protectedRooms.add(room));
+            Object.entries(jsonMsg['unread'] || {}).forEach(([room, count]) => updateUnreadCount(room, count));
             refreshRoomsList(rooms);
             break;
+        case MSG_MARK_READ:
+            lastSequences[jsonMsg['room']] = Math.max(lastSequences[jsonMsg['room']] || 0, jsonMsg['seq']);
+            updateUnreadCount(jsonMsg['room'], jsonMsg['unread'][jsonMsg['room']]);
+            break;
         case MSG_CREATE_ROOM:
             var room = jsonMsg['room'];
+            if (jsonMsg['visibility'] == VISIBILITY_PASSWORD) {
+                protectedRooms.add(room);
+            }
             addRoomToRoomsList(room);
             break;
         case MSG_REMOVE_ROOM:
@@ -370,24 +1076,106 @@ function handleMessage(message) {
             break;
         case MSG_USER_JOINED_ROOM:
             var room = jsonMsg['room'];
-            addRoomTab(room);
-            setFocusOnTab(room);
+            if (jsonMsg['senderName'] == senderName) {
+                if (isTabOpened(room)) {
+                    break;
+                }
+                addRoomTab(room);
+                setFocusOnTab(room);
+            } else {
+                displayRoomEvent(room, jsonMsg['senderName'] + " joined the room");
+            }
             break;
         case MSG_USER_LEFT_ROOM:
             var room = jsonMsg['room'];
-            removeRoomTab(room);
-            removeRoomFromRoomsList(room);
+            if (jsonMsg['senderName'] == senderName) {
+                removeRoomTab(room);
+                removeRoomFromRoomsList(room);
+            } else {
+                displayRoomEvent(room, jsonMsg['senderName'] + " left the room");
+            }
+            break;
+        case MSG_TYPING_START:
+            displayTyping(jsonMsg['room'], jsonMsg['senderName'], true);
+            break;
+        case MSG_TYPING_STOP:
+            displayTyping(jsonMsg['room'], jsonMsg['senderName'], false);
+            break;
+        case MSG_COMMAND_RESULT:
+            jsonMsg['content'].split("\n").forEach((line) => displayRoomEvent(jsonMsg['room'], line));
+            break;
+        case MSG_ROOM_INFO:
+            displayRoomInfo(jsonMsg);
+            break;
+        case MSG_RESUME:
+            closeNotResumedTabs(jsonMsg['rooms'] || []);
+            break;
+        case MSG_RESYNC:
+            clearConversation(jsonMsg['room']);
+            break;
+        case MSG_INVITE:
+            answerInvitation(jsonMsg);
+            break;
+        case MSG_INVITE_ACCEPT:
+        case MSG_INVITE_DECLINE:
+            displayInvitationAnswer(jsonMsg);
+            break;
+        case MSG_KICK_USER:
+        case MSG_BAN_USER:
+        case MSG_MUTE_USER:
+        case MSG_ADD_MODERATOR:
+        case MSG_REMOVE_MODERATOR:
+            displayModeration(jsonMsg);
+            break;
+        case MSG_ROOM_MEMBERS:
+            displayRoomMembers(jsonMsg['room'], jsonMsg['members'] || []);
             break;
         case MSG_TEXT:
-            displayMessage(jsonMsg['room'], jsonMsg['senderName'], jsonMsg['content']);
+            displayMessage(jsonMsg);
+            countMessage(jsonMsg);
+            break;
+        case MSG_EDIT:
+        case MSG_DELETE:
+            displayMessageChange(jsonMsg);
+            break;
+        case MSG_THREAD_PAGE:
+            displayThreadPage(jsonMsg);
+            break;
+        case MSG_REACT:
+        case MSG_UNREACT:
+            displayReaction(jsonMsg);
+            break;
+        case MSG_HISTORY_PAGE:
+            if (jsonMsg['recipient']) {
+                (jsonMsg['messages'] || []).forEach(displayDirectMessage);
+            } else {
+                displayHistoryPage(jsonMsg['room'], jsonMsg['messages'] || []);
+            }
+            break;
+        case MSG_DIRECT:
+            displayDirectMessage(jsonMsg);
+            requestConversations();
+            break;
+        case MSG_CONVERSATIONS_LIST:
+            refreshConversationsList(jsonMsg['conversations'] || []);
+            break;
+        case MSG_ACK:
+            console.log("Message " + jsonMsg['clientMsgId'] + " accepted as " + jsonMsg['id']);
             break;
         case MSG_ERROR:
+            console.log("Request " + jsonMsg['requestId'] + " failed with " + jsonMsg['code']);
             var content = jsonMsg['content'];
             handleErrors(content);
             break;
+        case MSG_HELLO:
+            console.log("Protocol version " + jsonMsg['version'] + ", features: " + (jsonMsg['features'] || []).join(", "));
+            break;
         case MSG_LOGOUT:
             logout();
             break;
+        case MSG_PING:
+            send({ msgType: MSG_PONG });
+            break;
         default:
             console.log(`Unknown message type ${msgType}.`);
     }
@@ -395,7 +1183,151 @@ function handleMessage(message) {
 
 
 var host = window.location.hostname + (window.location.port != null ? ':' + window.location.port : '');
-var wsSocket = new WebSocket("ws://" + host + "/talk");
+const RECONNECT_MIN_DELAY_MS = 1000;
+const RECONNECT_MAX_DELAY_MS = 30000;
+const POLL_RETRIES = 3;
+const POLL_RETRY_DELAY_MS = 1000;
+
+// Transports are tried in this order. If one of them cannot connect at all
+// (e.g. a proxy blocks websockets), the next one is used from then on.
+const TRANSPORTS = ["websocket", "sse", "poll"];
+
+var socket;
+var transportIndex = 0;
+var connected = false;
+var loggingOut = false;
+var reconnectDelay = RECONNECT_MIN_DELAY_MS;
+
+
+// HttpTransport exchanges messages through HTTP requests. It has the same
+// callbacks and methods as WebSocket. Messages are posted one by one, so
+// they reach the server in order.
+function HttpTransport(postUrl) {
+    this.token = null;
+    this.closed = false;
+    this.pending = Promise.resolve();
+    this.postUrl = postUrl;
+}
+
+HttpTransport.prototype.send = function (data) {
+    this.pending = this.pending
+        .then(() => fetch(this.postUrl + this.token, { method: "POST", headers: { "Content-Type": "application/json" }, body: data }))
+        .then((resp) => {
+            if (!resp.ok) {
+                throw new Error("Sending failed with status " + resp.status);
+            }
+        })
+        .catch((err) => this.finish(err.message));
+};
+
+HttpTransport.prototype.close = function () {
+    this.finish("");
+};
+
+HttpTransport.prototype.finish = function (reason) {
+    if (this.closed) {
+        return;
+    }
+    this.closed = true;
+    console.log("Transport closed: " + reason);
+    this.onclose({ "code": 0, "reason": "" });
+};
+
+
+// SseTransport receives messages as Server-Sent Events and posts messages with HTTP requests.
+function SseTransport() {
+    HttpTransport.call(this, "/sse/");
+
+    this.source = new EventSource("/sse");
+    this.source.addEventListener("token", (event) => {
+        this.token = event.data;
+        this.onopen(event);
+    });
+    this.source.onmessage = (event) => this.onmessage(event);
+    // EventSource would reconnect by itself, but it would be a new connection, so it is closed instead
+    this.source.onerror = () => this.close();
+}
+
+SseTransport.prototype = Object.create(HttpTransport.prototype);
+
+SseTransport.prototype.close = function () {
+    this.source.close();
+    this.finish("");
+};
+
+
+// PollTransport receives messages with long-polling requests and posts messages with HTTP requests.
+// Each poll acknowledges the batch of messages received by the previous one, so if a response
+// is lost, the failed poll is retried and the server returns the same batch again.
+function PollTransport() {
+    HttpTransport.call(this, "/poll/");
+    this.acked = 0;
+
+    fetch("/poll", { method: "POST" })
+        .then((resp) => resp.ok ? resp.json() : Promise.reject(new Error("Opening failed with status " + resp.status)))
+        .then((body) => {
+            this.token = body["token"];
+            this.onopen({ "transport": "poll" });
+            this.poll();
+        })
+        .catch((err) => this.finish(err.message));
+}
+
+PollTransport.prototype = Object.create(HttpTransport.prototype);
+
+PollTransport.prototype.poll = function (retries = 0) {
+    if (this.closed) {
+        return;
+    }
+
+    fetch("/poll/" + this.token + "?ack=" + this.acked)
+        .then((resp) => resp.ok ? resp.json() : Promise.reject(new Error("Polling failed with status " + resp.status)))
+        .then((body) => {
+            if (body["batch"] > this.acked) {
+                body["envelopes"].forEach((envelope) => this.onmessage({ "data": JSON.stringify(envelope) }));
+                this.acked = body["batch"];
+            }
+            this.poll();
+        }, (err) => {
+            if (err instanceof TypeError && retries < POLL_RETRIES) {
+                setTimeout(() => this.poll(retries + 1), POLL_RETRY_DELAY_MS);
+                return;
+            }
+            this.finish(err.message);
+        });
+};
+
+
+function openTransport(name) {
+    switch (name) {
+        case "sse":
+            return new SseTransport();
+        case "poll":
+            return new PollTransport();
+        default:
+            return new WebSocket("ws://" + host + "/talk", ["chat.json"]);
+    }
+}
+
+
+function connect() {
+    var opened = false;
+
+    socket = openTransport(TRANSPORTS[transportIndex]);
+    socket.onopen = (event) => {
+        opened = true;
+        onConnect(event);
+    };
+    socket.onmessage = handleMessage;
+    socket.onclose = (event) => {
+        if (!opened && !loggingOut && transportIndex < TRANSPORTS.length - 1) {
+            transportIndex++;
+            console.log("Falling back to " + TRANSPORTS[transportIndex] + " transport");
+            connect();
+            return;
+        }
+        onDisconnect(event);
+    };
+}
 
-wsSocket.onopen = onConnect;
-wsSocket.onmessage = handleMessage;
+connect();